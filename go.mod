@@ -0,0 +1,3 @@
+module github.com/bhargMV/Spreadsheet
+
+go 1.22
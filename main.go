@@ -4,269 +4,5186 @@
     1) setCellValue(cellId, Value)
     2) getCellValue(cellId)
     
-    cellId is of the format "<Alphabet in caps><Row Number>"
+    cellId is of the format "<Alphabets in caps><Row Number>"
     Note:
-    - Alphabet in caps corresponds to the column.
-    - Row Number is > 1
-    - Value is string represnetation of an integer or a mathematical formula.
-    - Formula starts with =
+    - Alphabets in caps correspond to the column: A..Z, then AA..AZ, BA..ZZ, AAA and so on.
+      Lower case alphabets are accepted as well, in cell IDs and in formulas. Ex: "a1" is "A1".
+    - Row Number is >= 1
+    - Value is string represnetation of a number (Ex: "10", "-2.5", "2.5e-1", "1_000"), a
+      mathematical formula or text (Ex: "Hello"). A formula that uses text as a number has the
+      error #VALUE!, but functions of ranges such as SUM ignore text.
+    - Formula starts with =. Whitespace around the =, operators and cell IDs is ignored.
+      Ex: "= A1 + SUM(B1 : B5)"
     
     Assumptions:
-    - Max number of columns: 26
-    - Formula supports only addition and subtraction of cell IDs and numbers. Ex: "=A1+B2-C3+10"
-    - Formula supports range sum. Ex: A1:A5, A1:C4 etc
+    - Max number of columns: 16384 (A..XFD) by default, see WithMaxColumns
+    - Formula supports addition, subtraction, multiplication and division of cell IDs and numbers.
+      Ex: "=A1+B2-C3*10/D4"
+    - * and / are applied before + and -. Operators of the same precedence are applied from left
+      to right. Ex: "=2+3*4" is 14.
+    - Parentheses group sub-expressions, which are evaluated first. Ex: "=(A1+B2)*C3"
+    - Formula supports functions whose arguments are expressions or ranges separated by commas.
+      Function names are case insensitive, so "=sum(A1:A5)" is "=SUM(A1:A5)".
+      Supported functions:
+      - SUM: sum of the arguments. Ex: "=SUM(A1:A5,B1,10)"
+      - AVERAGE: arithmetic mean of the arguments. Every cell of a range counts toward the
+        divisor, including cells that are not set. Ex: "=AVERAGE(A1:A10)"
+      - MIN, MAX: smallest and largest of the arguments. Ex: "=MIN(A1:C3)", "=MAX(A1,B1)"
+      - ABS: absolute value of the argument. Ex: "=ABS(A1-B1)"
+      - MOD: remainder of dividing the first argument by the second, with the sign of the
+        second. Ex: "=MOD(A1,3)"
+      - POWER: first argument raised to the power of the second. Ex: "=POWER(A1,2)"
+      - ROUND: first argument rounded to the number of decimal places given by the second, which
+        defaults to 0. Halves are rounded away from zero. Ex: "=ROUND(A1,2)"
+      - FLOOR, CEIL: argument rounded down and up to an integer. Ex: "=FLOOR(A1)", "=CEIL(A1)"
+      - COUNT: number of arguments that are numbers. Cells that are not set are not counted.
+        Cells that hold text are not counted either. Ex: "=COUNT(A1:A10)"
+      - COUNTA: number of arguments that are not empty. Ex: "=COUNTA(A1:A10)"
+      - IF: the second argument if the first is not 0, else the third, which defaults to 0. Only
+        the chosen argument is evaluated. Ex: "=IF(A1>B1,A1,B1)"
+      - CONCATENATE: arguments joined as text. Ex: "=CONCATENATE(A1," ",B1)"
+      - PRODUCT: product of the arguments. Cells that are not set are 0, so the product is 0.
+        Ex: "=PRODUCT(A1:A4,2)"
+      - SUMIF: sum of the cells of a range that meet a criterion, which is a comparison operator
+        followed by a number or text, where the operator defaults to =. Cells that are not set are
+        0 when compared with a number. Ex: "=SUMIF(A1:A10,">5")", "=SUMIF(A1:A10,B1)"
+      - COUNTIF: number of cells of a range that meet a criterion, as in SUMIF. Cells that are not
+        set are counted by "=0" and by "=", which is equal to empty text, but not by "=x" for any
+        other text. Ex: "=COUNTIF(A1:A10,"<0")"
+    - Values can be compared with =, <>, <, >, <= and >=, which are applied after all other
+      operators. A comparison is 1 if it is true and 0 if it is false. If either value is text,
+      the values are compared as text, ignoring case. Ex: "=(A1>=10)*5"
+    - Text in double quotes can be used in formulas, with "" for a double quote in the text.
+      & joins values as text, and is applied after + and - and before comparisons. A formula
+      whose value is text holds the text. Ex: "=A1&" "&B1", "=IF(A1="Yes",1,0)"
+    - Values are floating point numbers. Ex: "=7/2" is 3.5. Whole values are printed as integers.
+    - A number in a formula followed by % is a percent. Ex: "=A1*10%" is A1*0.1
+    - A cell ID, number or sub-expression can be negated with a leading -. Ex: "=-A1", "=10+-3"
+    - Formula supports range sum. Ex: A1:A5, A1:C4 etc. The corners may be in any order, so A5:A1 is
+      A1:A5. A range may span a single row or column, as in A1:C1 and A1:A3, or a single cell, as
+      in A1:A1, which is the cell A1.
+    - A range of whole columns or rows, such as A:A, A:C or 1:1, has all the cells of the columns
+      or rows however many rows or columns the sheet has. Ex: "=SUM(B:B)" in A1. Such ranges move
+      like other ranges when columns or rows are inserted or deleted, or when the formula is copied.
     - Example formula with additon, subtraction and range: "=A1+B2-C3+10+A2:B3"
+    - A range is summed before the operator is applied. Ex: "=A1:A3*2" is twice the sum of A1, A2 and A3.
     - There is no cyclic dependency on the cell. Example: formula of A1 cannot be "=B1" and formula
-      of B1 cannot be "=A1" at the same time.
-    - By default, the value of each cell is 0.
+      of B1 cannot be "=A1" at the same time. A formula that would make a cycle, directly such as
+      "=A1+1" in A1 or through other formula cells, is rejected. So is a range that has the cell
+      of its formula, such as "=SUM(A1:C3)" in C3, including through a name defined for the range.
+      A sheet created with WithIterativeCalculation allows cycles and computes them iteratively.
+    - By default, a cell is not set (empty) and its value is 0, or the value given by WithDefault
+      when the sheet is created. Ex: CreateSpreadSheet(10, 10, WithDefault(1))
+    - A spreadsheet is safe for concurrent use by multiple goroutines.
+    - Division by zero is an error, #DIV/0!, and so is MOD by zero. A value that is not a finite
+      number, such as POWER(-8,0.5) or a sum larger than the largest float64 (about 1.8e308),
+      is the error #NUM!. A formula at the end of a chain of formula cells longer than the max
+      formula depth, 100000 by default, is the error #DEPTH!. A formula that refers to a cell with
+      an error has the same error.
+    - A $ before the column and/or row of a cell ID in a formula makes it absolute, so that it
+      doesn't change when the formula is copied to another cell. Ex: "=$A$1+$A2+A$3"
+    - Sheets of a workbook have names, and a formula may refer to the cells of another sheet of
+      its workbook by the sheet name. Ex: "=Sheet2!A1*2", "=SUM(Sheet2!A1:B5)"
+    - A name may be defined for a cell ID or range with DefineName and used in formulas in its
+      place. Ex: "=SUM(Revenue)" after defining Revenue as A1:A12. A formula that refers to a name
+      that is not defined is the error #NAME?, until the name is defined.
+    - Formula cells can be computed lazily, when their values are read, with SetLazyEvaluation.
+    - Large sheets that are mostly empty can be created with CreateSparseSpreadSheet, which only
+      allocates the cells that are set.
+    - The last 100 changes of cells can be undone with Undo and redone with Redo. Inserting or
+      deleting rows and columns and resizing the sheet discard them.
+    - When a row or column is deleted, references to its cells in formulas are replaced with
+      #REF!, which is an error. Ranges that span the deleted row or column shrink.
+    - Errors returned by the methods can be matched with errors.Is, such as ErrRowOutOfBounds and
+      ErrCyclicDependency, and with errors.As, such as CellIdError for the cell ID of the error.
 */
 
 package main
 
 import (
+    "bytes"
+    "encoding/csv"
+    "encoding/gob"
+    "encoding/json"
     "errors"
     "fmt"
+    "html"
+    "io"
+    "math"
+    "sort"
     "strings"
     "strconv"
+    "sync"
+    "unicode/utf8"
 )
 
 type Cell struct {
     // List of cells that are dependent on this cell. If this cell value is updated,
     // values of all the cells that dependent on this cell are updated simultaneously
-    // for displaying real time updated values of the affected cells.
+    // for displaying real time updated values of the affected cells. Cells that refer to this
+    // cell by a range of more than one cell are in SpreadSheet.rangeDependents instead.
     //
     // Note: Map data structure is used instead of a list for O(1) search/deletions.
     dependentCells map[string]interface{}
     
-    // Integer value of the cell. This is displayed in the UI.
-    value *int
+    // Numeric value of the cell. This is displayed in the UI.
+    //
+    // Note: value is nil if the cell is not set, in which case the value of the cell is 0.
+    value *float64
+    
+    // Text of the cell, if the cell holds text instead of a number or formula, or if the value of
+    // its formula is text. value is nil then.
+    text *string
     
     // Formula of the cell.
     formula *string
+    
+    // Length of the longest chain of formula cells that ends with the cell, where each cell of the
+    // chain refers to the one before it. It is 1 for a formula that doesn't refer to formula cells,
+    // and is only set for formula cells.
+    depth int
+    
+    // Parsed formula of the cell, so that the formula is not parsed each time the cell is
+    // recomputed or its dependees are updated. It is set with the formula, and is parsed again
+    // when names are defined or deleted or the formulas are rewritten.
+    expr Expr
+    
+    // Error of the formula of the cell, such as ErrDivByZero. If a formula refers to a cell with
+    // an error, the formula has the same error.
+    err error
+    
+    // Comment of the cell, or nil if it has none. It is independent of the value of the cell, so
+    // a cell that is not set may have a comment.
+    comment *string
+    
+    // True if the cell is locked, so that its contents cannot be changed. See LockCell.
+    locked bool
+    
+    // Number format of the cell, such as #,##0.00, or nil to display numbers as formatValue does.
+    // See SetCellFormat.
+    format *string
+}
+
+// Error of a formula that divides by zero.
+var ErrDivByZero = errors.New("#DIV/0!")
+
+// Error of a formula that refers to a cell that was deleted.
+var ErrRef = errors.New("#REF!")
+
+// Error of a formula that refers to a name that is not defined.
+var ErrName = errors.New("#NAME?")
+
+// Error of a formula that uses text where a number is expected, such as A1+1 where A1 is text.
+var ErrValue = errors.New("#VALUE!")
+
+// Error of a formula whose value is not a finite number, such as POWER(-8,0.5).
+var ErrNum = errors.New("#NUM!")
+
+// Error of a formula at the end of a chain of formula cells that is longer than the max formula
+// depth of the sheet.
+var ErrDepth = errors.New("#DEPTH!")
+
+// Errors returned by the methods of a sheet, which can be matched with errors.Is. The errors of
+// cell IDs, cycles and formulas are returned as CellIdError, CycleError and FormulaError with
+// the cell IDs or reason of the error, and the other errors are wrapped with their details.
+var (
+    // Cell ID whose column isn't alphabets, such as 1A.
+    ErrInvalidColumn = errors.New("Invalid column in cell ID")
+    // Cell ID whose row isn't a number of at least 1, such as A0.
+    ErrInvalidRow = errors.New("Invalid row in cell ID")
+    // Cell ID after the last row or column of its sheet.
+    ErrRowOutOfBounds = errors.New("Row out of bounds")
+    ErrColumnOutOfBounds = errors.New("Column out of bounds")
+    // Formula that refers to its own cell, directly or through other formulas.
+    ErrCyclicDependency = errors.New("Cyclic dependency")
+    // Formula that is malformed, such as =A1*/2.
+    ErrInvalidFormula = errors.New("Invalid formula")
+    // Formula with an operator that is missing an operand, such as =A1+, =+A1 or =A1++B2.
+    ErrDanglingOperator = errors.New("Dangling operator in formula")
+    // Sheet name that is invalid, is already used or is not a sheet of the workbook.
+    ErrInvalidSheetName = errors.New("Invalid sheet name")
+    ErrDuplicateSheet = errors.New("Workbook already has a sheet named")
+    ErrUnknownSheet = errors.New("Unknown sheet")
+    // Name that is invalid or is not defined, for DefineName and DeleteName.
+    ErrInvalidName = errors.New("Invalid name")
+    ErrUndefinedName = errors.New("Name is not defined")
+    // Dimensions of a sheet that are not positive, or have more columns than its max.
+    ErrInvalidDimensions = errors.New("Invalid sheet dimensions")
+    // Sheets of different dimensions, for Diff.
+    ErrDimensionMismatch = errors.New("Sheets have different dimensions")
+    ErrTooManyColumns = errors.New("Number of columns is more than the max")
+    // Row or column index that is outside the sheet, or is its only row or column for deleting.
+    ErrIndexOutOfBounds = errors.New("Index out of bounds")
+    ErrOnlyRowOrColumn = errors.New("Cannot delete the only row or column of the sheet")
+    // Cell that would be removed by Resize while a formula refers to it.
+    ErrCellReferenced = errors.New("Cell is referred to by a formula")
+    // Cell that is locked by LockCell, for updating it.
+    ErrCellLocked = errors.New("Cell is locked")
+    // Undo or redo when there is nothing to undo or redo.
+    ErrNothingToUndo = errors.New("Nothing to undo")
+    ErrNothingToRedo = errors.New("Nothing to redo")
+    // Argument that is invalid otherwise, such as a negative undo limit.
+    ErrInvalidArgument = errors.New("Invalid argument")
+    // CSV, JSON or snapshot that cannot be loaded.
+    ErrInvalidCSV = errors.New("Invalid CSV")
+    ErrInvalidJSON = errors.New("Invalid JSON")
+    ErrInvalidSnapshot = errors.New("Invalid snapshot")
+)
+
+// Error of a cell ID, which is one of ErrInvalidColumn, ErrInvalidRow, ErrRowOutOfBounds and
+// ErrColumnOutOfBounds. For the out of bounds errors, NumRows and NumCols are the dimensions of
+// the sheet of the cell, and are 0 otherwise.
+type CellIdError struct {
+    CellId string
+    Err error
+    NumRows, NumCols int
+}
+
+func (err *CellIdError) Error() string {
+    if err.NumRows > 0 || err.NumCols > 0 {
+        return fmt.Sprintf("%s: %s, sheet is %dx%d", err.Err.Error(), err.CellId, err.NumRows,
+            err.NumCols)
+    }
+    return err.Err.Error() + ": " + err.CellId
+}
+
+func (err *CellIdError) Unwrap() error {
+    return err.Err
+}
+
+// Error of a formula that would make a cycle of cells, where each cell refers to the next and the
+// last is the first. It matches ErrCyclicDependency. A cell that refers to itself has a cycle of
+// the cell twice.
+type CycleError struct {
+    CellIds []string
+}
+
+func (err *CycleError) Error() string {
+    if len(err.CellIds) == 2 && err.CellIds[0] == err.CellIds[1] {
+        return ErrCyclicDependency.Error() + ": " + err.CellIds[0] + " refers to itself"
+    }
+    return ErrCyclicDependency.Error() + ": " + strings.Join(err.CellIds, " -> ")
+}
+
+func (err *CycleError) Unwrap() error {
+    return ErrCyclicDependency
+}
+
+// Error of a malformed formula, with the reason, such as a missing operand. It matches
+// ErrInvalidFormula, and Err if it is set.
+type FormulaError struct {
+    Reason string
+    
+    // More specific error, such as ErrDanglingOperator, or nil.
+    Err error
+}
+
+func (err *FormulaError) Error() string {
+    return err.Reason
+}
+
+func (err *FormulaError) Unwrap() []error {
+    if err.Err == nil {
+        return []error{ErrInvalidFormula}
+    }
+    return []error{ErrInvalidFormula, err.Err}
+}
+
+// Default max number of columns of a sheet, as column 16384 is XFD. See WithMaxColumns.
+const defaultMaxNumCols = 16384
+
+// Default max number of calls that can be undone.
+const defaultUndoLimit = 100
+
+// Default max length of a chain of formula cells, see SetMaxFormulaDepth.
+const defaultMaxFormulaDepth = 100000
+
+// Change of a cell, for undo and redo. before and after are the contents of the cell as accepted
+// by SetCellValue, or nil if the cell is not set.
+type CellChange struct {
+    cellId string
+    before, after *string
+}
+
+type SpreadSheet struct {
+    // Spreadsheet is a matrix of cells, stored densely or sparsely.
+    cells cellStore
+    
+    // Cells whose formulas refer to ranges of the sheet of more than one cell, keyed by the range
+    // without its sheet name, as in Cell.dependentCells. A range such as A:A has one entry however
+    // many cells it has, so that its cells are not allocated to hold its dependents.
+    rangeDependents map[CellRange]map[string]bool
+    
+    // Guards the cells. Methods that update cells hold the write lock until the values of all the
+    // dependents are recomputed, so that readers never see a partial update. The sheets of a
+    // workbook use the mutex of the workbook instead.
+    mutex sync.RWMutex
+    
+    // Workbook of the sheet and its name in the workbook. workbook is nil if the sheet is not in
+    // a workbook.
+    workbook *Workbook
+    name string
+    
+    // Names defined on the sheet for cell IDs and ranges, keyed by the upper case name. The value
+    // is the cell ID or range, such as A1:A12.
+    names map[string]string
+    
+    // Changes of cells that can be undone and redone. Each entry has the changes of one call of
+    // SetCellValue, SetCellValues, ClearCell, CopyCell, FillDown or FillRight. The undo stack has
+    // at most undoLimit entries.
+    undoStack, redoStack [][]*CellChange
+    undoLimit int
+    
+    // Max length of a chain of formula cells, see SetMaxFormulaDepth.
+    maxFormulaDepth int
+    
+    // Max number of columns of the sheet, see WithMaxColumns.
+    maxNumCols int
+    
+    // Value of the cells that are not set, or nil for 0. See WithDefault.
+    defaultValue *float64
+    
+    // Max number of times the formula cells are recomputed for a change, and the largest change
+    // of a value after which they are recomputed again, if formulas may refer to each other in a
+    // cycle. maxIterations is 0 if cycles are not allowed. See WithIterativeCalculation.
+    maxIterations int
+    tolerance float64
+    
+    // Changes of the call in progress, or nil if changes are not recorded.
+    changes []*CellChange
+    
+    // Number of formula cells recomputed by the updates of the sheet, see SetCellValueN.
+    numRecomputed int
+    
+    // Functions called with the cell ID and value of each cell whose value changes, keyed by
+    // subscription ID. See Subscribe.
+    subscribers map[int]func(cellId string, value CellValue)
+    nextSubscriberId int
+    
+    // New values of the cells whose values changed while the sheet is locked, keyed by cell ID.
+    // The subscribers are called with them when the sheet is unlocked.
+    changedValues map[string]CellValue
+    
+    // True if formula cells are computed lazily, when their values are read. The cells to
+    // recompute are then marked stale instead, and a stale cell is computed once when its value
+    // is read. See SetLazyEvaluation.
+    lazy bool
+    staleCells map[string]bool
+    
+    // Guards the stale cells and their computation by methods that hold the read lock. The sheets
+    // of a workbook use the eval mutex of the workbook instead.
+    evalMutex sync.Mutex
+}
+
+// Workbook of named sheets. A formula of a sheet may refer to the cells of another sheet of the
+// workbook by the name of the sheet, as in =Sheet2!A1 or =SUM(Sheet2!A1:B2).
+type Workbook struct {
+    sheets map[string]*SpreadSheet
+    
+    // Guards the cells of all the sheets, as updating a cell of one sheet recomputes the cells of
+    // other sheets that refer to it.
+    mutex sync.RWMutex
+    
+    // Guards the stale cells of all the sheets, as computing a cell of one sheet may compute the
+    // stale cells of other sheets that it refers to.
+    evalMutex sync.Mutex
+}
+
+// Kind of the value of a cell.
+type CellKind int
+
+const (
+    // Cell that is not set.
+    KindEmpty CellKind = iota
+    KindNumber
+    KindText
+    
+    // Cell whose formula has an error, such as ErrDivByZero.
+    KindError
+)
+
+// Value of a cell with its kind, as returned by GetCell. Data is a float64 for KindNumber, a string
+// for KindText, an error for KindError and nil for KindEmpty.
+type CellValue struct {
+    Kind CellKind
+    Data interface{}
+}
+
+// Difference of a cell between two sheets, see Diff. Old and New are the values of the cell in
+// the first and second sheet, and OldFormula and NewFormula are their formulas, which are empty
+// if the cell doesn't have a formula.
+type CellDiff struct {
+    CellId string
+    Old, New CellValue
+    OldFormula, NewFormula string
+}
+
+// JSON encoding of a sheet.
+type SpreadSheetJSON struct {
+    Rows int `json:"rows"`
+    Cols int `json:"cols"`
+    
+    // Cells that are set, keyed by cell ID.
+    Cells map[string]*CellJSON `json:"cells"`
+    
+    // Cell IDs and ranges of the names of the sheet, keyed by name.
+    Names map[string]string `json:"names,omitempty"`
+}
+
+// Binary encoding of a sheet by Snapshot, with gob. Only the contents, comments, locks and formats
+// of the cells are encoded, in row major order, as the values of formulas and the dependents are
+// derived.
+type sheetSnapshot struct {
+    Rows, Cols int
+    Cells []cellSnapshot
+    Names map[string]string
+}
+
+// Binary encoding of a cell at the zero based Row and Col. At most one of the number, formula or
+// text of the cell is set, as are the comment, lock and format of the cell.
+type cellSnapshot struct {
+    Row, Col int
+    Value *float64
+    Formula *string
+    Text *string
+    Comment *string
+    Locked bool
+    Format *string
+}
+
+// JSON encoding of a cell. At most one of the number, formula or text of the cell is set, the
+// comment and format are set if the cell has them, and locked is true if the cell is locked.
+type CellJSON struct {
+    Value *float64 `json:"value,omitempty"`
+    Formula *string `json:"formula,omitempty"`
+    Text *string `json:"text,omitempty"`
+    Comment *string `json:"comment,omitempty"`
+    Locked bool `json:"locked,omitempty"`
+    Format *string `json:"format,omitempty"`
+}
+
+type CellId struct {
+    row, col int
+    
+    // True if the row or col of a cell ID in a formula is absolute, i.e. has a leading $ as in
+    // $A$1, so that it doesn't move when the formula is copied.
+    absRow, absCol bool
+    
+    // True if the cell ID is a corner of a range of whole columns, as C in A:C, whose row is 0, or
+    // of a range of whole rows, as 3 in 1:3, whose col is 0.
+    wholeColumn, wholeRow bool
+}
+
+// Cell ID or range of a formula, such as A1, A1:B2, or a range of whole columns or rows, such as
+// A:C or 1:3. Ranges are not expanded to their cells, so that a range of a large sheet is cheap.
+type CellRange struct {
+    // Name of the sheet of the range, as in Sheet2!A1:B2. Empty for the sheet of the formula.
+    sheet string
+    
+    // Zero based rows and columns of the corners as written, which may be in any order. Both
+    // corners of a cell ID are the cell. The rows of whole columns and the columns of whole rows
+    // are 0.
+    row1, col1, row2, col2 int
+    
+    // True if the range is of whole columns or rows, which has all the cells of the columns or
+    // rows in the sheet however many there are.
+    wholeColumns, wholeRows bool
+}
+
+// Token of a formula. A token is either an operator, a parenthesis, a comma or an operand. An
+// operand is a number, text in double quotes, a cell ID, a range of cell IDs or a function name.
+type Token struct {
+    text string
+    isOperator bool
+    
+    // True if the token is text in double quotes, such as "Hello".
+    isText bool
+    
+    // Index of the token in the formula.
+    pos int
+}
+
+// Expression parsed from a formula. Expressions form a tree whose leaves are operands and
+// whose inner nodes are operators applied to their sub-expressions.
+type Expr interface {
+    // Returns the value of the expression using the current values of the sheet.
+    // Returns an error such as ErrDivByZero if the value can't be computed.
+    // The value is nil if the expression is a cell ID of a cell that is not set.
+    eval(sheet *SpreadSheet) (*Value, error)
+    
+    // Returns the cell IDs and ranges referenced by the expression.
+    getRanges() []*CellRange
+}
+
+// Value of a cell ID or expression in a formula. It is a number, or text if text is not nil.
+type Value struct {
+    number float64
+    text *string
+}
+
+// Operand expression. Its value is the number, the value of the cell ID or the sum of the values
+// of the cells of the range.
+type OperandExpr struct {
+    // Number of the operand, or nil if it is a cell ID or range.
+    val *float64
+    
+    // Cell ID or range of the operand, or nil if it is a number.
+    cellRange *CellRange
+}
+
+// Text expression such as "Hello". Its value is the text.
+type TextExpr struct {
+    text string
+}
+
+// Error expression such as #REF!. Its value is the error.
+type ErrorExpr struct {
+    err error
+}
+
+// Binary operator expression such as A1+B2 or 2*C3.
+type BinaryExpr struct {
+    op string
+    left, right Expr
+}
+
+// Unary minus expression such as -A1.
+type NegateExpr struct {
+    operand Expr
+}
+
+// Function call expression such as SUM(A1:A5,10).
+type FunctionExpr struct {
+    name string
+    args []Expr
+}
+
+// IF function expression such as IF(A1>B1,A1,B1). Only the argument chosen by the condition is
+// evaluated, so an error in the other argument doesn't propagate.
+type IfExpr struct {
+    cond, then, otherwise Expr
+}
+
+// Functions supported in formulas. A function is called with the values of its arguments,
+// where a range argument is expanded to the values of each of its cells. The value of a cell
+// that is not set is nil. Text is 0, except that it is counted by COUNTA.
+var formulaFunctions = map[string]func(values []*Value) float64{
+    "SUM": sumValues,
+    "AVERAGE": averageValues,
+    "MIN": minValue,
+    "MAX": maxValue,
+    "COUNT": countValues,
+    "COUNTA": countNonEmptyValues,
+    "PRODUCT": productValues,
+}
+
+// Text functions supported in formulas. Like formulaFunctions, a function is called with the
+// values of its arguments where ranges are expanded, but its value is text.
+var textFunctions = map[string]func(values []*Value) string{
+    "CONCATENATE": concatenateValues,
+}
+
+// Conditional functions supported in formulas, such as SUMIF. A function takes a range and a
+// criterion, and is called with the values of the cells of the range and the criterion.
+var conditionalFunctions = map[string]func(values []*Value, criterion *Criterion) float64{
+    "SUMIF": sumIfValues,
+    "COUNTIF": countIfValues,
+}
+
+// Criterion of a conditional function, such as ">5". A value meets it if comparing the value
+// with value using op, as in compareValues, is true.
+type Criterion struct {
+    op string
+    value *Value
+}
+
+// Scalar function supported in formulas, such as ABS. It takes minArgs to maxArgs arguments and
+// is called with the value of each argument, where a range argument is the sum of its cells as
+// with operators.
+type ScalarFunction struct {
+    minArgs, maxArgs int
+    fn func(args []float64) (float64, error)
+}
+
+var scalarFunctions = map[string]*ScalarFunction{
+    "ABS": {minArgs: 1, maxArgs: 1, fn: absValue},
+    "MOD": {minArgs: 2, maxArgs: 2, fn: modValue},
+    "POWER": {minArgs: 2, maxArgs: 2, fn: powerValue},
+    "ROUND": {minArgs: 1, maxArgs: 2, fn: roundValue},
+    "FLOOR": {minArgs: 1, maxArgs: 1, fn: floorValue},
+    "CEIL": {minArgs: 1, maxArgs: 1, fn: ceilValue},
+}
+
+// Recursive descent parser over the tokens of a formula. Grammar:
+//
+//     compare  = concat (("=" | "<>" | "<" | ">" | "<=" | ">=") concat)*
+//     concat   = sum ("&" sum)*
+//     sum      = product (("+" | "-") product)*
+//     product  = unary (("*" | "/") unary)*
+//     unary    = "-" unary | operand
+//     operand  = "(" compare ")" | function | number | text | cell ID | range | name
+//     function = name "(" compare ("," compare)* ")"
+//
+// so that parenthesized sub-expressions are evaluated first, then unary minus, and * and / bind
+// tighter than + and -. Operators of the same precedence are applied from left to right.
+type FormulaParser struct {
+    tokens []*Token
+    pos int
+    
+    // Names of the sheet of the formula, as in SpreadSheet.
+    names map[string]string
+}
+
+// Option of a sheet for CreateSpreadSheet, such as WithDefault.
+type Option func(sheet *SpreadSheet)
+
+// Option that sets the value of the cells that are not set to value instead of 0. It is the value
+// returned by GetCellValue for such a cell, and the value of a reference to it in a formula, so
+// that SUM(A1:A3) is 3 times the value if none of A1 to A3 is set. The functions see them as
+// numbers too, so COUNT and COUNTA count them and AVERAGE(A1:A3) is the value. The cells are still
+// not set for GetCell, GetCellDisplay and IsCellEmpty.
+func WithDefault(value float64) Option {
+    return func(sheet *SpreadSheet) {
+        sheet.defaultValue = &value
+    }
+}
+
+// Option that allows formulas to refer to each other in a cycle, such as =B1*0.5+10 in A1 and =A1
+// in B1, which are computed iteratively as in Excel. After a change, the formula cells are
+// computed and then recomputed from the last values of the cells of the cycle, until no value
+// changes by more than tolerance, up to maxIterations more times. The formula cells whose values
+// still change have the error #NUM!, as do the formulas that refer to them, which the cycle keeps
+// until one of its cells is set to a value that is not a formula. maxIterations of 0 or less
+// disables iterative calculation, so that a cycle is an error. Formula cells of a lazy sheet are
+// computed once when they are read, without iterating.
+func WithIterativeCalculation(maxIterations int, tolerance float64) Option {
+    return func(sheet *SpreadSheet) {
+        if maxIterations > 0 {
+            sheet.maxIterations = maxIterations
+        }
+        sheet.tolerance = math.Abs(tolerance)
+    }
+}
+
+// Option that sets the max number of columns of the sheet, which is 16384 (A..XFD) by default.
+// Creating, resizing or inserting a column into the sheet so that it has more columns returns an
+// error. maxCols of 0 or less keeps the default.
+func WithMaxColumns(maxCols int) Option {
+    return func(sheet *SpreadSheet) {
+        if maxCols > 0 {
+            sheet.maxNumCols = maxCols
+        }
+    }
+}
+
+// Function that creates a sheet of numRows rows and numCols columns with the given options.
+// Returns an error if either is not positive or numCols is more than the max number of columns.
+func CreateSpreadSheet(numRows, numCols int, options ...Option) (*SpreadSheet, error) {
+    sheet := newSpreadSheet(nil, options...)
+    if err := sheet.checkDimensions(numRows, numCols); err != nil {
+        return nil, err
+    }
+    sheet.cells = newDenseCells(numRows, numCols)
+    return sheet, nil
+}
+
+// Function that creates a sheet of maxRows rows and maxCols columns that only allocates the cells
+// that are set or referred to, for large sheets that are mostly empty. It has the same methods
+// and options as a sheet created by CreateSpreadSheet. Returns an error for invalid dimensions,
+// as it does.
+func CreateSparseSpreadSheet(maxRows, maxCols int, options ...Option) (*SpreadSheet, error) {
+    sheet := newSpreadSheet(nil, options...)
+    if err := sheet.checkDimensions(maxRows, maxCols); err != nil {
+        return nil, err
+    }
+    sheet.cells = newSparseCells(maxRows, maxCols)
+    return sheet, nil
+}
+
+// Function that returns an error if the sheet cannot have numRows rows and numCols columns.
+func (sheet *SpreadSheet) checkDimensions(numRows, numCols int) error {
+    if numRows <= 0 || numCols <= 0 {
+        return ErrInvalidDimensions
+    }
+    if numCols > sheet.maxNumCols {
+        return fmt.Errorf("%w of %d", ErrTooManyColumns, sheet.maxNumCols)
+    }
+    return nil
+}
+
+func newSpreadSheet(cells cellStore, options ...Option) *SpreadSheet {
+    sheet := new(SpreadSheet)
+    sheet.names = make(map[string]string)
+    sheet.undoLimit = defaultUndoLimit
+    sheet.maxFormulaDepth = defaultMaxFormulaDepth
+    sheet.maxNumCols = defaultMaxNumCols
+    sheet.cells = cells
+    for _, option := range options {
+        option(sheet)
+    }
+    return sheet
+}
+
+// Function that returns a cell that is not set.
+func newCell() *Cell {
+    cell := new(Cell)
+    cell.dependentCells = make(map[string]interface{})
+    return cell
+}
+
+// Cell that is returned by a sparse sheet for a cell that was not allocated. It is never updated.
+var emptyCell = new(Cell)
+
+// Storage of the cells of a sheet.
+type cellStore interface {
+    // Returns the number of rows and columns.
+    dimensions() (numRows, numCols int)
+    
+    // Returns the cell at row, col, or emptyCell if it was not allocated. The cell must not be
+    // updated, as it may be emptyCell.
+    get(row, col int) *Cell
+    
+    // Returns the cell at row, col, allocating it if needed, so that it may be updated.
+    touch(row, col int) *Cell
+    
+    // Calls fn with each allocated cell, in row major order.
+    forEach(fn func(row, col int, cell *Cell))
+    
+    // Inserts an empty row or column before the index at, or deletes the row or column at the
+    // index at, moving the cells after it.
+    insertRow(at int)
+    deleteRow(at int)
+    insertColumn(at int)
+    deleteColumn(at int)
+    
+    // Resizes to numRows rows and numCols columns, removing the cells outside.
+    resize(numRows, numCols int)
+}
+
+// Storage that allocates all the cells up front, as a matrix.
+type denseCells struct {
+    cells [][]*Cell
+    
+    // Number of columns, which is stored as there may be no rows to take it from.
+    numCols int
+}
+
+func newDenseCells(numRows, numCols int) *denseCells {
+    store := &denseCells{cells: make([][]*Cell, numRows), numCols: numCols}
+    for i := 0; i < numRows; i++ {
+        store.cells[i] = make([]*Cell, numCols)
+        for j := 0; j < numCols; j++ {
+            store.cells[i][j] = newCell()
+        }
+    }
+    return store
+}
+
+func (store *denseCells) dimensions() (int, int) {
+    return len(store.cells), store.numCols
+}
+
+func (store *denseCells) get(row, col int) *Cell {
+    return store.cells[row][col]
+}
+
+func (store *denseCells) touch(row, col int) *Cell {
+    return store.cells[row][col]
+}
+
+func (store *denseCells) forEach(fn func(row, col int, cell *Cell)) {
+    for row, cells := range store.cells {
+        for col, cell := range cells {
+            fn(row, col, cell)
+        }
+    }
+}
+
+func (store *denseCells) insertRow(at int) {
+    cells := make([]*Cell, store.numCols)
+    for col := range cells {
+        cells[col] = newCell()
+    }
+    store.cells = append(store.cells[:at], append([][]*Cell{cells}, store.cells[at:]...)...)
+}
+
+func (store *denseCells) deleteRow(at int) {
+    store.cells = append(store.cells[:at], store.cells[at+1:]...)
+}
+
+func (store *denseCells) insertColumn(at int) {
+    store.numCols++
+    for row, cells := range store.cells {
+        store.cells[row] = append(cells[:at], append([]*Cell{newCell()}, cells[at:]...)...)
+    }
+}
+
+func (store *denseCells) deleteColumn(at int) {
+    store.numCols--
+    for row, cells := range store.cells {
+        store.cells[row] = append(cells[:at], cells[at+1:]...)
+    }
+}
+
+func (store *denseCells) resize(numRows, numCols int) {
+    cells := make([][]*Cell, numRows)
+    for i := 0; i < numRows; i++ {
+        cells[i] = make([]*Cell, numCols)
+        for j := 0; j < numCols; j++ {
+            if i < len(store.cells) && j < len(store.cells[i]) {
+                cells[i][j] = store.cells[i][j]
+                continue
+            }
+            cells[i][j] = newCell()
+        }
+    }
+    store.cells = cells
+    store.numCols = numCols
+}
+
+// Storage that only allocates the cells that are touched, keyed by row and column.
+type sparseCells struct {
+    cells map[cellKey]*Cell
+    numRows, numCols int
+}
+
+type cellKey struct {
+    row, col int
+}
+
+func newSparseCells(numRows, numCols int) *sparseCells {
+    return &sparseCells{cells: make(map[cellKey]*Cell), numRows: numRows, numCols: numCols}
+}
+
+func (store *sparseCells) dimensions() (int, int) {
+    return store.numRows, store.numCols
+}
+
+func (store *sparseCells) get(row, col int) *Cell {
+    if cell, ok := store.cells[cellKey{row, col}]; ok {
+        return cell
+    }
+    return emptyCell
+}
+
+func (store *sparseCells) touch(row, col int) *Cell {
+    cell, ok := store.cells[cellKey{row, col}]
+    if !ok {
+        cell = newCell()
+        store.cells[cellKey{row, col}] = cell
+    }
+    return cell
+}
+
+func (store *sparseCells) forEach(fn func(row, col int, cell *Cell)) {
+    keys := make([]cellKey, 0, len(store.cells))
+    for key := range store.cells {
+        keys = append(keys, key)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        if keys[i].row != keys[j].row {
+            return keys[i].row < keys[j].row
+        }
+        return keys[i].col < keys[j].col
+    })
+    for _, key := range keys {
+        fn(key.row, key.col, store.cells[key])
+    }
+}
+
+// Function to move the cells using fn, which returns the new row and column of a cell, or false
+// if the cell is removed.
+func (store *sparseCells) moveCells(fn func(key cellKey) (cellKey, bool)) {
+    cells := make(map[cellKey]*Cell, len(store.cells))
+    for key, cell := range store.cells {
+        if newKey, ok := fn(key); ok {
+            cells[newKey] = cell
+        }
+    }
+    store.cells = cells
+}
+
+func (store *sparseCells) insertRow(at int) {
+    store.numRows++
+    store.moveCells(func(key cellKey) (cellKey, bool) {
+        if key.row >= at {
+            key.row++
+        }
+        return key, true
+    })
+}
+
+func (store *sparseCells) deleteRow(at int) {
+    store.numRows--
+    store.moveCells(func(key cellKey) (cellKey, bool) {
+        if key.row == at {
+            return key, false
+        }
+        if key.row > at {
+            key.row--
+        }
+        return key, true
+    })
+}
+
+func (store *sparseCells) insertColumn(at int) {
+    store.numCols++
+    store.moveCells(func(key cellKey) (cellKey, bool) {
+        if key.col >= at {
+            key.col++
+        }
+        return key, true
+    })
+}
+
+func (store *sparseCells) deleteColumn(at int) {
+    store.numCols--
+    store.moveCells(func(key cellKey) (cellKey, bool) {
+        if key.col == at {
+            return key, false
+        }
+        if key.col > at {
+            key.col--
+        }
+        return key, true
+    })
+}
+
+func (store *sparseCells) resize(numRows, numCols int) {
+    store.numRows, store.numCols = numRows, numCols
+    store.moveCells(func(key cellKey) (cellKey, bool) {
+        return key, key.row < numRows && key.col < numCols
+    })
+}
+
+// Function that returns the number of rows and columns of the sheet, which are 0 for a sheet
+// without cells, as in new(SpreadSheet).
+func (sheet *SpreadSheet) dimensions() (int, int) {
+    if sheet.cells == nil {
+        return 0, 0
+    }
+    return sheet.cells.dimensions()
+}
+
+// Function to call fn for each cell that is stored, as cellStore.forEach. A sheet without cells,
+// as in new(SpreadSheet), is 0x0 and has no cells.
+func (sheet *SpreadSheet) forEachCell(fn func(row, col int, cell *Cell)) {
+    if sheet.cells == nil {
+        return
+    }
+    sheet.cells.forEach(fn)
+}
+
+// Function that returns the cell at row, col. The cell must not be updated, see cellStore.
+func (sheet *SpreadSheet) getCell(row, col int) *Cell {
+    return sheet.cells.get(row, col)
+}
+
+// Function that returns the cell at row, col so that it may be updated.
+func (sheet *SpreadSheet) touchCell(row, col int) *Cell {
+    return sheet.cells.touch(row, col)
+}
+
+// Function that creates a workbook without sheets.
+func CreateWorkbook() *Workbook {
+    workbook := new(Workbook)
+    workbook.sheets = make(map[string]*SpreadSheet)
+    return workbook
+}
+
+// Function that adds a sheet with the given name, dimensions and options, as in CreateSpreadSheet,
+// to the workbook and returns it.
+// The name is made of alphabets, digits and underscores, and is case sensitive. Returns an error
+// if the name is invalid or the workbook already has a sheet with the name.
+func (workbook *Workbook) AddSheet(name string, numRows, numCols int, options ...Option) (*SpreadSheet, error) {
+    workbook.mutex.Lock()
+    defer workbook.mutex.Unlock()
+    
+    if len(name) == 0 || strings.Trim(name, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+        return nil, fmt.Errorf("%w: %s", ErrInvalidSheetName, name)
+    }
+    if _, ok := workbook.sheets[name]; ok {
+        return nil, fmt.Errorf("%w %s", ErrDuplicateSheet, name)
+    }
+    
+    sheet, err := CreateSpreadSheet(numRows, numCols, options...)
+    if err != nil {
+        return nil, err
+    }
+    sheet.workbook = workbook
+    sheet.name = name
+    workbook.sheets[name] = sheet
+    return sheet, nil
+}
+
+// Function that returns the sheet of the workbook with the given name. Returns an error if there
+// is no such sheet.
+func (workbook *Workbook) GetSheet(name string) (*SpreadSheet, error) {
+    workbook.mutex.RLock()
+    defer workbook.mutex.RUnlock()
+    
+    sheet, ok := workbook.sheets[name]
+    if !ok {
+        return nil, fmt.Errorf("%w: %s", ErrUnknownSheet, name)
+    }
+    return sheet, nil
+}
+
+// Function that recomputes the formula cells of all the sheets of the workbook once, in
+// topological order across the sheets, so that a cell is computed after the cells it refers to on
+// any sheet. This is useful after a bulk load, where formulas may refer to cells that were loaded
+// after them. The formula cells of lazy sheets are marked stale instead.
+func (workbook *Workbook) RecalculateAll() {
+    workbook.mutex.Lock()
+    
+    var sheet *SpreadSheet
+    affectedCellIds := make(map[*SpreadSheet]map[string]bool)
+    for _, sheet = range workbook.sheets {
+        formulaCellIds := make(map[string]bool)
+        sheet.forEachCell(func(row, col int, cell *Cell) {
+            if cell.formula != nil {
+                formulaCellIds[getCellId(row, col)] = true
+            }
+        })
+        affectedCellIds[sheet] = formulaCellIds
+    }
+    recomputeAffectedCells(affectedCellIds)
+    
+    if sheet == nil {
+        workbook.mutex.Unlock()
+        return
+    }
+    // Subscribers of all the sheets are notified.
+    sheet.unlockAndNotify()
+}
+
+// Function that sets the cell to a number, text or formula starting with =. The cells that depend
+// on the cell are recomputed. If the cell ID or value is invalid, an error is returned and neither
+// the cell nor its dependents change.
+func (sheet *SpreadSheet) SetCellValue(cellId string, value string) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    return sheet.recordChanges(func() error {
+        return sheet.setCellValue(cellId, value)
+    })
+}
+
+func (sheet *SpreadSheet) setCellValue(cellId string, value string) error {
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return err
+    }
+    // Dependents are keyed by cell ID, so use the same cell ID for a1 and A1.
+    cellId = getCellId(row, col)
+    if sheet.getCell(row, col).locked {
+        return fmt.Errorf("%w: %s", ErrCellLocked, cellId)
+    }
+    
+    value, expr, err := sheet.validateCellValue(cellId, value)
+    if err != nil {
+        return err
+    }
+    if err := sheet.checkCycles(map[string]Expr{cellId: expr}); err != nil {
+        return err
+    }
+    
+    sheet.assignCellValue(cellId, row, col, value, expr)
+    sheet.recomputeWithDependents([]string{cellId})
+    return nil
+}
+
+// Function that sets the cell as SetCellValue does, and returns the number of formula cells that
+// were recomputed, which are the cell if it has a formula and its direct and indirect dependents,
+// on any sheet of the workbook. It helps to find cells with a large number of dependents. The
+// formula cells of lazy sheets are counted when they are marked stale.
+func (sheet *SpreadSheet) SetCellValueN(cellId string, value string) (int, error) {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    sheet.numRecomputed = 0
+    err := sheet.recordChanges(func() error {
+        return sheet.setCellValue(cellId, value)
+    })
+    if err != nil {
+        return 0, err
+    }
+    return sheet.numRecomputed, nil
+}
+
+// Function that sets the values of several cells at once. updates maps cell IDs to values as
+// accepted by SetCellValue. All the cell IDs and values are validated first, and if any of them
+// is invalid an error is returned without updating any cell. Two cell IDs of the same cell, such
+// as a1 and A1, are invalid too. The formulas must not make a cycle with each other either. Else
+// the cells are updated and then the updated cells and their dependents are recomputed, each once.
+func (sheet *SpreadSheet) SetCellValues(updates map[string]string) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    // Cell IDs of the updates as given, keyed by their normalized cell IDs.
+    givenCellIds := make(map[string]string)
+    for givenCellId := range updates {
+        row, col, err := sheet.getCellRowColInBounds(givenCellId)
+        if err != nil {
+            return err
+        }
+        cellId := getCellId(row, col)
+        if other, ok := givenCellIds[cellId]; ok {
+            first, second := min(other, givenCellId), max(other, givenCellId)
+            return fmt.Errorf("%w: %s and %s are the same cell", ErrInvalidArgument, first, second)
+        }
+        if sheet.getCell(row, col).locked {
+            return fmt.Errorf("%w: %s", ErrCellLocked, cellId)
+        }
+        givenCellIds[cellId] = givenCellId
+    }
+    
+    values := make(map[string]string)
+    formulas := make(map[string]Expr)
+    for cellId, givenCellId := range givenCellIds {
+        value, expr, err := sheet.validateCellValue(cellId, updates[givenCellId])
+        if err != nil {
+            return err
+        }
+        values[cellId] = value
+        formulas[cellId] = expr
+    }
+    if err := sheet.checkCycles(formulas); err != nil {
+        return err
+    }
+    
+    return sheet.recordChanges(func() error {
+        cellIds := make([]string, 0)
+        for cellId, value := range values {
+            row, col, _ := getCellRowCol(cellId)
+            sheet.assignCellValue(cellId, row, col, value, formulas[cellId])
+            cellIds = append(cellIds, cellId)
+        }
+        
+        sheet.recomputeWithDependents(cellIds)
+        return nil
+    })
+}
+
+// Function to check that the value of the cell is text, a number or a valid formula. A formula may
+// only refer to other sheets of the workbook of the sheet, and to cells within the bounds of the
+// sheets. Returns the value to set, where an empty value is "0", and the parsed formula, which is
+// nil if the value is not a formula. Trailing whitespace, such as the line break of a value from
+// CSV or pasted text, is removed. Cycles are checked by checkCycles.
+func (sheet *SpreadSheet) validateCellValue(cellId, value string) (string, Expr, error) {
+    value = strings.TrimRight(value, " \t\r\n")
+    if len(strings.TrimSpace(value)) == 0 {
+        return "0", nil, nil
+    }
+    
+    if _, err := parseNumber(strings.TrimSpace(value)); err == nil {
+        return strings.TrimSpace(value), nil, nil
+    }
+    
+    if !strings.HasPrefix(strings.TrimSpace(value), "=") {
+        // Text.
+        return value, nil, nil
+    }
+    expr, err := sheet.parseFormula(value)
+    if err != nil {
+        return "", nil, err
+    }
+    for _, cellRange := range expr.getRanges() {
+        if err := sheet.checkRangeInBounds(cellRange); err != nil {
+            return "", nil, err
+        }
+    }
+    return value, expr, nil
+}
+
+// Function to check that setting the cells of the sheet to new values doesn't make a cycle of
+// formulas, including a formula that refers to its own cell. formulas maps the cell IDs to their
+// parsed formulas, or nil for values that are not formulas. The other cells keep their formulas.
+// Returns a CycleError with the cell IDs of a cycle, where each cell refers to the next, such as
+// C1 -> A1 -> B1 -> C1 if A1 refers to B1, B1 to C1 and the new formula of C1 to A1.
+func (sheet *SpreadSheet) checkCycles(formulas map[string]Expr) error {
+    if sheet.maxIterations > 0 {
+        // Cycles are computed iteratively.
+        return nil
+    }
+    search := &cycleSearch{
+        formulas: formulas,
+        newDependents: make(map[*SpreadSheet]map[string][]string),
+        newRangeDependents: make(map[*SpreadSheet]map[CellRange][]string),
+        states: make(map[*SpreadSheet]map[string]int),
+    }
+    cellIds := make([]string, 0)
+    for cellId, expr := range formulas {
+        if expr == nil {
+            continue
+        }
+        cellIds = append(cellIds, cellId)
+        for _, cellRange := range expr.getRanges() {
+            refSheet := sheet.getRefSheet(cellRange.sheet)
+            if !cellRange.isCell() {
+                if search.newRangeDependents[refSheet] == nil {
+                    search.newRangeDependents[refSheet] = make(map[CellRange][]string)
+                }
+                key := cellRange.getKey()
+                search.newRangeDependents[refSheet][key] = append(search.newRangeDependents[refSheet][key], cellId)
+                continue
+            }
+            if search.newDependents[refSheet] == nil {
+                search.newDependents[refSheet] = make(map[string][]string)
+            }
+            refId := getCellId(cellRange.row1, cellRange.col1)
+            search.newDependents[refSheet][refId] = append(search.newDependents[refSheet][refId], cellId)
+        }
+    }
+    sort.Strings(cellIds)
+    
+    // Each cell is searched once, so that a batch of formulas that refer to each other is checked
+    // in linear time.
+    for _, cellId := range cellIds {
+        cycle := sheet.findDependentCycle(sheet, cellId, search, nil)
+        if cycle == nil {
+            continue
+        }
+        // cycle has a cell and its dependents up to the cell again, so each cell refers to the
+        // one before it.
+        for i, j := 0, len(cycle)-1; i < j; i, j = i+1, j-1 {
+            cycle[i], cycle[j] = cycle[j], cycle[i]
+        }
+        return &CycleError{CellIds: cycle}
+    }
+    return nil
+}
+
+// Depth first search of checkCycles, with the dependents of the new formulas of checkCycles in
+// place of the old formulas of the cells in formulas.
+type cycleSearch struct {
+    formulas map[string]Expr
+    
+    // Cells whose new formulas refer to each cell by a cell ID, keyed by sheet and cell ID, and to
+    // each range of more than one cell, keyed by sheet and range as in rangeDependents.
+    newDependents map[*SpreadSheet]map[string][]string
+    newRangeDependents map[*SpreadSheet]map[CellRange][]string
+    
+    // State of each cell searched, keyed by sheet and cell ID.
+    states map[*SpreadSheet]map[string]int
+}
+
+// States of the cells in the depth first search of findDependentCycle.
+const (
+    cellUnvisited = iota
+    cellOnPath
+    cellSearched
+)
+
+// Function to find a cycle of dependents through the cell cellId of refSheet by the depth first
+// search, where path has the cells from the start of the search down to cellId. Returns the cell
+// IDs of the cycle, qualified with the names of other sheets, from a cell down to the same cell,
+// or nil if there is none.
+func (sheet *SpreadSheet) findDependentCycle(refSheet *SpreadSheet, cellId string, search *cycleSearch, path []string) []string {
+    states := search.states
+    if states[refSheet] == nil {
+        states[refSheet] = make(map[string]int)
+    }
+    states[refSheet][cellId] = cellOnPath
+    path = append(path, refSheet.getDependentId(sheet, cellId))
+    
+    type dependent struct {
+        sheet *SpreadSheet
+        cellId string
+    }
+    dependents := make([]dependent, 0)
+    row, col, _ := getCellRowCol(cellId)
+    refSheet.forEachDependent(row, col, func(cid string) {
+        name, dependentId := splitSheetRef(cid)
+        dependentSheet := refSheet.getRefSheet(name)
+        if _, ok := search.formulas[dependentId]; dependentSheet == nil || dependentSheet == sheet && ok {
+            return
+        }
+        dependents = append(dependents, dependent{dependentSheet, dependentId})
+    })
+    for _, dependentId := range search.newDependents[refSheet][cellId] {
+        dependents = append(dependents, dependent{sheet, dependentId})
+    }
+    for cellRange, dependentIds := range search.newRangeDependents[refSheet] {
+        if cellRange.contains(refSheet, row, col) {
+            for _, dependentId := range dependentIds {
+                dependents = append(dependents, dependent{sheet, dependentId})
+            }
+        }
+    }
+    
+    for _, d := range dependents {
+        switch states[d.sheet][d.cellId] {
+        case cellOnPath:
+            // The dependent is a cell before cellId on the path, so the path from it is a cycle.
+            start := len(path)-1
+            for path[start] != d.sheet.getDependentId(sheet, d.cellId) {
+                start--
+            }
+            return append(append([]string{}, path[start:]...), path[start])
+        case cellUnvisited:
+            if cycle := sheet.findDependentCycle(d.sheet, d.cellId, search, path); cycle != nil {
+                return cycle
+            }
+        }
+    }
+    states[refSheet][cellId] = cellSearched
+    return nil
+}
+
+// Function to check that the cell ID or range of a formula or name refers to cells within the
+// bounds of its sheet, which must be the sheet or another sheet of the workbook. The corners are
+// checked as written, first then second, and the error has the corner that is outside the sheet,
+// so that the cells of the range are never visited.
+func (sheet *SpreadSheet) checkRangeInBounds(cellRange *CellRange) error {
+    refSheet := sheet.getRefSheet(cellRange.sheet)
+    if refSheet == nil {
+        return fmt.Errorf("%w in formula: %s", ErrUnknownSheet, cellRange.sheet)
+    }
+    numRows, numCols := refSheet.dimensions()
+    checkCorner := func(row, col int) error {
+        // Whole columns are written without rows and whole rows without columns, as in A:B and 1:2.
+        cornerId := getCellId(row, col)
+        if cellRange.wholeColumns {
+            cornerId = GetColumnName(col)
+        } else if cellRange.wholeRows {
+            cornerId = strconv.Itoa(row+1)
+        }
+        var err error
+        if !cellRange.wholeColumns && row >= numRows {
+            err = ErrRowOutOfBounds
+        } else if !cellRange.wholeRows && col >= numCols {
+            err = ErrColumnOutOfBounds
+        } else {
+            return nil
+        }
+        return &CellIdError{CellId: qualifyRef(cellRange.sheet, cornerId), Err: err, NumRows: numRows,
+            NumCols: numCols}
+    }
+    if err := checkCorner(cellRange.row1, cellRange.col1); err != nil {
+        return err
+    }
+    return checkCorner(cellRange.row2, cellRange.col2)
+}
+
+// Function to set the cell at row, col to the value, which must be valid, and to update the
+// dependees of the cell. expr is the parsed formula from validateCellValue, or nil if the value is
+// not a formula. Neither the value of a formula nor the values of dependents are computed.
+func (sheet *SpreadSheet) assignCellValue(cellId string, row, col int, value string, expr Expr) {
+    cell := sheet.touchCell(row, col)
+    before := cell.getContent()
+    beforeValue := cell.getCellValue()
+    defer func() {
+        sheet.addChange(cellId, before, cell.getContent())
+        sheet.notifyChange(cellId, beforeValue)
+    }()
+    
+    // Remove dependees.
+    if cell.formula != nil {
+        sheet.deleteDependees(cellId, cell)
+    }
+    cell.expr = nil
+    
+    valueNum, err := parseNumber(value)
+    if err == nil {
+        cell.value = &valueNum
+        // If value is a number, unset the formula and text.
+        cell.formula = nil
+        cell.text = nil
+        cell.err = nil
+    } else if strings.HasPrefix(strings.TrimSpace(value), "=") {
+        cell.formula = &value
+        cell.expr = expr
+        cell.text = nil
+    } else {
+        cell.text = &value
+        cell.value = nil
+        cell.formula = nil
+        cell.err = nil
+    }
+    
+    // Add dependees.
+    if cell.formula != nil {
+        sheet.addDependees(cellId, expr)
+    }
+}
+
+// Function that resets the cell to not set. Cells that depend on this cell are recomputed
+// with its value as 0.
+func (sheet *SpreadSheet) ClearCell(cellId string) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    return sheet.recordChanges(func() error {
+        return sheet.clearCell(cellId)
+    })
+}
+
+func (sheet *SpreadSheet) clearCell(cellId string) error {
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return err
+    }
+    cellId = getCellId(row, col)
+    if sheet.getCell(row, col).locked {
+        return fmt.Errorf("%w: %s", ErrCellLocked, cellId)
+    }
+    cell := sheet.touchCell(row, col)
+    sheet.addChange(cellId, cell.getContent(), nil)
+    defer sheet.notifyChange(cellId, cell.getCellValue())
+    
+    // Remove dependees.
+    if cell.formula != nil {
+        sheet.deleteDependees(cellId, cell)
+    }
+    cell.expr = nil
+    cell.formula = nil
+    cell.value = nil
+    cell.text = nil
+    cell.err = nil
+    
+    sheet.recomputeWithDependents([]string{cellId})
+    return nil
+}
+
+// Function that resets every cell of the sheet to not set, as clearing each cell would, but in one
+// pass that keeps the storage of the cells. The formulas and their dependents are removed, as are
+// the comments, locks and formats of the cells. The names and settings of the sheet are kept.
+// Formulas of other sheets of the workbook that refer to the sheet are recomputed. The undo
+// history is cleared.
+func (sheet *SpreadSheet) Reset() {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    // Values of the cells before resetting, to notify the subscribers of the cells that were set.
+    before := make(map[string]CellValue)
+    if len(sheet.subscribers) > 0 {
+        sheet.refreshAllCells()
+        sheet.forEachCell(func(row, col int, cell *Cell) {
+            if !cell.isEmpty() {
+                before[getCellId(row, col)] = cell.getCellValue()
+            }
+        })
+    }
+    
+    sheet.forEachCell(func(row, col int, cell *Cell) {
+        *cell = *newCell()
+    })
+    sheet.staleCells = nil
+    sheet.clearHistory()
+    // Dependents of the cells of the sheet on other sheets of the workbook are rebuilt as well.
+    sheet.rebuildDependents()
+    
+    for cellId, value := range before {
+        sheet.notifyChange(cellId, value)
+    }
+}
+
+// Function that copies the cell src to the cell dst. If src has a formula, the cell IDs in the
+// formula are moved by the number of rows and columns from src to dst, so that copying =A1+B1
+// from C1 to C2 gives =A2+B2. A cell ID that would move outside the sheet is replaced with #REF!.
+// If src is not set, dst is cleared.
+func (sheet *SpreadSheet) CopyCell(src, dst string) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    return sheet.recordChanges(func() error {
+        return sheet.copyCell(src, dst)
+    })
+}
+
+func (sheet *SpreadSheet) copyCell(src, dst string) error {
+    srcRow, srcCol, err := sheet.getCellRowColInBounds(src)
+    if err != nil {
+        return err
+    }
+    dstRow, dstCol, err := sheet.getCellRowColInBounds(dst)
+    if err != nil {
+        return err
+    }
+    
+    cell := sheet.getCell(srcRow, srcCol)
+    if cell.isEmpty() {
+        return sheet.clearCell(dst)
+    }
+    if cell.text != nil && cell.formula == nil {
+        return sheet.setCellValue(dst, *cell.text)
+    }
+    if cell.formula == nil {
+        return sheet.setCellValue(dst, formatValue(*cell.value))
+    }
+    
+    formula := rewriteFormula(*cell.formula, func(ref string) string {
+        return sheet.updateRefForCopy(ref, dstRow-srcRow, dstCol-srcCol)
+    })
+    return sheet.setCellValue(dst, formula)
+}
+
+// Function that moves the cell src to the cell dst, as cut and paste. dst gets the contents,
+// comment and format of src, and src is cleared. Unlike CopyCell, the cell IDs in a formula of src
+// are not moved, and formulas of the sheet and of the other sheets of the workbook that refer to
+// src, as well as names for src, are updated to refer to dst, so that they follow the moved cell.
+// Ranges that contain src are unchanged. The undo history is cleared. Returns an error if src or
+// dst is locked, or if the formula of src would make a cycle at dst.
+func (sheet *SpreadSheet) MoveCell(src, dst string) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    srcRow, srcCol, err := sheet.getCellRowColInBounds(src)
+    if err != nil {
+        return err
+    }
+    dstRow, dstCol, err := sheet.getCellRowColInBounds(dst)
+    if err != nil {
+        return err
+    }
+    src, dst = getCellId(srcRow, srcCol), getCellId(dstRow, dstCol)
+    if src == dst {
+        return nil
+    }
+    for _, cellId := range []string{src, dst} {
+        row, col, _ := getCellRowCol(cellId)
+        if sheet.getCell(row, col).locked {
+            return fmt.Errorf("%w: %s", ErrCellLocked, cellId)
+        }
+    }
+    
+    sheet.refreshCell(srcRow, srcCol)
+    srcCell := sheet.touchCell(srcRow, srcCol)
+    if srcCell.formula != nil {
+        expr, err := sheet.getCellExpr(srcCell)
+        if err != nil {
+            return err
+        }
+        // Formulas that refer to src can't be referred to by its formula, so only the formula at
+        // dst may make a cycle.
+        if err := sheet.checkCycles(map[string]Expr{src: nil, dst: expr}); err != nil {
+            return err
+        }
+    }
+    
+    dstCell := sheet.touchCell(dstRow, dstCol)
+    srcBefore, dstBefore := srcCell.getCellValue(), dstCell.getCellValue()
+    // The dependents of every cell are rebuilt by rewriteFormulas.
+    *dstCell = *srcCell
+    *srcCell = *newCell()
+    
+    sheet.rewriteFormulas(func(ref string) string {
+        if strings.Contains(ref, ":") {
+            return ref
+        }
+        return mapCellIds(ref, func(id *CellId) {
+            if id.row == srcRow && id.col == srcCol {
+                id.row, id.col = dstRow, dstCol
+            }
+        })
+    })
+    sheet.notifyChange(src, srcBefore)
+    sheet.notifyChange(dst, dstBefore)
+    return nil
+}
+
+// Function that undoes the last call of SetCellValue, SetCellValues, ClearCell, CopyCell,
+// FillDown or FillRight that has not been undone, by restoring the cells it changed. The
+// dependents of the cells are recomputed. Returns an error if there is nothing to undo.
+func (sheet *SpreadSheet) Undo() error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    if len(sheet.undoStack) == 0 {
+        return ErrNothingToUndo
+    }
+    
+    changes := sheet.undoStack[len(sheet.undoStack)-1]
+    if err := sheet.checkChangesUnlocked(changes); err != nil {
+        return err
+    }
+    sheet.undoStack = sheet.undoStack[:len(sheet.undoStack)-1]
+    for i := len(changes)-1; i >= 0; i-- {
+        if err := sheet.setCellContent(changes[i].cellId, changes[i].before); err != nil {
+            return err
+        }
+    }
+    sheet.redoStack = append(sheet.redoStack, changes)
+    return nil
+}
+
+// Function that redoes the last call undone by Undo. Returns an error if there is nothing to
+// redo. Calls that change cells after Undo discard the calls that can be redone.
+func (sheet *SpreadSheet) Redo() error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    if len(sheet.redoStack) == 0 {
+        return ErrNothingToRedo
+    }
+    
+    changes := sheet.redoStack[len(sheet.redoStack)-1]
+    if err := sheet.checkChangesUnlocked(changes); err != nil {
+        return err
+    }
+    sheet.redoStack = sheet.redoStack[:len(sheet.redoStack)-1]
+    for _, change := range changes {
+        if err := sheet.setCellContent(change.cellId, change.after); err != nil {
+            return err
+        }
+    }
+    sheet.undoStack = append(sheet.undoStack, changes)
+    return nil
+}
+
+// Function that sets the max number of calls that can be undone, which is 100 by default. The
+// oldest calls are discarded if there are more. A limit of 0 disables undo.
+func (sheet *SpreadSheet) SetUndoLimit(limit int) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    if limit < 0 {
+        return fmt.Errorf("%w: undo limit %d", ErrInvalidArgument, limit)
+    }
+    
+    sheet.undoLimit = limit
+    sheet.trimUndoStack()
+    return nil
+}
+
+// Function to call fn, which changes cells, and record the changes so that they are undone as
+// one. The calls that can be redone are discarded. If fn returns an error, the cells it changed
+// before the error are restored, so that a call that fails changes nothing.
+func (sheet *SpreadSheet) recordChanges(fn func() error) error {
+    sheet.changes = make([]*CellChange, 0)
+    err := fn()
+    if err != nil {
+        changes := sheet.changes
+        sheet.changes = nil
+        for i := len(changes)-1; i >= 0; i-- {
+            // The cells had valid contents, so they can be restored.
+            sheet.setCellContent(changes[i].cellId, changes[i].before)
+        }
+        return err
+    }
+    if len(sheet.changes) > 0 {
+        sheet.undoStack = append(sheet.undoStack, sheet.changes)
+        sheet.trimUndoStack()
+        sheet.redoStack = nil
+    }
+    sheet.changes = nil
+    return err
+}
+
+// Function to check that none of the cells changed by a call is locked, so that the call can be
+// undone or redone as a whole.
+func (sheet *SpreadSheet) checkChangesUnlocked(changes []*CellChange) error {
+    for _, change := range changes {
+        row, col, err := sheet.getCellRowColInBounds(change.cellId)
+        if err != nil {
+            return err
+        }
+        if sheet.getCell(row, col).locked {
+            return fmt.Errorf("%w: %s", ErrCellLocked, change.cellId)
+        }
+    }
+    return nil
+}
+
+// Function to add a change of a cell to the changes of the call in progress, if they are recorded.
+func (sheet *SpreadSheet) addChange(cellId string, before, after *string) {
+    if (before == nil && after == nil) || (before != nil && after != nil && *before == *after) {
+        return
+    }
+    if sheet.changes != nil {
+        sheet.changes = append(sheet.changes, &CellChange{cellId: cellId, before: before, after: after})
+    }
+}
+
+// Function to discard the oldest entries of the undo stack beyond the undo limit.
+func (sheet *SpreadSheet) trimUndoStack() {
+    if len(sheet.undoStack) > sheet.undoLimit {
+        sheet.undoStack = sheet.undoStack[len(sheet.undoStack)-sheet.undoLimit:]
+    }
+}
+
+// Function to discard the calls that can be undone and redone. It is called when cells move, as
+// the changes are keyed by cell ID.
+func (sheet *SpreadSheet) clearHistory() {
+    sheet.undoStack = nil
+    sheet.redoStack = nil
+}
+
+// Function to set the contents of the cell to content as in SetCellValue, or to clear the cell if
+// content is nil.
+func (sheet *SpreadSheet) setCellContent(cellId string, content *string) error {
+    if content == nil {
+        return sheet.clearCell(cellId)
+    }
+    return sheet.setCellValue(cellId, *content)
+}
+
+// Function that fills the cells below src, down to the cell to in the same column, with copies of
+// src as in CopyCell. For example, filling =A1*2 from B1 down to B3 sets B2 to =A2*2 and B3 to
+// =A3*2.
+func (sheet *SpreadSheet) FillDown(src, to string) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    return sheet.recordChanges(func() error {
+        return sheet.fill(src, to, true)
+    })
+}
+
+// Function that fills the cells to the right of src, up to the cell to in the same row, with
+// copies of src as in CopyCell. For example, filling =A1*2 from A2 right to C2 sets B2 to =B1*2
+// and C2 to =C1*2.
+func (sheet *SpreadSheet) FillRight(src, to string) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    return sheet.recordChanges(func() error {
+        return sheet.fill(src, to, false)
+    })
+}
+
+// Function to copy src to each cell after it up to the cell to, down the column if down is true,
+// else right along the row.
+func (sheet *SpreadSheet) fill(src, to string, down bool) error {
+    srcRow, srcCol, err := sheet.getCellRowColInBounds(src)
+    if err != nil {
+        return err
+    }
+    toRow, toCol, err := sheet.getCellRowColInBounds(to)
+    if err != nil {
+        return err
+    }
+    
+    if down && (toCol != srcCol || toRow < srcRow) {
+        return fmt.Errorf("%w: cell %s is not below %s in the same column", ErrInvalidArgument, to, src)
+    }
+    if !down && (toRow != srcRow || toCol < srcCol) {
+        return fmt.Errorf("%w: cell %s is not right of %s in the same row", ErrInvalidArgument, to, src)
+    }
+    
+    for row := srcRow; row <= toRow; row++ {
+        for col := srcCol; col <= toCol; col++ {
+            if row == srcRow && col == srcCol {
+                continue
+            }
+            if err := sheet.copyCell(src, getCellId(row, col)); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// Function to move a cell ID or range by rowOffset rows and colOffset columns. Absolute rows and
+// columns don't move. Returns #REF! if the cell ID or range would move outside the sheet.
+func (sheet *SpreadSheet) updateRefForCopy(ref string, rowOffset, colOffset int) string {
+    name, ref := splitSheetRef(ref)
+    refSheet := sheet.getRefSheet(name)
+    if refSheet == nil {
+        return qualifyRef(name, ref)
+    }
+    
+    outside := false
+    ref = mapCellIds(ref, func(id *CellId) {
+        // Whole columns have no rows to move, and whole rows have no columns.
+        if !id.absRow && !id.wholeColumn {
+            id.row += rowOffset
+        }
+        if !id.absCol && !id.wholeRow {
+            id.col += colOffset
+        }
+        numRows, numCols := refSheet.dimensions()
+        if id.row < 0 || id.row >= numRows || id.col < 0 || id.col >= numCols {
+            outside = true
+        }
+    })
+    
+    if outside {
+        return ErrRef.Error()
+    }
+    return qualifyRef(name, ref)
+}
+
+// Function that inserts an empty row before the zero based row index at, so that row at and the
+// rows below it move down by one. at may be the number of rows, to add a row at the bottom. The
+// cell IDs in formulas are updated to refer to the moved cells.
+func (sheet *SpreadSheet) InsertRow(at int) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    numRows, numCols := sheet.dimensions()
+    if at < 0 || at > numRows {
+        return fmt.Errorf("%w: row %d", ErrIndexOutOfBounds, at)
+    }
+    if numCols == 0 {
+        return fmt.Errorf("%w: a row of a sheet without columns", ErrInvalidDimensions)
+    }
+    
+    sheet.cells.insertRow(at)
+    
+    sheet.rewriteFormulas(func(ref string) string {
+        return updateRefForInsert(ref, at, false)
+    })
+    return nil
+}
+
+// Function that deletes the row at the zero based row index at, so that the rows below it move up
+// by one. The cell IDs in formulas are updated to refer to the moved cells. A cell ID of the
+// deleted row is replaced with #REF!, and a range that spans the deleted row shrinks by one row.
+func (sheet *SpreadSheet) DeleteRow(at int) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    numRows, _ := sheet.dimensions()
+    if at < 0 || at >= numRows {
+        return fmt.Errorf("%w: row %d", ErrIndexOutOfBounds, at)
+    }
+    if numRows == 1 {
+        return ErrOnlyRowOrColumn
+    }
+    
+    sheet.cells.deleteRow(at)
+    sheet.rewriteFormulas(func(ref string) string {
+        return updateRefForDelete(ref, at, false)
+    })
+    return nil
+}
+
+// Function that inserts an empty column before the zero based column index at, so that column at
+// and the columns to its right move right by one. at may be the number of columns, to add a
+// column at the right. The cell IDs in formulas are updated to refer to the moved cells.
+func (sheet *SpreadSheet) InsertColumn(at int) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    numRows, numCols := sheet.dimensions()
+    if at < 0 || at > numCols {
+        return fmt.Errorf("%w: column %d", ErrIndexOutOfBounds, at)
+    }
+    if numRows == 0 {
+        return fmt.Errorf("%w: a column of a sheet without rows", ErrInvalidDimensions)
+    }
+    if numCols >= sheet.maxNumCols {
+        return fmt.Errorf("%w of %d", ErrTooManyColumns, sheet.maxNumCols)
+    }
+    
+    sheet.cells.insertColumn(at)
+    
+    sheet.rewriteFormulas(func(ref string) string {
+        return updateRefForInsert(ref, at, true)
+    })
+    return nil
+}
+
+// Function that deletes the column at the zero based column index at, so that the columns to its
+// right move left by one. The cell IDs in formulas are updated to refer to the moved cells. A cell
+// ID of the deleted column is replaced with #REF!, and a range that spans the deleted column
+// shrinks by one column.
+func (sheet *SpreadSheet) DeleteColumn(at int) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    _, numCols := sheet.dimensions()
+    if at < 0 || at >= numCols {
+        return fmt.Errorf("%w: column %d", ErrIndexOutOfBounds, at)
+    }
+    if numCols == 1 {
+        return ErrOnlyRowOrColumn
+    }
+    
+    sheet.cells.deleteColumn(at)
+    sheet.rewriteFormulas(func(ref string) string {
+        return updateRefForDelete(ref, at, true)
+    })
+    return nil
+}
+
+// Function to update a cell ID or range for an inserted row, or column if isColumn is true, at the
+// zero based index at. Cell IDs at or after the index move by one.
+func updateRefForInsert(ref string, at int, isColumn bool) string {
+    return mapCellIds(ref, func(id *CellId) {
+        index := &id.row
+        if isColumn {
+            index = &id.col
+        }
+        if *index >= at {
+            *index++
+        }
+    })
+}
+
+// Function to update a cell ID or range for a deleted row, or column if isColumn is true, at the
+// zero based index at. Cell IDs after the index move back by one. A cell ID at the index is
+// replaced with #REF!, and a range that spans the index shrinks by one. Ranges of whole columns
+// are unchanged by a deleted row, as are ranges of whole rows by a deleted column.
+func updateRefForDelete(ref string, at int, isColumn bool) string {
+    ids, err := parseRangeCorners(ref)
+    if err != nil || isColumn && ids[0].wholeRow || !isColumn && ids[0].wholeColumn {
+        return ref
+    }
+    
+    // Find the first and last index of the range along the deleted row or column.
+    first, last := -1, -1
+    for _, id := range ids {
+        index := id.row
+        if isColumn {
+            index = id.col
+        }
+        if first == -1 || index < first {
+            first = index
+        }
+        if index > last {
+            last = index
+        }
+    }
+    if first == at && last == at {
+        return ErrRef.Error()
+    }
+    
+    return mapCellIds(ref, func(id *CellId) {
+        index := &id.row
+        if isColumn {
+            index = &id.col
+        }
+        // The last cell ID of a range in the deleted row or column moves back to the index before
+        // it, and the first stays at the index, which then has the row or column after it.
+        if *index > at || (*index == at && *index == last) {
+            *index--
+        }
+    })
+}
+
+// Function that resizes the sheet to numRows rows and numCols columns. New cells are not set.
+// Returns an error if a cell that would be removed is referred to by a formula of a cell that
+// would remain. A sheet without cells, as in new(SpreadSheet), gets the default settings.
+func (sheet *SpreadSheet) Resize(numRows, numCols int) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    sheet.setDefaults()
+    if err := sheet.checkDimensions(numRows, numCols); err != nil {
+        return err
+    }
+    
+    // The first cell in row major order that would be removed and is referred to by a formula of
+    // a cell that would remain, and the cell of the formula.
+    referredRow, referredCol, referredBy := 0, 0, ""
+    refer := func(row, col int, cid string) {
+        // Cells of other sheets of the workbook always remain.
+        if name, _ := splitSheetRef(cid); len(name) == 0 {
+            if dependentRow, dependentCol, _ := getCellRowCol(cid); dependentRow >= numRows || dependentCol >= numCols {
+                return
+            }
+        }
+        if len(referredBy) == 0 || row < referredRow || row == referredRow && col < referredCol ||
+            row == referredRow && col == referredCol && cid < referredBy {
+            referredRow, referredCol, referredBy = row, col, cid
+        }
+    }
+    sheet.forEachCell(func(row, col int, cell *Cell) {
+        if row >= numRows || col >= numCols {
+            for cid := range cell.dependentCells {
+                refer(row, col, cid)
+            }
+        }
+    })
+    for cellRange, dependents := range sheet.rangeDependents {
+        // The first cell of the range that would be removed is in its first row, unless the range
+        // is within the columns that remain. The corners of the key are in order. Ranges of whole
+        // columns shrink with the rows of the sheet, and ranges of whole rows with the columns, so
+        // only their columns or rows may be removed.
+        row, col := cellRange.row1, cellRange.col1
+        switch {
+        case cellRange.wholeColumns && cellRange.col2 < numCols,
+            cellRange.wholeRows && cellRange.row2 < numRows:
+            continue
+        case cellRange.wholeColumns:
+            col = max(col, numCols)
+        case cellRange.wholeRows:
+            row = max(row, numRows)
+        case row >= numRows:
+        case cellRange.col2 >= numCols:
+            col = max(col, numCols)
+        case cellRange.row2 >= numRows:
+            row = numRows
+        default:
+            continue
+        }
+        for cid := range dependents {
+            refer(row, col, cid)
+        }
+    }
+    if len(referredBy) > 0 {
+        return fmt.Errorf("%w: %s is referred to by %s", ErrCellReferenced, getCellId(referredRow, referredCol), referredBy)
+    }
+    
+    if sheet.cells == nil {
+        sheet.cells = newDenseCells(0, 0)
+    }
+    sheet.cells.resize(numRows, numCols)
+    
+    // Removed formula cells are still dependents of the cells they referred to.
+    sheet.rebuildDependents()
+    sheet.clearHistory()
+    return nil
+}
+
+// Function to rewrite the cell IDs and ranges of the sheet in every formula using fn, as in
+// rewriteFormula. The formulas of the other sheets of the workbook are rewritten as well, where
+// they refer to the sheet, and so are the cell IDs and ranges of names. The dependents of every
+// cell are then rebuilt, as they are keyed by cell ID.
+func (sheet *SpreadSheet) rewriteFormulas(fn func(ref string) string) {
+    sheet.clearHistory()
+    for _, formulaSheet := range sheet.getSheets() {
+        rewriteRef := func(ref string) string {
+            name, ref := splitSheetRef(ref)
+            if formulaSheet.getRefSheet(name) != sheet {
+                return qualifyRef(name, ref)
+            }
+            return qualifyRef(name, fn(ref))
+        }
+        formulaSheet.forEachCell(func(row, col int, cell *Cell) {
+            if cell.formula != nil {
+                formula := rewriteFormula(*cell.formula, rewriteRef)
+                cell.formula = &formula
+            }
+        })
+        for name, ref := range formulaSheet.names {
+            formulaSheet.names[name] = rewriteRef(ref)
+        }
+    }
+    sheet.rebuildDependents()
+}
+
+// Function to rebuild the dependents of every cell of the sheets of the workbook, or of the sheet
+// if it is not in a workbook, from the formulas and recompute the formula cells. The formulas are
+// parsed again, as they or the names they refer to may have changed.
+func (sheet *SpreadSheet) rebuildDependents() {
+    sheets := sheet.getSheets()
+    for _, formulaSheet := range sheets {
+        // All the formula cells are recomputed, and stale cells may have moved.
+        formulaSheet.staleCells = nil
+        formulaSheet.rangeDependents = nil
+        formulaSheet.forEachCell(func(row, col int, cell *Cell) {
+            cell.dependentCells = make(map[string]interface{})
+            cell.expr = nil
+        })
+    }
+    
+    formulaCellIds := make(map[*SpreadSheet][]string)
+    for _, formulaSheet := range sheets {
+        formulaSheet.forEachCell(func(row, col int, cell *Cell) {
+            if cell.formula != nil {
+                if expr, err := formulaSheet.getCellExpr(cell); err == nil {
+                    formulaSheet.addDependees(getCellId(row, col), expr)
+                }
+                formulaCellIds[formulaSheet] = append(formulaCellIds[formulaSheet], getCellId(row, col))
+            }
+        })
+    }
+    for formulaSheet, cellIds := range formulaCellIds {
+        formulaSheet.recomputeWithDependents(cellIds)
+    }
+}
+
+// Function that defines a name for a cell ID or range of the sheet, so that formulas may refer
+// to it by the name. For example, after defining Revenue as A1:A12, =SUM(Revenue) is the sum of
+// A1 to A12. Names are case insensitive, are made of alphabets, digits and underscores, and
+// must not be cell IDs. The ref may be qualified with another sheet of the workbook, as in
+// Sheet2!A1:A12. Redefining a name recomputes the formulas that refer to it. Returns a CycleError
+// if a formula that refers to the name would refer to its own cell.
+func (sheet *SpreadSheet) DefineName(name, ref string) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    if !isValidName(name) {
+        return fmt.Errorf("%w: %s", ErrInvalidName, name)
+    }
+    
+    ref = strings.TrimSpace(ref)
+    if _, err := parseFormulaNumber(ref); err == nil {
+        return fmt.Errorf("%w: %s refers to %s, which is not a cell ID or range", ErrInvalidName, name, ref)
+    }
+    cellRange, err := parseRange(ref)
+    if err != nil {
+        return err
+    }
+    if sheet.getRefSheet(cellRange.sheet) == nil {
+        return fmt.Errorf("%w: %s refers to %s, which is not a cell ID or range", ErrInvalidName, name, ref)
+    }
+    if err := sheet.checkRangeInBounds(cellRange); err != nil {
+        return err
+    }
+    
+    oldRef, defined := sheet.names[strings.ToUpper(name)]
+    sheet.names[strings.ToUpper(name)] = ref
+    if err := sheet.checkNameCycles(); err != nil {
+        if defined {
+            sheet.names[strings.ToUpper(name)] = oldRef
+        } else {
+            delete(sheet.names, strings.ToUpper(name))
+        }
+        return err
+    }
+    sheet.rebuildDependents()
+    return nil
+}
+
+// Function to check that the formulas of the sheet don't make a cycle with the current names,
+// such as =SUM(Total) in A3 after defining Total as A1:A3, whose range has the formula's own cell.
+// Formulas that don't parse, such as those that refer to a name whose cells were deleted, refer to
+// no cells and are skipped.
+func (sheet *SpreadSheet) checkNameCycles() error {
+    formulas := make(map[string]Expr)
+    sheet.forEachCell(func(row, col int, cell *Cell) {
+        if cell.formula == nil {
+            return
+        }
+        if expr, err := sheet.parseFormula(*cell.formula); err == nil {
+            formulas[getCellId(row, col)] = expr
+        }
+    })
+    return sheet.checkCycles(formulas)
+}
+
+// Function that deletes a name defined by DefineName. Formulas that refer to the name have the
+// error ErrName.
+func (sheet *SpreadSheet) DeleteName(name string) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    if _, ok := sheet.names[strings.ToUpper(name)]; !ok {
+        return fmt.Errorf("%w: %s", ErrUndefinedName, name)
+    }
+    
+    delete(sheet.names, strings.ToUpper(name))
+    sheet.rebuildDependents()
+    return nil
+}
+
+// Function that returns the value of the cell. If the formula of the cell has an error, such
+// as ErrDivByZero, the error is returned. Returns ErrValue if the cell holds text.
+func (sheet *SpreadSheet) GetCellValue(cellId string) (float64, error) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return 0, err
+    }
+    sheet.refreshCell(row, col)
+    
+    if sheet.getCell(row, col).err != nil {
+        return 0, sheet.getCell(row, col).err
+    }
+    if sheet.getCell(row, col).text != nil {
+        return 0, ErrValue
+    }
+    if sheet.getCell(row, col).isEmpty() && sheet.defaultValue != nil {
+        return *sheet.defaultValue, nil
+    }
+
+    return sheet.getCell(row, col).getValue(), nil
+}
+
+// Function that evaluates the formula against the current values of the sheet without storing it
+// in a cell, for previews. The leading = is optional, so "=A1+B2*2" and "A1+B2*2" are the same.
+// Returns the error of the formula, such as ErrDivByZero, or ErrValue if its value is text.
+func (sheet *SpreadSheet) Evaluate(formula string) (float64, error) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    if !strings.HasPrefix(strings.TrimSpace(formula), "=") {
+        formula = "=" + formula
+    }
+    expr, err := sheet.parseFormula(formula)
+    if err != nil {
+        return 0, err
+    }
+    for _, cellRange := range expr.getRanges() {
+        if err := sheet.checkRangeInBounds(cellRange); err != nil {
+            return 0, err
+        }
+    }
+    
+    // Stale cells the formula refers to are computed when it reads them.
+    mutex := sheet.getEvalMutex()
+    mutex.Lock()
+    defer mutex.Unlock()
+    value, err := expr.eval(sheet)
+    if err == nil {
+        err = checkFinite(value)
+    }
+    if err != nil {
+        return 0, err
+    }
+    return getNumber(value)
+}
+
+// Function that checks that the formula could be set in the cell without changing the sheet, for
+// validating input before it is committed. The leading = is optional as in Evaluate. Returns the
+// error SetCellValue would return for the formula: a FormulaError for invalid syntax, a CellIdError
+// for a reference outside the sheet, or a CycleError if the formula would make a cycle with the
+// current formulas of the sheet.
+func (sheet *SpreadSheet) ValidateFormula(cellId, formula string) error {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return err
+    }
+    cellId = getCellId(row, col)
+    
+    if !strings.HasPrefix(strings.TrimSpace(formula), "=") {
+        formula = "=" + formula
+    }
+    _, expr, err := sheet.validateCellValue(cellId, formula)
+    if err != nil {
+        return err
+    }
+    return sheet.checkCycles(map[string]Expr{cellId: expr})
+}
+
+// Function that returns the value of the cell with its kind, which is number, text, error or empty
+// for a cell that is not set. The value of a formula cell is the value of its formula.
+func (sheet *SpreadSheet) GetCell(cellId string) (CellValue, error) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return CellValue{}, err
+    }
+    sheet.refreshCell(row, col)
+    
+    return sheet.getCell(row, col).getCellValue(), nil
+}
+
+// Function that subscribes fn to changes of the values of cells. fn is called with the cell ID
+// and new value of each cell whose value changes, including formula cells whose values change
+// because a cell they refer to changes. fn is called after the sheet is updated and unlocked, so
+// it may read or update the sheet. The changed cells are passed in row major order, sheet by sheet
+// by name, and each to the subscribers in the order they subscribed. Returns a function that
+// unsubscribes fn.
+func (sheet *SpreadSheet) Subscribe(fn func(cellId string, value CellValue)) func() {
+    sheet.getMutex().Lock()
+    defer sheet.getMutex().Unlock()
+    
+    if sheet.subscribers == nil {
+        sheet.subscribers = make(map[int]func(cellId string, value CellValue))
+    }
+    id := sheet.nextSubscriberId
+    sheet.nextSubscriberId++
+    sheet.subscribers[id] = fn
+    
+    return func() {
+        sheet.getMutex().Lock()
+        defer sheet.getMutex().Unlock()
+        delete(sheet.subscribers, id)
+    }
+}
+
+// Function to unlock the sheet, which must be locked for writing, and then call the subscribers
+// with the cells whose values changed while it was locked. The sheets of a workbook share the
+// lock, so the subscribers of the other sheets of the workbook are called as well.
+func (sheet *SpreadSheet) unlockAndNotify() {
+    type notification struct {
+        fns []func(cellId string, value CellValue)
+        cellIds []string
+        values map[string]CellValue
+    }
+    notifications := make([]*notification, 0)
+    for _, changedSheet := range sheet.getSheets() {
+        // Subscribers are called with the new values of cells as they change, so stale cells are
+        // computed now.
+        if len(changedSheet.subscribers) > 0 {
+            for cellId := range changedSheet.staleCells {
+                changedSheet.computeIfStale(cellId)
+            }
+        }
+        if len(changedSheet.changedValues) == 0 {
+            continue
+        }
+        n := &notification{values: changedSheet.changedValues}
+        // Subscribers are called in the order they subscribed.
+        ids := make([]int, 0, len(changedSheet.subscribers))
+        for id := range changedSheet.subscribers {
+            ids = append(ids, id)
+        }
+        sort.Ints(ids)
+        for _, id := range ids {
+            n.fns = append(n.fns, changedSheet.subscribers[id])
+        }
+        for cellId := range n.values {
+            n.cellIds = append(n.cellIds, cellId)
+        }
+        sortCellIds(n.cellIds)
+        notifications = append(notifications, n)
+        changedSheet.changedValues = nil
+    }
+    sheet.getMutex().Unlock()
+    
+    for _, n := range notifications {
+        for _, cellId := range n.cellIds {
+            for _, fn := range n.fns {
+                fn(cellId, n.values[cellId])
+            }
+        }
+    }
+}
+
+// Function to record that the value of the cell changed from before, if it did and the sheet has
+// subscribers, so that they are called when the sheet is unlocked.
+func (sheet *SpreadSheet) notifyChange(cellId string, before CellValue) {
+    if len(sheet.subscribers) == 0 {
+        return
+    }
+    row, col, _ := getCellRowCol(cellId)
+    after := sheet.getCell(row, col).getCellValue()
+    if after == before {
+        return
+    }
+    if sheet.changedValues == nil {
+        sheet.changedValues = make(map[string]CellValue)
+    }
+    sheet.changedValues[cellId] = after
+}
+
+// Function that returns the value of the cell as it is displayed. It is the text of a text cell,
+// the formatted number of a number or formula, the error of a formula with an error, such as
+// #DIV/0!, or empty if the cell is not set.
+func (sheet *SpreadSheet) GetCellDisplay(cellId string) (string, error) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return "", err
+    }
+    sheet.refreshCell(row, col)
+    return sheet.getCell(row, col).getFormattedDisplay(), nil
+}
+
+// Function that returns the value of the cell as a string for rendering, which is the same as
+// GetCellDisplay: the formatted number, the text, the error code such as #DIV/0! or #REF!, or
+// empty if the cell is not set.
+func (sheet *SpreadSheet) GetCellValueString(cellId string) (string, error) {
+    return sheet.GetCellDisplay(cellId)
+}
+
+// Function that locks the cell, so that SetCellValue, SetCellValues and ClearCell return
+// ErrCellLocked for it, as do CopyCell, FillDown, FillRight, Undo and Redo if they would update
+// it. The cell may still be moved by inserting or deleting rows and columns, and a formula of the
+// cell is still recomputed when the cells it refers to change.
+func (sheet *SpreadSheet) LockCell(cellId string) error {
+    return sheet.setCellLocked(cellId, true)
+}
+
+// Function that unlocks the cell, so that it can be updated again.
+func (sheet *SpreadSheet) UnlockCell(cellId string) error {
+    return sheet.setCellLocked(cellId, false)
+}
+
+func (sheet *SpreadSheet) setCellLocked(cellId string, locked bool) error {
+    sheet.getMutex().Lock()
+    defer sheet.getMutex().Unlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return err
+    }
+    sheet.touchCell(row, col).locked = locked
+    return nil
+}
+
+// Function that sets the number format of the cell, which changes how its number is displayed by
+// GetCellDisplay, GetCellValueString, Print and WriteHTML, but not its value. A format has # and 0
+// digits, with commas for a thousands separator, optionally followed by . and a 0 for each
+// decimal place, and an optional %, which displays the number times 100. A 0 digit is always
+// displayed, so 0.5 is "0.5" with 0.0 but ".5" with #.0. For example, 1234.5 is "1,234.50" with
+// #,##0.00 and 0.25 is "25%" with 0%. An empty format removes the format. Text, errors and cells
+// that are not set are displayed as before. Returns an error if the format is invalid.
+func (sheet *SpreadSheet) SetCellFormat(cellId, format string) error {
+    sheet.getMutex().Lock()
+    defer sheet.getMutex().Unlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return err
+    }
+    if len(format) == 0 {
+        sheet.touchCell(row, col).format = nil
+        return nil
+    }
+    if _, err := parseNumberFormat(format); err != nil {
+        return err
+    }
+    sheet.touchCell(row, col).format = &format
+    return nil
+}
+
+// Function that sets the comment of the cell, such as a note on where its value comes from. An
+// empty comment removes the comment. The value and formula of the cell are unchanged.
+func (sheet *SpreadSheet) SetCellComment(cellId, comment string) error {
+    sheet.getMutex().Lock()
+    defer sheet.getMutex().Unlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return err
+    }
+    
+    if len(comment) == 0 {
+        sheet.touchCell(row, col).comment = nil
+        return nil
+    }
+    sheet.touchCell(row, col).comment = &comment
+    return nil
+}
+
+// Function that returns the comment of the cell and true if the cell has a comment. Returns an
+// empty string and false if it has none.
+func (sheet *SpreadSheet) GetCellComment(cellId string) (string, bool, error) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return "", false, err
+    }
+    
+    if sheet.getCell(row, col).comment == nil {
+        return "", false, nil
+    }
+    return *sheet.getCell(row, col).comment, true, nil
+}
+
+// Function that returns the formula of the cell and true if the cell has a formula. Returns an
+// empty string and false if the cell has a number or is not set.
+func (sheet *SpreadSheet) GetCellFormula(cellId string) (string, bool, error) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return "", false, err
+    }
+    
+    if sheet.getCell(row, col).formula == nil {
+        return "", false, nil
+    }
+    return *sheet.getCell(row, col).formula, true, nil
+}
+
+// Function that returns the number of rows and columns of the sheet.
+func (sheet *SpreadSheet) Dimensions() (rows, cols int) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    return sheet.dimensions()
+}
+
+// Function that calls fn with the cell ID and value of each cell that is set, in row major order.
+// The value of a cell with an error or text is 0. fn is called after the sheet is read, so it may
+// update the sheet.
+func (sheet *SpreadSheet) ForEachSetCell(fn func(cellId string, value float64)) {
+    sheet.getMutex().RLock()
+    sheet.refreshAllCells()
+    cellIds := make([]string, 0)
+    values := make([]float64, 0)
+    sheet.forEachCell(func(row, col int, cell *Cell) {
+        if !cell.isEmpty() {
+            cellIds = append(cellIds, getCellId(row, col))
+            values = append(values, cell.getValue())
+        }
+    })
+    sheet.getMutex().RUnlock()
+    
+    for i, cellId := range cellIds {
+        fn(cellId, values[i])
+    }
+}
+
+// Function that returns the sorted cell IDs of the cells whose formulas refer to the cell. Cell IDs
+// of other sheets are qualified with the sheet name, as in Sheet2!A1.
+func (sheet *SpreadSheet) GetDependents(cellId string) ([]string, error) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return nil, err
+    }
+    
+    dependents := make([]string, 0)
+    seen := make(map[string]bool)
+    sheet.forEachDependent(row, col, func(cid string) {
+        if !seen[cid] {
+            seen[cid] = true
+            dependents = append(dependents, cid)
+        }
+    })
+    sortCellIds(dependents)
+    return dependents, nil
+}
+
+// Function that returns the sorted cell IDs of the cells that would be recomputed if the cell
+// changed, which are its dependents, their dependents and so on, without changing the cell. Cell
+// IDs of other sheets are qualified with the sheet name, as in Sheet2!A1.
+func (sheet *SpreadSheet) AffectedBy(cellId string) ([]string, error) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return nil, err
+    }
+    cellId = getCellId(row, col)
+    
+    affectedCellIds := make(map[*SpreadSheet]map[string]bool)
+    sheet.addDependents([]string{cellId}, affectedCellIds)
+    affected := make([]string, 0)
+    for affectedSheet, cellIds := range affectedCellIds {
+        for affectedId := range cellIds {
+            if affectedSheet == sheet && affectedId == cellId {
+                continue
+            }
+            affected = append(affected, affectedSheet.getDependentId(sheet, affectedId))
+        }
+    }
+    sortCellIds(affected)
+    return affected, nil
+}
+
+// Function that returns the sorted cell IDs that the formula of the cell refers to. Ranges are
+// expanded to their cells. Cell IDs of other sheets are qualified with the sheet name, as in
+// Sheet2!A1. Returns an empty slice if the cell has no formula.
+func (sheet *SpreadSheet) GetPrecedents(cellId string) ([]string, error) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return nil, err
+    }
+    
+    precedents := make([]string, 0)
+    cell := sheet.getCell(row, col)
+    if cell.formula == nil {
+        return precedents, nil
+    }
+    expr, err := sheet.getCellExpr(cell)
+    if err != nil {
+        return precedents, nil
+    }
+    seen := make(map[string]bool)
+    for _, cellRange := range expr.getRanges() {
+        refSheet := sheet.getRefSheet(cellRange.sheet)
+        top, left, bottom, right := cellRange.getBounds(refSheet)
+        for precedentRow := top; precedentRow <= bottom; precedentRow++ {
+            for precedentCol := left; precedentCol <= right; precedentCol++ {
+                precedentId := getCellId(precedentRow, precedentCol)
+                if refSheet != sheet {
+                    precedentId = qualifyRef(cellRange.sheet, precedentId)
+                }
+                if !seen[precedentId] {
+                    seen[precedentId] = true
+                    precedents = append(precedents, precedentId)
+                }
+            }
+        }
+    }
+    sortCellIds(precedents)
+    return precedents, nil
+}
+
+// Function that returns the cell IDs of a range, such as A1:B2, in row major order, for processing
+// a block of cells. The corners may be in any order, and a cell ID is a range of one cell. The
+// range may be qualified with another sheet of the workbook, as in Sheet2!A1:B2, whose cell IDs
+// are then qualified as well. Returns an error if rangeStr is not a valid range or a corner is
+// outside its sheet, which is checked before any cell ID is made.
+func (sheet *SpreadSheet) Range(rangeStr string) ([]string, error) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    rangeStr = strings.TrimSpace(rangeStr)
+    if _, err := parseFormulaNumber(rangeStr); err == nil {
+        return nil, fmt.Errorf("%w: %s is not a cell ID or range", ErrInvalidArgument, rangeStr)
+    }
+    cellRange, err := parseRange(rangeStr)
+    if err != nil {
+        return nil, err
+    }
+    if err := sheet.checkRangeInBounds(cellRange); err != nil {
+        return nil, err
+    }
+    
+    refSheet := sheet.getRefSheet(cellRange.sheet)
+    top, left, bottom, right := cellRange.getBounds(refSheet)
+    cellIds := make([]string, 0, (bottom-top+1)*(right-left+1))
+    for row := top; row <= bottom; row++ {
+        for col := left; col <= right; col++ {
+            cellId := getCellId(row, col)
+            if refSheet != sheet {
+                cellId = qualifyRef(cellRange.sheet, cellId)
+            }
+            cellIds = append(cellIds, cellId)
+        }
+    }
+    return cellIds, nil
+}
+
+// Function that returns true if the cell is not set, i.e. it has neither a value nor a formula.
+func (sheet *SpreadSheet) IsCellEmpty(cellId string) (bool, error) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    row, col, err := sheet.getCellRowColInBounds(cellId)
+    if err != nil {
+        return false, err
+    }
+
+    return sheet.getCell(row, col).isEmpty(), nil
+}
+
+// Function that returns an independent copy of the sheet, with copies of its cells and names and
+// the same settings, such as the undo limit and lazy evaluation, for snapshots and what-if
+// analysis. Updating the copy doesn't change the sheet and vice versa. The copy has no undo
+// history or subscribers, and is not in a workbook, so formulas that refer to other sheets of the
+// workbook are replaced with their values and names for cells of other sheets are not copied.
+func (sheet *SpreadSheet) Clone() *SpreadSheet {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    sheet.refreshAllCells()
+    
+    numRows, numCols := sheet.dimensions()
+    var clone *SpreadSheet
+    if _, ok := sheet.cells.(*sparseCells); ok {
+        clone = newSpreadSheet(newSparseCells(numRows, numCols))
+    } else {
+        clone = newSpreadSheet(newDenseCells(numRows, numCols))
+    }
+    clone.undoLimit = sheet.undoLimit
+    clone.maxFormulaDepth = sheet.maxFormulaDepth
+    clone.maxNumCols = sheet.maxNumCols
+    clone.defaultValue = sheet.defaultValue
+    clone.maxIterations, clone.tolerance = sheet.maxIterations, sheet.tolerance
+    clone.lazy = sheet.lazy
+    for name, ref := range sheet.names {
+        if refSheet, _ := splitSheetRef(ref); len(refSheet) == 0 {
+            clone.names[name] = ref
+        }
+    }
+    
+    sheet.forEachCell(func(row, col int, cell *Cell) {
+        if cell.isUnused() {
+            return
+        }
+        cloneCell := clone.touchCell(row, col)
+        if cell.comment != nil {
+            comment := *cell.comment
+            cloneCell.comment = &comment
+        }
+        cloneCell.locked = cell.locked
+        if cell.format != nil {
+            format := *cell.format
+            cloneCell.format = &format
+        }
+        if cell.value != nil {
+            value := *cell.value
+            cloneCell.value = &value
+        }
+        if cell.text != nil {
+            text := *cell.text
+            cloneCell.text = &text
+        }
+        cloneCell.err = cell.err
+        cloneCell.depth = cell.depth
+        if cell.formula == nil {
+            return
+        }
+        
+        expr, err := sheet.getCellExpr(cell)
+        if err != nil {
+            return
+        }
+        for _, cellRange := range expr.getRanges() {
+            if sheet.getRefSheet(cellRange.sheet) != sheet {
+                return
+            }
+        }
+        formula := *cell.formula
+        cloneCell.formula = &formula
+        // The parsed formula is not changed once parsed, so it is shared with the clone.
+        cloneCell.expr = expr
+    })
+    
+    // The values are copied, so only the dependents are rebuilt.
+    clone.forEachCell(func(row, col int, cell *Cell) {
+        if cell.formula != nil {
+            clone.addDependees(getCellId(row, col), cell.expr)
+        }
+    })
+    return clone
+}
+
+// Function that returns the cells whose value or formula differs between the sheets a and b, such
+// as a sheet and its clone, in row major order. Returns ErrDimensionMismatch if the sheets don't
+// have the same dimensions.
+func Diff(a, b *SpreadSheet) ([]CellDiff, error) {
+    a.getMutex().RLock()
+    defer a.getMutex().RUnlock()
+    if b.getMutex() != a.getMutex() {
+        b.getMutex().RLock()
+        defer b.getMutex().RUnlock()
+    }
+    
+    numRows, numCols := a.dimensions()
+    if bRows, bCols := b.dimensions(); bRows != numRows || bCols != numCols {
+        return nil, fmt.Errorf("%w: %dx%d and %dx%d", ErrDimensionMismatch, numRows, numCols, bRows, bCols)
+    }
+    a.refreshAllCells()
+    b.refreshAllCells()
+    
+    // Cells that are set in either sheet.
+    cellIdSet := make(map[string]bool)
+    for _, sheet := range []*SpreadSheet{a, b} {
+        sheet.forEachCell(func(row, col int, cell *Cell) {
+            if !cell.isEmpty() {
+                cellIdSet[getCellId(row, col)] = true
+            }
+        })
+    }
+    cellIds := make([]string, 0, len(cellIdSet))
+    for cellId := range cellIdSet {
+        cellIds = append(cellIds, cellId)
+    }
+    sortCellIds(cellIds)
+    
+    diffs := make([]CellDiff, 0)
+    for _, cellId := range cellIds {
+        row, col, _ := getCellRowCol(cellId)
+        diff := CellDiff{CellId: cellId, Old: a.getCell(row, col).getCellValue(), New: b.getCell(row, col).getCellValue()}
+        if formula := a.getCell(row, col).formula; formula != nil {
+            diff.OldFormula = *formula
+        }
+        if formula := b.getCell(row, col).formula; formula != nil {
+            diff.NewFormula = *formula
+        }
+        if diff.Old != diff.New || diff.OldFormula != diff.NewFormula {
+            diffs = append(diffs, diff)
+        }
+    }
+    return diffs, nil
+}
+
+// Function that writes the values of the sheet to w as CSV, one record per row of the sheet.
+// Cells that are not set are written as empty fields and cells with an error as the error. If
+// withHeader is true, the first record has the column names.
+func (sheet *SpreadSheet) SaveCSV(w io.Writer, withHeader bool) error {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    sheet.refreshAllCells()
+    writer := csv.NewWriter(w)
+    numRows, numCols := sheet.dimensions()
+    if withHeader && numRows > 0 {
+        header := make([]string, numCols)
+        for col := range header {
+            header[col] = GetColumnName(col)
+        }
+        if err := writer.Write(header); err != nil {
+            return err
+        }
+    }
+    
+    for row := 0; row < numRows; row++ {
+        record := make([]string, numCols)
+        for col := range record {
+            record[col] = sheet.getCell(row, col).getDisplay()
+        }
+        if err := writer.Write(record); err != nil {
+            return err
+        }
+    }
+    
+    writer.Flush()
+    return writer.Error()
+}
+
+// Function that writes the values of the sheet to w as a text table for debugging, with the column
+// names as the first row and the row numbers as the first column. The columns are aligned, with
+// numbers aligned right and text and errors aligned left. Cells that are not set are blank.
+func (sheet *SpreadSheet) Print(w io.Writer) error {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    sheet.refreshAllCells()
+    numRows, numCols := sheet.dimensions()
+    
+    // The first row and column of the table are the column names and row numbers.
+    table := make([][]string, numRows+1)
+    alignRight := make([][]bool, numRows+1)
+    table[0] = make([]string, numCols+1)
+    alignRight[0] = make([]bool, numCols+1)
+    for col := 0; col < numCols; col++ {
+        table[0][col+1] = GetColumnName(col)
+    }
+    for row := 0; row < numRows; row++ {
+        table[row+1] = make([]string, numCols+1)
+        alignRight[row+1] = make([]bool, numCols+1)
+        table[row+1][0] = strconv.Itoa(row + 1)
+        alignRight[row+1][0] = true
+        for col := 0; col < numCols; col++ {
+            cell := sheet.getCell(row, col)
+            table[row+1][col+1] = cell.getFormattedDisplay()
+            alignRight[row+1][col+1] = cell.getCellValue().Kind == KindNumber
+        }
+    }
+    
+    widths := make([]int, numCols+1)
+    for _, record := range table {
+        for col, field := range record {
+            if width := utf8.RuneCountInString(field); width > widths[col] {
+                widths[col] = width
+            }
+        }
+    }
+    
+    for row, record := range table {
+        line := ""
+        for col, field := range record {
+            padding := strings.Repeat(" ", widths[col]-utf8.RuneCountInString(field))
+            if col > 0 {
+                line += "  "
+            }
+            if alignRight[row][col] {
+                line += padding + field
+            } else {
+                line += field + padding
+            }
+        }
+        if _, err := io.WriteString(w, strings.TrimRight(line, " ")+"\n"); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Function that writes the values of the sheet to w as an HTML table, for embedding the sheet in
+// a report. The first row has the column names and the first column the row numbers, as <th>
+// cells. The other cells are <td> cells with the values as in GetCellDisplay, and formula cells
+// have the formula as the title, so that it shows when hovering over the cell.
+func (sheet *SpreadSheet) WriteHTML(w io.Writer) error {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    sheet.refreshAllCells()
+    numRows, numCols := sheet.dimensions()
+    
+    var b strings.Builder
+    b.WriteString("<table>\n<tr><th></th>")
+    for col := 0; col < numCols; col++ {
+        b.WriteString("<th>" + GetColumnName(col) + "</th>")
+    }
+    b.WriteString("</tr>\n")
+    for row := 0; row < numRows; row++ {
+        b.WriteString("<tr><th>" + strconv.Itoa(row+1) + "</th>")
+        for col := 0; col < numCols; col++ {
+            cell := sheet.getCell(row, col)
+            if cell.formula != nil {
+                b.WriteString("<td title=\"" + html.EscapeString(*cell.formula) + "\">")
+            } else {
+                b.WriteString("<td>")
+            }
+            b.WriteString(html.EscapeString(cell.getFormattedDisplay()) + "</td>")
+        }
+        b.WriteString("</tr>\n")
+    }
+    b.WriteString("</table>\n")
+    
+    _, err := io.WriteString(w, b.String())
+    return err
+}
+
+// Function that creates a sheet from CSV read from r. Each record is a row of the sheet and each
+// field is a number, a formula starting with =, text or empty for a cell that is not set. The
+// number of columns of the sheet is the length of the longest record.
+func LoadCSV(r io.Reader) (*SpreadSheet, error) {
+    reader := csv.NewReader(r)
+    reader.FieldsPerRecord = -1
+    records, err := reader.ReadAll()
+    if err != nil {
+        return nil, err
+    }
+    
+    numCols := 0
+    for _, record := range records {
+        if len(record) > numCols {
+            numCols = len(record)
+        }
+    }
+    if len(records) == 0 || numCols == 0 {
+        return nil, fmt.Errorf("%w: no cells", ErrInvalidCSV)
+    }
+    
+    sheet, err := CreateSpreadSheet(len(records), numCols)
+    if err != nil {
+        return nil, err
+    }
+    values := make(map[string]string)
+    for row, record := range records {
+        for col, field := range record {
+            field = strings.TrimSpace(field)
+            if len(field) == 0 {
+                continue
+            }
+            cellId := getCellId(row, col)
+            values[cellId] = field
+        }
+    }
+    
+    if err := sheet.loadCellValues(values); err != nil {
+        return nil, err
+    }
+    return sheet, nil
+}
+
+// Function that returns the JSON encoding of the sheet. It has the dimensions of the sheet, the
+// number or formula of each cell that is set and the names of the sheet. Dependents are not
+// encoded, they are rebuilt from the formulas by UnmarshalJSON.
+func (sheet *SpreadSheet) MarshalJSON() ([]byte, error) {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    sheetJSON := &SpreadSheetJSON{Cells: make(map[string]*CellJSON)}
+    sheetJSON.Rows, sheetJSON.Cols = sheet.dimensions()
+    if len(sheet.names) > 0 {
+        sheetJSON.Names = sheet.names
+    }
+    sheet.forEachCell(func(row, col int, cell *Cell) {
+        if cell.isUnused() {
+            return
+        }
+        cellJSON := &CellJSON{Comment: cell.comment, Locked: cell.locked, Format: cell.format}
+        if cell.formula != nil {
+            cellJSON.Formula = cell.formula
+        } else if cell.text != nil {
+            cellJSON.Text = cell.text
+        } else {
+            cellJSON.Value = cell.value
+        }
+        sheetJSON.Cells[getCellId(row, col)] = cellJSON
+    })
+    return json.Marshal(sheetJSON)
+}
+
+// Function that replaces the sheet with the sheet encoded in data by MarshalJSON. The dependents
+// are rebuilt and the formula cells recomputed, as in Restore. The undo history is cleared. Returns
+// ErrInvalidJSON if data is not a sheet, or the error of an invalid cell, in which case the sheet
+// is unchanged.
+func (sheet *SpreadSheet) UnmarshalJSON(data []byte) error {
+    sheetJSON := new(SpreadSheetJSON)
+    if err := json.Unmarshal(data, sheetJSON); err != nil {
+        return fmt.Errorf("%w: %w", ErrInvalidJSON, err)
+    }
+    
+    snapshot := &sheetSnapshot{Rows: sheetJSON.Rows, Cols: sheetJSON.Cols, Names: sheetJSON.Names}
+    cellIds := make([]string, 0, len(sheetJSON.Cells))
+    for cellId := range sheetJSON.Cells {
+        cellIds = append(cellIds, cellId)
+    }
+    sort.Strings(cellIds)
+    for _, cellId := range cellIds {
+        row, col, err := getCellRowCol(cellId)
+        if err != nil {
+            return fmt.Errorf("%w: %w", ErrInvalidJSON, err)
+        }
+        cell := sheetJSON.Cells[cellId]
+        snapshot.Cells = append(snapshot.Cells, cellSnapshot{Row: row, Col: col, Value: cell.Value,
+            Formula: cell.Formula, Text: cell.Text, Comment: cell.Comment, Locked: cell.Locked,
+            Format: cell.Format})
+    }
+    
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    return sheet.restoreSnapshot(snapshot, ErrInvalidJSON)
+}
+
+// Function that returns a snapshot of the contents and comments of the cells and the names of the
+// sheet, which can be restored with Restore, for checkpoints. It is smaller and faster to encode
+// and restore than JSON.
+func (sheet *SpreadSheet) Snapshot() []byte {
+    sheet.getMutex().RLock()
+    defer sheet.getMutex().RUnlock()
+    
+    snapshot := &sheetSnapshot{Cells: make([]cellSnapshot, 0), Names: sheet.names}
+    snapshot.Rows, snapshot.Cols = sheet.dimensions()
+    sheet.forEachCell(func(row, col int, cell *Cell) {
+        if cell.isUnused() {
+            return
+        }
+        cellSnapshot := cellSnapshot{Row: row, Col: col, Comment: cell.comment, Locked: cell.locked}
+        cellSnapshot.Format = cell.format
+        if cell.formula != nil {
+            cellSnapshot.Formula = cell.formula
+        } else if cell.text != nil {
+            cellSnapshot.Text = cell.text
+        } else {
+            cellSnapshot.Value = cell.value
+        }
+        snapshot.Cells = append(snapshot.Cells, cellSnapshot)
+    })
+    
+    var buf bytes.Buffer
+    // Encoding to a buffer doesn't fail for these types.
+    gob.NewEncoder(&buf).Encode(snapshot)
+    return buf.Bytes()
+}
+
+// Function that replaces the cells and names of the sheet with the snapshot in data, returned by
+// Snapshot. The dependents are rebuilt and the formula cells recomputed. The undo history is
+// cleared. Returns ErrInvalidSnapshot if data is not a snapshot, or the error of an invalid cell,
+// in which case the sheet is unchanged.
+func (sheet *SpreadSheet) Restore(data []byte) error {
+    snapshot := new(sheetSnapshot)
+    if err := gob.NewDecoder(bytes.NewReader(data)).Decode(snapshot); err != nil {
+        return fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+    }
+    
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    return sheet.restoreSnapshot(snapshot, ErrInvalidSnapshot)
+}
+
+// Function to replace the cells and names of the sheet with those of the snapshot, for Restore
+// and UnmarshalJSON. errInvalid wraps the errors of a snapshot that is not valid, other than
+// the errors of invalid formulas.
+func (sheet *SpreadSheet) restoreSnapshot(snapshot *sheetSnapshot, errInvalid error) error {
+    sheet.setDefaults()
+    if err := sheet.checkDimensions(snapshot.Rows, snapshot.Cols); err != nil {
+        return fmt.Errorf("%w: %w", errInvalid, err)
+    }
+    
+    // The cells are restored to a new sheet with the name and workbook of the sheet, so that the
+    // sheet is unchanged if a cell is invalid.
+    restored := &SpreadSheet{workbook: sheet.workbook, name: sheet.name, names: make(map[string]string),
+        maxNumCols: sheet.maxNumCols}
+    restored.maxIterations, restored.tolerance = sheet.maxIterations, sheet.tolerance
+    if _, ok := sheet.cells.(*sparseCells); ok {
+        restored.cells = newSparseCells(snapshot.Rows, snapshot.Cols)
+    } else {
+        restored.cells = newDenseCells(snapshot.Rows, snapshot.Cols)
+    }
+    for name, ref := range snapshot.Names {
+        if !isValidName(name) {
+            return fmt.Errorf("%w: %w: %s", errInvalid, ErrInvalidName, name)
+        }
+        restored.names[strings.ToUpper(name)] = ref
+    }
+    
+    formulas := make(map[string]Expr)
+    for _, cellSnapshot := range snapshot.Cells {
+        if cellSnapshot.Row < 0 || cellSnapshot.Row >= snapshot.Rows || cellSnapshot.Col < 0 || cellSnapshot.Col >= snapshot.Cols {
+            return fmt.Errorf("%w: %w: row %d, column %d", errInvalid, ErrIndexOutOfBounds, cellSnapshot.Row, cellSnapshot.Col)
+        }
+        cell := restored.touchCell(cellSnapshot.Row, cellSnapshot.Col)
+        cell.comment = cellSnapshot.Comment
+        cell.locked = cellSnapshot.Locked
+        if cellSnapshot.Format != nil {
+            if _, err := parseNumberFormat(*cellSnapshot.Format); err != nil {
+                return fmt.Errorf("%w: %w", errInvalid, err)
+            }
+            cell.format = cellSnapshot.Format
+        }
+        switch {
+        case cellSnapshot.Formula != nil:
+            cellId := getCellId(cellSnapshot.Row, cellSnapshot.Col)
+            formula, expr, err := restored.validateCellValue(cellId, *cellSnapshot.Formula)
+            if err != nil {
+                return err
+            }
+            if expr == nil {
+                return fmt.Errorf("%w: %w: %s", errInvalid, ErrInvalidFormula, formula)
+            }
+            cell.formula = &formula
+            formulas[cellId] = expr
+        case cellSnapshot.Text != nil:
+            cell.text = cellSnapshot.Text
+        case cellSnapshot.Value != nil:
+            cell.value = cellSnapshot.Value
+        }
+    }
+    if err := restored.checkCycles(formulas); err != nil {
+        return err
+    }
+    
+    // Values of the cells before restoring, to notify the subscribers of the cells whose values
+    // change. Cells outside the restored dimensions are removed and not notified.
+    before := make(map[string]CellValue)
+    if len(sheet.subscribers) > 0 {
+        for _, s := range []*SpreadSheet{sheet, restored} {
+            s.forEachCell(func(row, col int, cell *Cell) {
+                if !cell.isEmpty() && row < snapshot.Rows && col < snapshot.Cols {
+                    before[getCellId(row, col)] = CellValue{}
+                }
+            })
+        }
+        sheet.refreshAllCells()
+        for cellId := range before {
+            row, col, _ := getCellRowCol(cellId)
+            if numRows, numCols := sheet.dimensions(); row < numRows && col < numCols {
+                before[cellId] = sheet.getCell(row, col).getCellValue()
+            }
+        }
+    }
+    
+    sheet.cells = restored.cells
+    sheet.names = restored.names
+    sheet.clearHistory()
+    sheet.rebuildDependents()
+    
+    if len(sheet.subscribers) > 0 {
+        sheet.refreshAllCells()
+    }
+    for cellId, value := range before {
+        row, col, _ := getCellRowCol(cellId)
+        if sheet.getCell(row, col).getCellValue() == value {
+            // The formula cell was recomputed from not set to its old value.
+            delete(sheet.changedValues, cellId)
+        } else {
+            sheet.notifyChange(cellId, value)
+        }
+    }
+    return nil
+}
+
+// Function to set the settings of a new sheet, as in new(SpreadSheet), to the defaults of
+// CreateSpreadSheet before its first cells are set. A sheet with cells is unchanged.
+func (sheet *SpreadSheet) setDefaults() {
+    if sheet.cells != nil {
+        return
+    }
+    sheet.undoLimit = defaultUndoLimit
+    sheet.maxFormulaDepth = defaultMaxFormulaDepth
+    sheet.maxNumCols = defaultMaxNumCols
+}
+
+// Function to set the cells to the given values, which are keyed by cell ID. Numbers are set first
+// and formulas after, so that a formula may refer to any of the cells.
+func (sheet *SpreadSheet) loadCellValues(values map[string]string) error {
+    formulaCellIds := make([]string, 0)
+    for cellId, value := range values {
+        if strings.HasPrefix(value, "=") {
+            formulaCellIds = append(formulaCellIds, cellId)
+            continue
+        }
+        if err := sheet.setCellValue(cellId, value); err != nil {
+            return err
+        }
+    }
+    
+    for _, cellId := range formulaCellIds {
+        if err := sheet.setCellValue(cellId, values[cellId]); err != nil {
+            return err
+        }
+    }
+    
+    // A formula may refer to a formula cell that was set after it, so recompute the formula
+    // cells in dependency order.
+    formulaCells := make(map[string]bool)
+    for _, cellId := range formulaCellIds {
+        formulaCells[cellId] = true
+    }
+    sheet.recomputeCells(formulaCells)
+    return nil
+}
+
+// Returns row, col numbers and nil if cell ID is valid and within the bounds of the sheet.
+// Else returns -1, -1, and error.
+func (sheet *SpreadSheet) getCellRowColInBounds(cellId string) (int, int, error) {
+    row, col, err := getCellRowCol(cellId)
+    if err != nil {
+        return -1, -1, err
+    }
+ 
+    numRows, numCols := sheet.dimensions()
+    if row >= numRows {
+        return -1, -1, &CellIdError{CellId: cellId, Err: ErrRowOutOfBounds, NumRows: numRows,
+            NumCols: numCols}
+    }
+    
+    if col >= numCols {
+        return -1, -1, &CellIdError{CellId: cellId, Err: ErrColumnOutOfBounds, NumRows: numRows,
+            NumCols: numCols}
+    }
+    
+    return row, col, nil
+}
+
+// Returns row, col numbers and nil if cell ID is valid. Else returns -1, -1, and error.
+//
+// Cell ID is valid if leading characters (column) are alphabets and rest of the characters (row)
+// are a string representation of an integer >= 1. Column alphabets are case insensitive, so a1 is
+// A1. A cell ID that doesn't start with an alphabet, such as @1, is invalid.
+func getCellRowCol(cellId string) (int, int, error) {
+    // Column is a base 26 number whose digits are A..Z. There is no zero digit, so A..Z are
+    // 1..26, AA is 27 and so on.
+    // Columns after the max number of columns of a sheet are out of its bounds, so the column is
+    // only limited so that it doesn't overflow.
+    i := 0
+    col := 0
+    for i < len(cellId) && col <= math.MaxInt32 {
+        c := cellId[i]
+        if c >= 'a' && c <= 'z' {
+            c -= 'a' - 'A'
+        }
+        if c < 'A' || c > 'Z' {
+            break
+        }
+        col = col*26 + int(c-'A') + 1
+        i++
+    }
+    if i == 0 || col > math.MaxInt32 {
+        return -1, -1, &CellIdError{CellId: cellId, Err: ErrInvalidColumn}
+    }
+    row, err := strconv.Atoi(cellId[i:])
+    if err != nil || row < 1 || !strings.ContainsAny(cellId[i:i+1], "0123456789") {
+        return -1, -1, &CellIdError{CellId: cellId, Err: ErrInvalidRow}
+    }
+    
+    return row-1, col-1, nil
+}
+
+// Function that returns the name of the zero based column index. It is the inverse of the
+// column parsing in getCellRowCol. For example, 0 is A, 25 is Z, 26 is AA and 702 is AAA.
+// Returns an empty string if col is negative.
+func GetColumnName(col int) string {
+    name := ""
+    for col >= 0 {
+        name = string(rune('A'+col%26)) + name
+        col = col/26 - 1
+    }
+    return name
+}
+
+// Function to parse a number such as 10, -2.5, 1e3 or 2.5e-1. Underscores may separate digits, so
+// 1_000 is 1000. Returns error if s is not a finite number.
+func parseNumber(s string) (float64, error) {
+    if strings.Contains(s, "_") {
+        for i := 0; i < len(s); i++ {
+            if s[i] == '_' && (i == 0 || i == len(s)-1 || !isDigit(s[i-1]) || !isDigit(s[i+1])) {
+                return 0, errors.New("Invalid digit separator in number: " + s)
+            }
+        }
+        s = strings.ReplaceAll(s, "_", "")
+    }
+    val, err := strconv.ParseFloat(s, 64)
+    if err != nil {
+        return 0, err
+    }
+    if math.IsInf(val, 0) || math.IsNaN(val) {
+        return 0, errors.New("Number is not finite: " + s)
+    }
+    return val, nil
+}
+
+// Function to parse a number of a formula, which may be a percent such as 10%, which is 0.1.
+func parseFormulaNumber(s string) (float64, error) {
+    if strings.HasSuffix(s, "%") {
+        val, err := parseNumber(s[:len(s)-1])
+        return val / 100, err
+    }
+    return parseNumber(s)
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+// Function that returns true if the operand is the mantissa of a number in scientific notation
+// followed by e, such as 2.5e, so that the + or - after it is the sign of the exponent.
+func isExponentPrefix(operand string) bool {
+    if len(operand) < 2 || (operand[len(operand)-1] != 'e' && operand[len(operand)-1] != 'E') {
+        return false
+    }
+    mantissa := operand[:len(operand)-1]
+    if strings.ContainsAny(mantissa, "eE") || !isDigit(mantissa[len(mantissa)-1]) && mantissa[len(mantissa)-1] != '.' {
+        return false
+    }
+    _, err := parseNumber(mantissa)
+    return err == nil
+}
+
+// Number format of a cell, parsed from a format such as #,##0.00.
+type numberFormat struct {
+    // Min number of digits before the decimal point, which is the number of 0 digits.
+    minDigits int
+    // Number of digits after the decimal point.
+    decimals int
+    // True if the digits before the decimal point are grouped in thousands with commas.
+    thousands bool
+    // True if the number is displayed times 100 with a %.
+    percent bool
+}
+
+// Function to parse a number format for SetCellFormat. For example, #,##0.00 has a thousands
+// separator, at least 1 digit before the decimal point and 2 after it. Returns ErrInvalidArgument
+// if the format is invalid.
+func parseNumberFormat(format string) (*numberFormat, error) {
+    numberFormat := new(numberFormat)
+    pattern := format
+    if strings.HasSuffix(pattern, "%") {
+        numberFormat.percent = true
+        pattern = strings.TrimSuffix(pattern, "%")
+    }
+    integer, decimals, hasPoint := strings.Cut(pattern, ".")
+    noDigits := strings.Trim(integer, ",") == "" && len(decimals) == 0
+    if noDigits || strings.Trim(integer, "#0,") != "" || strings.Trim(decimals, "0") != "" ||
+        (hasPoint && len(decimals) == 0) {
+        return nil, fmt.Errorf("%w: invalid number format %s", ErrInvalidArgument, format)
+    }
+    numberFormat.minDigits = strings.Count(integer, "0")
+    numberFormat.decimals = len(decimals)
+    numberFormat.thousands = strings.Contains(integer, ",")
+    return numberFormat, nil
+}
+
+// Function to format a value with the number format. For example, 1234.5 is "1,234.50" with
+// #,##0.00.
+func (numberFormat *numberFormat) format(value float64) string {
+    if numberFormat.percent {
+        value *= 100
+    }
+    // Halves are rounded away from zero, as by ROUND.
+    rounded, _ := roundValue([]float64{math.Abs(value), float64(numberFormat.decimals)})
+    digits := strconv.FormatFloat(rounded, 'f', numberFormat.decimals, 64)
+    integer, decimals, _ := strings.Cut(digits, ".")
+    negative := value < 0 && strings.Trim(digits, "0.") != ""
+    
+    if integer == "0" && numberFormat.minDigits == 0 {
+        integer = ""
+    }
+    if len(integer) < numberFormat.minDigits {
+        integer = strings.Repeat("0", numberFormat.minDigits-len(integer)) + integer
+    }
+    if numberFormat.thousands {
+        for i := len(integer)-3; i > 0; i -= 3 {
+            integer = integer[:i] + "," + integer[i:]
+        }
+    }
+    
+    formatted := integer
+    if numberFormat.decimals > 0 {
+        formatted += "." + decimals
+    }
+    if negative {
+        formatted = "-" + formatted
+    }
+    if numberFormat.percent {
+        formatted += "%"
+    }
+    return formatted
+}
+
+// Function to format a value for display. Whole values are formatted as integers.
+// For example, 10 is "10" and 2.5 is "2.5".
+func formatValue(value float64) string {
+    return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Function that returns the cell ID of the zero based row and col. For example, 0, 0 is A1.
+func getCellId(row, col int) string {
+    return GetColumnName(col) + strconv.Itoa(row+1)
+}
+
+// Function to sort cell IDs in row major order. For example, A1, B1, A2. Cell IDs qualified with
+// the name of another sheet, as in Sheet2!A1, come after the others, by sheet name.
+func sortCellIds(cellIds []string) {
+    sort.Slice(cellIds, func(i, j int) bool {
+        name1, cellId1 := splitSheetRef(cellIds[i])
+        name2, cellId2 := splitSheetRef(cellIds[j])
+        if name1 != name2 {
+            return name1 < name2
+        }
+        row1, col1, _ := getCellRowCol(cellId1)
+        row2, col2, _ := getCellRowCol(cellId2)
+        if row1 != row2 {
+            return row1 < row2
+        }
+        return col1 < col2
+    })
+}
+
+// Function to parse a cell ID of a formula. A $ before the column or the row makes it absolute,
+// as in $A$1, $A1 and A$1.
+func parseCellRef(ref string) (*CellId, error) {
+    id := new(CellId)
+    if strings.HasPrefix(ref, "$") {
+        id.absCol = true
+        ref = ref[1:]
+    }
+    
+    // The row is absolute if $ follows the column alphabets.
+    if i := strings.Index(ref, "$"); i > 0 {
+        if strings.Trim(ref[:i], "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz") != "" {
+            return nil, &CellIdError{CellId: ref, Err: ErrInvalidColumn}
+        }
+        id.absRow = true
+        ref = ref[:i] + ref[i+1:]
+    }
+    
+    var err error
+    id.row, id.col, err = getCellRowCol(ref)
+    if err != nil {
+        return nil, err
+    }
+    return id, nil
+}
+
+// Function to format a cell ID of a formula, with a $ before the absolute column and row. The
+// corner of a range of whole columns has no row, and the corner of a range of whole rows has no
+// column.
+func formatCellRef(id *CellId) string {
+    cellId := ""
+    if !id.wholeRow {
+        if id.absCol {
+            cellId += "$"
+        }
+        cellId += GetColumnName(id.col)
+    }
+    if id.wholeColumn {
+        return cellId
+    }
+    if id.absRow {
+        cellId += "$"
+    }
+    return cellId + strconv.Itoa(id.row+1)
+}
+
+// Function to parse the cell IDs of a cell ID or range of a formula, such as A1 or A1:B2. The
+// corners of a range of whole columns or rows, such as A:C or 1:3, are parsed as the cell IDs of
+// their first rows or columns, see CellId. A single column or row, such as A or 1, is not a cell
+// ID.
+func parseRangeCorners(ref string) ([]*CellId, error) {
+    corners := splitRange(ref)
+    if len(corners) > 2 {
+        return nil, &FormulaError{Reason: "Invalid range in formula: " + ref}
+    }
+    isWhole := func(chars string) bool {
+        for _, corner := range corners {
+            corner = strings.TrimPrefix(corner, "$")
+            if len(corner) == 0 || strings.Trim(corner, chars) != "" {
+                return false
+            }
+        }
+        return len(corners) == 2
+    }
+    wholeColumns := isWhole("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
+    wholeRows := isWhole("0123456789")
+    
+    ids := make([]*CellId, len(corners))
+    for i, corner := range corners {
+        if wholeColumns {
+            corner += "1"
+        } else if wholeRows {
+            // A $ before the row is kept, as in A$3 for $3.
+            corner = "A" + corner
+        }
+        id, err := parseCellRef(corner)
+        if err != nil {
+            return nil, err
+        }
+        id.wholeColumn, id.wholeRow = wholeColumns, wholeRows
+        ids[i] = id
+    }
+    return ids, nil
+}
+
+// Function to parse a cell ID or range of a formula, such as A1 or A1:B2, or a range of whole
+// columns or rows, such as A:C or 1:3. The cell ID or range may be qualified with the name of a
+// sheet, as in Sheet2!A1:B2, and $ are ignored. Returns an error if rangeStr is not a valid cell
+// ID or a range of two valid cell IDs, columns or rows, such as 5:A3, whose corner is a number.
+func parseRange(rangeStr string) (*CellRange, error) {
+    name, rangeStr := splitSheetRef(rangeStr)
+    corners, err := parseRangeCorners(rangeStr)
+    if err != nil {
+        if !strings.Contains(rangeStr, ":") {
+            return nil, err
+        }
+        // A number such as 5 in 5:A3 would otherwise be reported as an invalid column. The minus
+        // of a negative number, as in A1:-1, is an operator, which leaves the range A1: without a
+        // corner.
+        for _, corner := range splitRange(rangeStr) {
+            if len(corner) == 0 {
+                return nil, &FormulaError{Reason: "Missing cell ID in range in formula: " + rangeStr}
+            }
+            if _, numErr := parseFormulaNumber(corner); numErr == nil {
+                reason := fmt.Sprintf("Number %s is not a cell ID in range %s in formula", corner, rangeStr)
+                return nil, &FormulaError{Reason: reason}
+            }
+        }
+        return nil, err
+    }
+    
+    // Both corners of a cell ID are the cell.
+    topLeft, bottomRight := corners[0], corners[len(corners)-1]
+    return &CellRange{
+        sheet: name,
+        row1: topLeft.row,
+        col1: topLeft.col,
+        row2: bottomRight.row,
+        col2: bottomRight.col,
+        wholeColumns: topLeft.wholeColumn,
+        wholeRows: topLeft.wholeRow,
+    }, nil
+}
+
+// Function that returns the first and last rows and columns of the range in refSheet, the sheet
+// of the range. The corners may be in any order, as in A5:A1 or B1:A3. A range of whole columns
+// has all the rows of the sheet, and a range of whole rows has all the columns. Such ranges are
+// clamped to the sheet, so that columns or rows outside it have no cells. refSheet is only used
+// for such ranges, and may be nil otherwise.
+func (cellRange *CellRange) getBounds(refSheet *SpreadSheet) (top, left, bottom, right int) {
+    top, bottom = min(cellRange.row1, cellRange.row2), max(cellRange.row1, cellRange.row2)
+    left, right = min(cellRange.col1, cellRange.col2), max(cellRange.col1, cellRange.col2)
+    if cellRange.wholeColumns {
+        numRows, numCols := refSheet.dimensions()
+        top, bottom = 0, numRows-1
+        right = min(right, numCols-1)
+    }
+    if cellRange.wholeRows {
+        numRows, numCols := refSheet.dimensions()
+        left, right = 0, numCols-1
+        bottom = min(bottom, numRows-1)
+    }
+    return top, left, bottom, right
+}
+
+// Function that returns true if the range has the cell at row, col of refSheet, the sheet of the
+// range.
+func (cellRange *CellRange) contains(refSheet *SpreadSheet, row, col int) bool {
+    top, left, bottom, right := cellRange.getBounds(refSheet)
+    return row >= top && row <= bottom && col >= left && col <= right
+}
+
+// Function that returns true if the range is a single cell ID, such as A1 or A1:A1.
+func (cellRange *CellRange) isCell() bool {
+    return !cellRange.wholeColumns && !cellRange.wholeRows && cellRange.row1 == cellRange.row2 &&
+        cellRange.col1 == cellRange.col2
+}
+
+// Function that returns the range without its sheet name and with its corners in order, so that
+// the same range written differently, as A1:B2 or B2:A1, has the same key in rangeDependents.
+func (cellRange *CellRange) getKey() CellRange {
+    return CellRange{
+        row1: min(cellRange.row1, cellRange.row2),
+        col1: min(cellRange.col1, cellRange.col2),
+        row2: max(cellRange.row1, cellRange.row2),
+        col2: max(cellRange.col1, cellRange.col2),
+        wholeColumns: cellRange.wholeColumns,
+        wholeRows: cellRange.wholeRows,
+    }
+}
+
+// Function that returns true if s may be the name of a cell ID or range. A name starts with an
+// alphabet or underscore, is followed by alphabets, digits and underscores, and is not a cell ID.
+func isValidName(s string) bool {
+    if len(s) == 0 || strings.ContainsRune("0123456789", rune(s[0])) {
+        return false
+    }
+    if strings.Trim(s, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789_") != "" {
+        return false
+    }
+    
+    // A cell ID is made of alphabets followed by digits.
+    letters := strings.TrimRight(s, "0123456789")
+    return len(letters) == len(s) || strings.Trim(letters, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz") != ""
+}
+
+// Function to split a cell ID or range of a formula into the name of its sheet and the cell ID or
+// range. For example, Sheet2!A1:B2 gives Sheet2 and A1:B2. The name is empty if there is none.
+func splitSheetRef(ref string) (string, string) {
+    if i := strings.Index(ref, "!"); i > 0 && !strings.HasPrefix(ref, "#") {
+        return strings.TrimSpace(ref[:i]), strings.TrimSpace(ref[i+1:])
+    }
+    return "", ref
+}
+
+// Function to qualify a cell ID or range with the name of a sheet. It is the inverse of
+// splitSheetRef. #REF! and refs without a name are returned as is.
+func qualifyRef(name, ref string) string {
+    if len(name) == 0 || ref == ErrRef.Error() {
+        return ref
+    }
+    return name + "!" + ref
+}
+
+// Function to split a range into its cell IDs, with surrounding whitespace removed.
+// For example, if rangeStr is "A1 : B2", then A1 and B2 are returned.
+func splitRange(rangeStr string) []string {
+    cellIds := strings.Split(rangeStr, ":")
+    for i := range cellIds {
+        cellIds[i] = strings.TrimSpace(cellIds[i])
+    }
+    return cellIds
+}
+
+// Function to split a formula into tokens. Each operator, parenthesis and comma is a token of its
+// own and the text between them is an operand token. The comparison operators <=, >= and <> are
+// single tokens, and so is text in double quotes. The sign of the exponent of a number such as
+// 2.5e-1 is part of the number. Whitespace around tokens is ignored. For
+// example, if formula is =(A1*2)+B1:B2, then the tokens are (, A1, *, 2, ), + and B1:B2.
+func tokenizeFormula(formula string) []*Token {
+    tokens := make([]*Token, 0)
+    
+    // Skip the leading = and any whitespace around it.
+    start := strings.Index(formula, "=") + 1
+    for i := start; i <= len(formula); i++ {
+        if i < len(formula) && !strings.ContainsRune("+-*/(),<>=&\"", rune(formula[i])) {
+            continue
+        }
+        if i < len(formula) && (formula[i] == '+' || formula[i] == '-') && isExponentPrefix(strings.TrimSpace(formula[start:i])) {
+            // Sign of the exponent of a number such as 2.5e-1.
+            continue
+        }
+
+        operand := strings.TrimSpace(formula[start:i])
+        if len(operand) > 0 {
+            pos := start + strings.Index(formula[start:i], operand)
+            tokens = append(tokens, &Token{text: operand, pos: pos})
+        }
+        if i < len(formula) && formula[i] == '"' {
+            end, closed := scanText(formula, i)
+            tokens = append(tokens, &Token{text: formula[i:end], isText: closed, pos: i})
+            i = end-1
+        } else if i < len(formula) {
+            op := formula[i:i+1]
+            if i+1 < len(formula) && (op == "<" && strings.ContainsRune("=>", rune(formula[i+1])) || op == ">" && formula[i+1] == '=') {
+                op = formula[i:i+2]
+            }
+            tokens = append(tokens, &Token{text: op, isOperator: true, pos: i})
+            i += len(op)-1
+        }
+        start = i+1
+    }
+    return tokens
+}
+
+// Function to scan text in double quotes that starts at the index start of the formula. Two double
+// quotes in the text are an escaped double quote. Returns the index after the closing double
+// quote, and false if there is none, in which case the index is the length of the formula.
+func scanText(formula string, start int) (int, bool) {
+    for i := start+1; i < len(formula); i++ {
+        if formula[i] != '"' {
+            continue
+        }
+        if i+1 < len(formula) && formula[i+1] == '"' {
+            i++
+            continue
+        }
+        return i+1, true
+    }
+    return len(formula), false
+}
+
+// Function to rewrite the cell IDs and ranges in a formula. fn is called with the text of each
+// cell ID or range and returns the text to replace it with. The rest of the formula is unchanged.
+func rewriteFormula(formula string, fn func(ref string) string) string {
+    tokens := tokenizeFormula(formula)
+    rewritten := ""
+    end := 0
+    for i, token := range tokens {
+        if token.isOperator || token.isText {
+            continue
+        }
+        if _, err := parseFormulaNumber(token.text); err == nil {
+            continue
+        }
+        if i+1 < len(tokens) && tokens[i+1].text == "(" {
+            // Function name.
+            continue
+        }
+        
+        rewritten += formula[end:token.pos] + fn(token.text)
+        end = token.pos + len(token.text)
+    }
+    return rewritten + formula[end:]
+}
+
+// Function to map each cell ID of a cell ID or range. fn updates the zero based row and col of
+// each cell ID, whose $ are kept. For example, mapping A1:$B2 with row+1 gives A2:$B3. The row of
+// a corner of whole columns and the column of a corner of whole rows are not written, as in
+// mapping A:B with row+1, which gives A:B.
+func mapCellIds(ref string, fn func(id *CellId)) string {
+    ids, err := parseRangeCorners(ref)
+    if err != nil {
+        return ref
+    }
+    cellIds := make([]string, len(ids))
+    for i, id := range ids {
+        fn(id)
+        cellIds[i] = formatCellRef(id)
+    }
+    return strings.Join(cellIds, ":")
+}
+
+// Function to check that the operands of a formula only have the characters of numbers, cell IDs,
+// ranges, names and sheet names, so that an unsupported operator such as ^ in =A1^2 is an error
+// instead of part of an operand. Returns a FormulaError with the one based position of the first
+// unknown character in the formula. #REF! is the cell ID of a deleted cell.
+func checkOperandChars(tokens []*Token) error {
+    for _, token := range tokens {
+        if token.isOperator || strings.HasPrefix(token.text, "\"") || token.text == ErrRef.Error() {
+            continue
+        }
+        // Numbers may have the sign of an exponent and a trailing %, as in 2.5e-1 and 10%.
+        if _, err := parseFormulaNumber(token.text); err == nil {
+            continue
+        }
+        for i := 0; i < len(token.text); i++ {
+            c := token.text[i]
+            isLetter := (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+            if isDigit(c) || isLetter || strings.IndexByte(" \t\r\n.$!:_", c) >= 0 {
+                continue
+            }
+            r, _ := utf8.DecodeRuneInString(token.text[i:])
+            reason := fmt.Sprintf("Unknown operator %c at position %d in formula", r, token.pos+i+1)
+            return &FormulaError{Reason: reason}
+        }
+    }
+    return nil
+}
+
+// Function to parse a formula into an expression tree. Returns an error if the formula is
+// malformed.
+func (sheet *SpreadSheet) parseFormula(formula string) (Expr, error) {
+    tokens := tokenizeFormula(formula)
+    if err := checkOperandChars(tokens); err != nil {
+        return nil, err
+    }
+    parser := &FormulaParser{tokens: tokens, names: sheet.names}
+    expr, err := parser.parseCompare()
+    if err != nil {
+        return nil, err
+    }
+    
+    if parser.pos < len(parser.tokens) {
+        errMsg := "Unexpected token in formula: " + parser.tokens[parser.pos].text
+        if parser.tokens[parser.pos].text == ")" {
+            errMsg = "Unbalanced parentheses in formula"
+        }
+        return nil, &FormulaError{Reason: errMsg}
+    }
+    return expr, nil
+}
+
+// Returns the next token if it is one of the given operators and advances past it.
+// Else returns nil.
+func (parser *FormulaParser) acceptOperator(ops ...string) *Token {
+    if parser.pos >= len(parser.tokens) {
+        return nil
+    }
+    
+    token := parser.tokens[parser.pos]
+    if !token.isOperator {
+        return nil
+    }
+    for _, op := range ops {
+        if token.text == op {
+            parser.pos++
+            return token
+        }
+    }
+    return nil
+}
+
+// Operators that compare two values. A comparison is 1 if it is true and 0 if it is false.
+var compareOperators = []string{"=", "<>", "<", ">", "<=", ">="}
+
+func (parser *FormulaParser) parseCompare() (Expr, error) {
+    left, err := parser.parseConcat()
+    if err != nil {
+        return nil, err
+    }
+    
+    for token := parser.acceptOperator(compareOperators...); token != nil; token = parser.acceptOperator(compareOperators...) {
+        right, err := parser.parseConcat()
+        if err != nil {
+            return nil, err
+        }
+        left = &BinaryExpr{op: token.text, left: left, right: right}
+    }
+    return left, nil
+}
+
+func (parser *FormulaParser) parseConcat() (Expr, error) {
+    left, err := parser.parseSum()
+    if err != nil {
+        return nil, err
+    }
+    
+    for token := parser.acceptOperator("&"); token != nil; token = parser.acceptOperator("&") {
+        right, err := parser.parseSum()
+        if err != nil {
+            return nil, err
+        }
+        left = &BinaryExpr{op: token.text, left: left, right: right}
+    }
+    return left, nil
+}
+
+func (parser *FormulaParser) parseSum() (Expr, error) {
+    left, err := parser.parseProduct()
+    if err != nil {
+        return nil, err
+    }
+    
+    for token := parser.acceptOperator("+", "-"); token != nil; token = parser.acceptOperator("+", "-") {
+        right, err := parser.parseProduct()
+        if err != nil {
+            return nil, err
+        }
+        left = &BinaryExpr{op: token.text, left: left, right: right}
+    }
+    return left, nil
+}
+
+func (parser *FormulaParser) parseProduct() (Expr, error) {
+    left, err := parser.parseUnary()
+    if err != nil {
+        return nil, err
+    }
+    
+    for token := parser.acceptOperator("*", "/"); token != nil; token = parser.acceptOperator("*", "/") {
+        right, err := parser.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        left = &BinaryExpr{op: token.text, left: left, right: right}
+    }
+    return left, nil
+}
+
+func (parser *FormulaParser) parseUnary() (Expr, error) {
+    if parser.acceptOperator("-") == nil {
+        return parser.parseOperand()
+    }
+    
+    operand, err := parser.parseUnary()
+    if err != nil {
+        return nil, err
+    }
+    return &NegateExpr{operand: operand}, nil
+}
+
+func (parser *FormulaParser) parseOperand() (Expr, error) {
+    if parser.pos >= len(parser.tokens) || (parser.tokens[parser.pos].isOperator && parser.tokens[parser.pos].text != "(") {
+        return nil, parser.getMissingOperandError()
+    }
+    
+    if parser.acceptOperator("(") != nil {
+        expr, err := parser.parseCompare()
+        if err != nil {
+            return nil, err
+        }
+        if parser.acceptOperator(")") == nil {
+            return nil, &FormulaError{Reason: "Unbalanced parentheses in formula"}
+        }
+        return expr, nil
+    }
+    
+    token := parser.tokens[parser.pos]
+    parser.pos++
+    if token.isText {
+        text := token.text[1:len(token.text)-1]
+        return &TextExpr{text: strings.ReplaceAll(text, "\"\"", "\"")}, nil
+    }
+    if strings.HasPrefix(token.text, "\"") {
+        return nil, &FormulaError{Reason: "Missing closing double quote in formula"}
+    }
+    if parser.acceptOperator("(") != nil {
+        return parser.parseFunction(token.text)
+    }
+    if token.text == ErrRef.Error() {
+        return &ErrorExpr{err: ErrRef}, nil
+    }
+    rangeStr := token.text
+    if isValidName(rangeStr) {
+        var ok bool
+        if rangeStr, ok = parser.names[strings.ToUpper(rangeStr)]; !ok {
+            // The formula is valid, as the name may be defined later.
+            return &ErrorExpr{err: ErrName}, nil
+        }
+    }
+    if val, err := parseFormulaNumber(rangeStr); err == nil {
+        return &OperandExpr{val: &val}, nil
+    }
+    cellRange, err := parseRange(rangeStr)
+    if err != nil {
+        return nil, err
+    }
+    return &OperandExpr{cellRange: cellRange}, nil
+}
+
+// Returns the error of an operand missing at the current token. It is a dangling operator if the
+// token before is an operator, as in =A1+ and =A1++B2, or if the token is an operator where an
+// operand starts, as in =+A1.
+func (parser *FormulaParser) getMissingOperandError() error {
+    var prev, next *Token
+    if parser.pos > 0 {
+        prev = parser.tokens[parser.pos-1]
+    }
+    if parser.pos < len(parser.tokens) {
+        next = parser.tokens[parser.pos]
+    }
+    
+    switch {
+    case isBinaryOperator(prev) && next == nil:
+        return &FormulaError{Reason: "Dangling operator " + prev.text + " at the end of formula", Err: ErrDanglingOperator}
+    case isBinaryOperator(prev):
+        return &FormulaError{Reason: "Dangling operator " + prev.text + " before " + next.text + " in formula", Err: ErrDanglingOperator}
+    case isBinaryOperator(next) && prev == nil:
+        return &FormulaError{Reason: "Dangling operator " + next.text + " at the start of formula", Err: ErrDanglingOperator}
+    case isBinaryOperator(next):
+        return &FormulaError{Reason: "Dangling operator " + next.text + " after " + prev.text + " in formula", Err: ErrDanglingOperator}
+    }
+    return &FormulaError{Reason: "Missing operand in formula"}
+}
+
+// Returns true if the token is an operator other than a parenthesis or comma, such as + or <=.
+func isBinaryOperator(token *Token) bool {
+    return token != nil && token.isOperator && !strings.Contains("(),", token.text)
+}
+
+// Parses the comma separated arguments of the function name up to the closing parenthesis. The
+// name is case insensitive.
+func (parser *FormulaParser) parseFunction(givenName string) (Expr, error) {
+    name := strings.ToUpper(givenName)
+    _, isScalar := scalarFunctions[name]
+    _, isText := textFunctions[name]
+    _, isConditional := conditionalFunctions[name]
+    if _, ok := formulaFunctions[name]; !ok && !isScalar && !isText && !isConditional && name != "IF" {
+        return nil, &FormulaError{Reason: "Unknown function in formula: " + givenName}
+    }
+    
+    expr := &FunctionExpr{name: name}
+    for {
+        arg, err := parser.parseCompare()
+        if err != nil {
+            return nil, err
+        }
+        expr.args = append(expr.args, arg)
+        
+        if parser.acceptOperator(")") != nil {
+            if name == "IF" {
+                return newIfExpr(expr.args)
+            }
+            if isScalar {
+                return expr, checkNumArgs(name, len(expr.args))
+            }
+            if isConditional {
+                return expr, checkConditionalArgs(name, expr.args)
+            }
+            return expr, nil
+        }
+        if parser.acceptOperator(",") == nil {
+            return nil, &FormulaError{Reason: "Unbalanced parentheses in formula"}
+        }
+    }
+}
+
+// Returns an error if the scalar function name doesn't take numArgs arguments.
+func checkNumArgs(name string, numArgs int) error {
+    function := scalarFunctions[name]
+    if numArgs >= function.minArgs && numArgs <= function.maxArgs {
+        return nil
+    }
+    
+    errMsg := name + " takes " + strconv.Itoa(function.minArgs)
+    if function.maxArgs > function.minArgs {
+        errMsg += " to " + strconv.Itoa(function.maxArgs)
+    }
+    errMsg += " arguments in formula"
+    return &FormulaError{Reason: errMsg}
+}
+
+// Returns an error if the arguments of the conditional function name are not a range, or cell ID,
+// and a criterion.
+func checkConditionalArgs(name string, args []Expr) error {
+    if len(args) == 2 {
+        if operand, ok := args[0].(*OperandExpr); ok && operand.cellRange != nil {
+            return nil
+        }
+    }
+    return &FormulaError{Reason: name + " takes a range and a criterion in formula"}
+}
+
+// Returns the IF expression of the arguments of IF, which are the condition, the value if the
+// condition is not 0 and optionally the value if it is 0. The value if it is 0 defaults to 0.
+func newIfExpr(args []Expr) (Expr, error) {
+    if len(args) < 2 || len(args) > 3 {
+        return nil, &FormulaError{Reason: "IF takes 2 or 3 arguments in formula"}
+    }
+    
+    expr := &IfExpr{cond: args[0], then: args[1], otherwise: &OperandExpr{val: new(float64)}}
+    if len(args) == 3 {
+        expr.otherwise = args[2]
+    }
+    return expr, nil
+}
+
+func (expr *OperandExpr) eval(sheet *SpreadSheet) (*Value, error) {
+    if expr.val != nil {
+        return &Value{number: *expr.val}, nil
+    }
+    
+    // A single cell has the value of its cell, which may be text.
+    refSheet := sheet.getRefSheet(expr.cellRange.sheet)
+    top, left, bottom, right := expr.cellRange.getBounds(refSheet)
+    if top == bottom && left == right {
+        return refSheet.getRefValue(top, left)
+    }
+    
+    value := 0.0
+    err := sheet.forEachValue(expr.cellRange, func(cellValue *Value) error {
+        number, err := getNumber(cellValue)
+        value += number
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    return &Value{number: value}, nil
+}
+
+// Function to call fn with the value of each cell of the range, as in getRefValue, in row major
+// order. Returns the first error of the cells or of fn, if any.
+func (sheet *SpreadSheet) forEachValue(cellRange *CellRange, fn func(value *Value) error) error {
+    refSheet := sheet.getRefSheet(cellRange.sheet)
+    top, left, bottom, right := cellRange.getBounds(refSheet)
+    for row := top; row <= bottom; row++ {
+        for col := left; col <= right; col++ {
+            value, err := refSheet.getRefValue(row, col)
+            if err != nil {
+                return err
+            }
+            if err := fn(value); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// Returns the value of the cell at row, col for a formula that refers to it. The value is nil if
+// the cell is not set. If the cell has an error, the error is returned so that it propagates to
+// the formula being computed.
+func (sheet *SpreadSheet) getRefValue(row, col int) (*Value, error) {
+    if len(sheet.staleCells) > 0 {
+        sheet.computeIfStale(getCellId(row, col))
+    }
+    cell := sheet.getCell(row, col)
+    if cell.err != nil {
+        return nil, cell.err
+    }
+    if cell.text != nil {
+        return &Value{text: cell.text}, nil
+    }
+    if cell.value == nil && sheet.defaultValue != nil {
+        return &Value{number: *sheet.defaultValue}, nil
+    }
+    if cell.value == nil {
+        return nil, nil
+    }
+    return &Value{number: *cell.value}, nil
+}
+
+func (expr *OperandExpr) getRanges() []*CellRange {
+    if expr.cellRange == nil {
+        return make([]*CellRange, 0)
+    }
+    return []*CellRange{expr.cellRange}
+}
+
+func (expr *ErrorExpr) eval(sheet *SpreadSheet) (*Value, error) {
+    return nil, expr.err
+}
+
+func (expr *ErrorExpr) getRanges() []*CellRange {
+    return make([]*CellRange, 0)
+}
+
+func (expr *TextExpr) eval(sheet *SpreadSheet) (*Value, error) {
+    text := expr.text
+    return &Value{text: &text}, nil
+}
+
+func (expr *TextExpr) getRanges() []*CellRange {
+    return make([]*CellRange, 0)
+}
+
+func (expr *BinaryExpr) eval(sheet *SpreadSheet) (*Value, error) {
+    leftValue, err := expr.left.eval(sheet)
+    if err != nil {
+        return nil, err
+    }
+    rightValue, err := expr.right.eval(sheet)
+    if err != nil {
+        return nil, err
+    }
+    
+    switch expr.op {
+    case "&":
+        text := getText(leftValue) + getText(rightValue)
+        return &Value{text: &text}, nil
+    case "=", "<>", "<", ">", "<=", ">=":
+        return &Value{number: boolValue(compareValues(expr.op, leftValue, rightValue))}, nil
+    }
+    
+    left, err := getNumber(leftValue)
+    if err != nil {
+        return nil, err
+    }
+    right, err := getNumber(rightValue)
+    if err != nil {
+        return nil, err
+    }
+    
+    value := 0.0
+    switch expr.op {
+    case "+":
+        value = left + right
+    case "-":
+        value = left - right
+    case "*":
+        value = left * right
+    default:
+        if right == 0 {
+            return nil, ErrDivByZero
+        }
+        value = left / right
+    }
+    return &Value{number: value}, nil
+}
+
+// Returns the result of comparing the values with the comparison operator op. If either value is
+// text, the values are compared as text, ignoring case. Else they are compared as numbers.
+func compareValues(op string, left, right *Value) bool {
+    cmp := 0
+    if (left != nil && left.text != nil) || (right != nil && right.text != nil) {
+        cmp = strings.Compare(strings.ToUpper(getText(left)), strings.ToUpper(getText(right)))
+    } else if numberOrZero(left) < numberOrZero(right) {
+        cmp = -1
+    } else if numberOrZero(left) > numberOrZero(right) {
+        cmp = 1
+    }
+    
+    switch op {
+    case "=":
+        return cmp == 0
+    case "<>":
+        return cmp != 0
+    case "<":
+        return cmp < 0
+    case ">":
+        return cmp > 0
+    case "<=":
+        return cmp <= 0
+    default:
+        return cmp >= 0
+    }
+}
+
+// Returns the criterion of a conditional function given by value. Text is a comparison operator
+// followed by a number or text, as in ">5" or "<>done", where the operator defaults to =. A number
+// is a criterion of being equal to it.
+func parseCriterion(value *Value) *Criterion {
+    if value == nil || value.text == nil {
+        return &Criterion{op: "=", value: value}
+    }
+    
+    // The longest operator that the text starts with, so that <= is not taken for <.
+    op := ""
+    for _, prefix := range compareOperators {
+        if strings.HasPrefix(*value.text, prefix) && len(prefix) > len(op) {
+            op = prefix
+        }
+    }
+    operand := strings.TrimPrefix(*value.text, op)
+    if len(op) == 0 {
+        op = "="
+    }
+    if number, err := parseNumber(strings.TrimSpace(operand)); err == nil {
+        return &Criterion{op: op, value: &Value{number: number}}
+    }
+    return &Criterion{op: op, value: &Value{text: &operand}}
+}
+
+// Returns true if the value meets the criterion. A cell that is not set is 0 when compared with a
+// number, so it meets "=0", and empty text when compared with text, so it meets "=". Text only
+// meets a criterion of a number with <>, as text is never equal to a number.
+func (criterion *Criterion) matches(value *Value) bool {
+    isNumber := criterion.value != nil && criterion.value.text == nil
+    if isNumber && value != nil && value.text != nil {
+        return criterion.op == "<>"
+    }
+    return compareValues(criterion.op, value, criterion.value)
+}
+
+// Returns the sum of the values that meet the criterion.
+func sumIfValues(values []*Value, criterion *Criterion) float64 {
+    sum := 0.0
+    for _, value := range values {
+        if criterion.matches(value) {
+            sum += numberOrZero(value)
+        }
+    }
+    return sum
+}
+
+// Returns the number of values that meet the criterion.
+func countIfValues(values []*Value, criterion *Criterion) float64 {
+    count := 0.0
+    for _, value := range values {
+        if criterion.matches(value) {
+            count++
+        }
+    }
+    return count
+}
+
+// Returns 1 if b is true, else 0.
+func boolValue(b bool) float64 {
+    if b {
+        return 1
+    }
+    return 0
+}
+
+func (expr *IfExpr) eval(sheet *SpreadSheet) (*Value, error) {
+    cond, err := evalNumber(expr.cond, sheet)
+    if err != nil {
+        return nil, err
+    }
+    if cond != 0 {
+        return expr.then.eval(sheet)
+    }
+    return expr.otherwise.eval(sheet)
+}
+
+func (expr *IfExpr) getRanges() []*CellRange {
+    ranges := expr.cond.getRanges()
+    ranges = append(ranges, expr.then.getRanges()...)
+    return append(ranges, expr.otherwise.getRanges()...)
+}
+
+func (expr *NegateExpr) eval(sheet *SpreadSheet) (*Value, error) {
+    value, err := evalNumber(expr.operand, sheet)
+    if err != nil {
+        return nil, err
+    }
+    return &Value{number: -value}, nil
+}
+
+func (expr *NegateExpr) getRanges() []*CellRange {
+    return expr.operand.getRanges()
+}
+
+func (expr *BinaryExpr) getRanges() []*CellRange {
+    return append(expr.left.getRanges(), expr.right.getRanges()...)
+}
+
+// Returns the values of the arguments. Ranges are expanded to the values of their cells. Returns
+// the first error of the arguments, in order, if any.
+func (expr *FunctionExpr) getArgValues(sheet *SpreadSheet) ([]*Value, error) {
+    values := make([]*Value, 0)
+    for _, arg := range expr.args {
+        operand, ok := arg.(*OperandExpr)
+        if !ok || operand.cellRange == nil {
+            value, err := arg.eval(sheet)
+            if err != nil {
+                return nil, err
+            }
+            values = append(values, value)
+            continue
+        }
+        err := sheet.forEachValue(operand.cellRange, func(value *Value) error {
+            values = append(values, value)
+            return nil
+        })
+        if err != nil {
+            return nil, err
+        }
+    }
+    return values, nil
+}
+
+func (expr *FunctionExpr) eval(sheet *SpreadSheet) (*Value, error) {
+    if function, ok := scalarFunctions[expr.name]; ok {
+        args := make([]float64, len(expr.args))
+        for i, arg := range expr.args {
+            value, err := evalNumber(arg, sheet)
+            if err != nil {
+                return nil, err
+            }
+            args[i] = value
+        }
+        value, err := function.fn(args)
+        if err != nil {
+            return nil, err
+        }
+        return &Value{number: value}, nil
+    }
+    
+    if function, ok := conditionalFunctions[expr.name]; ok {
+        criterion, err := expr.args[1].eval(sheet)
+        if err != nil {
+            return nil, err
+        }
+        values, err := (&FunctionExpr{args: expr.args[:1]}).getArgValues(sheet)
+        if err != nil {
+            return nil, err
+        }
+        return &Value{number: function(values, parseCriterion(criterion))}, nil
+    }
+    
+    values, err := expr.getArgValues(sheet)
+    if err != nil {
+        return nil, err
+    }
+    if function, ok := textFunctions[expr.name]; ok {
+        text := function(values)
+        return &Value{text: &text}, nil
+    }
+    return &Value{number: formulaFunctions[expr.name](values)}, nil
+}
+
+// Returns the value of the expression as a number. Returns ErrValue if the value is text.
+func evalNumber(expr Expr, sheet *SpreadSheet) (float64, error) {
+    value, err := expr.eval(sheet)
+    if err != nil {
+        return 0, err
+    }
+    return getNumber(value)
 }
 
-type SpreadSheet struct {
-    // Spreadsheet is a matrix of cells.
-    cells [][]*Cell
+func (expr *FunctionExpr) getRanges() []*CellRange {
+    ranges := make([]*CellRange, 0)
+    for _, arg := range expr.args {
+        ranges = append(ranges, arg.getRanges()...)
+    }
+    return ranges
 }
 
-type CellId struct {
-    row, col int
-    sign string
-    val *int
+// Returns the sum of the values.
+func sumValues(values []*Value) float64 {
+    sum := 0.0
+    for _, value := range values {
+        sum += numberOrZero(value)
+    }
+    return sum
 }
 
-func CreateSpreadSheet(numRows, numCols int) *SpreadSheet {
-    sheet := new(SpreadSheet)
-    sheet.cells = make([][]*Cell, numRows)
-    if numCols > 26 {
-        // Set max cols to 26.
-        numCols = 26
+// Returns the product of the values. A value that is not set is 0, so the product is 0.
+func productValues(values []*Value) float64 {
+    product := 1.0
+    for _, value := range values {
+        product *= numberOrZero(value)
     }
+    return product
+}
 
-    for i := 0; i < numRows; i++ {
-        sheet.cells[i] = make([]*Cell, numCols)
-        for j := 0; j < numCols; j++ {
-            sheet.cells[i][j] = new(Cell)
-            sheet.cells[i][j].dependentCells = make(map[string]interface{})
-            value := 0
-            sheet.cells[i][j].value = &value
+// Returns the arithmetic mean of the values.
+func averageValues(values []*Value) float64 {
+    return sumValues(values) / float64(len(values))
+}
+
+// Returns the smallest of the values.
+func minValue(values []*Value) float64 {
+    min := numberOrZero(values[0])
+    for _, value := range values[1:] {
+        min = math.Min(min, numberOrZero(value))
+    }
+    return min
+}
+
+// Returns the largest of the values.
+func maxValue(values []*Value) float64 {
+    max := numberOrZero(values[0])
+    for _, value := range values[1:] {
+        max = math.Max(max, numberOrZero(value))
+    }
+    return max
+}
+
+// Returns the number of values that are numbers.
+func countValues(values []*Value) float64 {
+    count := 0
+    for _, value := range values {
+        if value != nil && value.text == nil {
+            count++
         }
     }
-    
-    return sheet
+    return float64(count)
 }
 
-func (sheet *SpreadSheet) SetCellValue(cellId string, value string) error {
-    row, col, err := getCellRowCol(cellId)
-    if err != nil {
-        return err
+// Returns the number of values that are set, including text.
+func countNonEmptyValues(values []*Value) float64 {
+    count := 0
+    for _, value := range values {
+        if value != nil {
+            count++
+        }
     }
-    
-    if len(strings.TrimSpace(value)) == 0 {
-        value = "0"
+    return float64(count)
+}
+
+// Returns the values joined as text.
+func concatenateValues(values []*Value) string {
+    text := ""
+    for _, value := range values {
+        text += getText(value)
     }
-    
-    // Remove dependees.
-    if sheet.cells[row][col].formula != nil {
-        sheet.deleteDependees(cellId, *sheet.cells[row][col].formula)
+    return text
+}
+
+// Returns the absolute value of the argument.
+func absValue(args []float64) (float64, error) {
+    return math.Abs(args[0]), nil
+}
+
+// Returns the remainder of dividing the first argument by the second. The remainder has the sign
+// of the divisor, so MOD(-7,3) is 2 and MOD(7,-3) is -2. Returns ErrDivByZero if the divisor is 0.
+func modValue(args []float64) (float64, error) {
+    if args[1] == 0 {
+        return 0, ErrDivByZero
     }
+    return args[0] - args[1]*math.Floor(args[0]/args[1]), nil
+}
 
-    valueInt, err := strconv.Atoi(value)
-    if err == nil {
-        sheet.cells[row][col].value = &valueInt
-        // If value is an integer, unset the formula.
-        sheet.cells[row][col].formula = nil
-    } else {
-        sheet.cells[row][col].formula = &value
-        sheet.computeCellValue(cellId)
+// Returns the first argument raised to the power of the second. Returns ErrDivByZero if 0 is
+// raised to a negative power, and ErrNum if the power is not a finite number.
+func powerValue(args []float64) (float64, error) {
+    if args[0] == 0 && args[1] < 0 {
+        return 0, ErrDivByZero
     }
     
-    // Add dependees.
-    if sheet.cells[row][col].formula != nil {
-        sheet.addDependees(cellId, *sheet.cells[row][col].formula)
+    value := math.Pow(args[0], args[1])
+    if math.IsInf(value, 0) || math.IsNaN(value) {
+        return 0, ErrNum
+    }
+    return value, nil
+}
+
+// Returns the first argument rounded to the number of decimal places given by the second, which
+// defaults to 0. Halves are rounded away from zero, so ROUND(2.345,2) is 2.35 and ROUND(-2.5) is
+// -3. A negative number of decimal places rounds to tens, hundreds and so on.
+func roundValue(args []float64) (float64, error) {
+    places := 0.0
+    if len(args) == 2 {
+        places = math.Trunc(args[1])
     }
     
-    // Recompute dependents value. This is because the cells whose value depends
-    // on this cell will have a stale value.
-    for cid := range sheet.cells[row][col].dependentCells {
-        sheet.computeCellValue(cid)
+    scale := math.Pow(10, math.Abs(places))
+    scaled := args[0] * scale
+    if places < 0 {
+        scaled = args[0] / scale
+    }
+    // Round the scaled value to 15 significant digits first, so that 2.345*100, which is
+    // 234.49999999999997, is rounded as 234.5.
+    scaled, _ = strconv.ParseFloat(strconv.FormatFloat(scaled, 'g', 15, 64), 64)
+    if places < 0 {
+        return math.Round(scaled) * scale, nil
+    }
+    return math.Round(scaled) / scale, nil
+}
+
+// Returns the argument rounded down to an integer, so FLOOR(-2.5) is -3.
+func floorValue(args []float64) (float64, error) {
+    return math.Floor(args[0]), nil
+}
+
+// Returns the argument rounded up to an integer, so CEIL(2.1) is 3.
+func ceilValue(args []float64) (float64, error) {
+    return math.Ceil(args[0]), nil
+}
+
+// Returns the value, or 0 if value is not set.
+func valueOrZero(value *float64) float64 {
+    if value == nil {
+        return 0
+    }
+    return *value
+}
+
+// Returns the number of the value, or 0 if value is not set or is text.
+func numberOrZero(value *Value) float64 {
+    if value == nil || value.text != nil {
+        return 0
+    }
+    return value.number
+}
+
+// Returns ErrNum if the value is a number that is not finite, such as a sum that overflows the
+// largest float64, so that it is not shown as infinity.
+func checkFinite(value *Value) error {
+    if value != nil && value.text == nil && (math.IsInf(value.number, 0) || math.IsNaN(value.number)) {
+        return ErrNum
     }
     return nil
 }
 
-// Function that returns the value of the cell.
-func (sheet *SpreadSheet) GetCellValue(cellId string) (int, error) {
-    row, col, err := getCellRowCol(cellId)
+// Returns the number of the value, or 0 if value is not set. Returns ErrValue if value is text.
+func getNumber(value *Value) (float64, error) {
+    if value != nil && value.text != nil {
+        return 0, ErrValue
+    }
+    return numberOrZero(value), nil
+}
+
+// Returns the value as text. A number is formatted as in formatValue and a value that is not set
+// is empty.
+func getText(value *Value) string {
+    if value == nil {
+        return ""
+    }
+    if value.text != nil {
+        return *value.text
+    }
+    return formatValue(value.number)
+}
+
+// Returns true if the cell is not set.
+func (cell *Cell) isEmpty() bool {
+    return cell.value == nil && cell.formula == nil && cell.text == nil
+}
+
+// Returns true if the cell is not set and has no comment, lock or format, so that it need not be
+// copied or saved.
+func (cell *Cell) isUnused() bool {
+    return cell.isEmpty() && cell.comment == nil && !cell.locked && cell.format == nil
+}
+
+// Returns the contents of the cell as accepted by SetCellValue, which is its formula, text or
+// number, or nil if the cell is not set.
+func (cell *Cell) getContent() *string {
+    if cell.formula != nil {
+        content := *cell.formula
+        return &content
+    }
+    if cell.text != nil {
+        content := *cell.text
+        return &content
+    }
+    if cell.value != nil {
+        content := formatValue(*cell.value)
+        return &content
+    }
+    return nil
+}
+
+// Returns the value of the cell with its kind, as in GetCell.
+func (cell *Cell) getCellValue() CellValue {
+    switch {
+    case cell.err != nil:
+        return CellValue{Kind: KindError, Data: cell.err}
+    case cell.text != nil:
+        return CellValue{Kind: KindText, Data: *cell.text}
+    case cell.isEmpty():
+        return CellValue{Kind: KindEmpty}
+    default:
+        return CellValue{Kind: KindNumber, Data: cell.getValue()}
+    }
+}
+
+// Returns the value of the cell as it is displayed, as in GetCellDisplay.
+func (cell *Cell) getDisplay() string {
+    if cell.err != nil {
+        return cell.err.Error()
+    }
+    if cell.text != nil {
+        return *cell.text
+    }
+    if cell.isEmpty() {
+        return ""
+    }
+    return formatValue(cell.getValue())
+}
+
+// Returns the value of the cell as it is displayed, as getDisplay, with its number formatted by
+// the format of the cell if it has one.
+func (cell *Cell) getFormattedDisplay() string {
+    if cell.format == nil || cell.err != nil || cell.text != nil || cell.isEmpty() {
+        return cell.getDisplay()
+    }
+    // The format was checked when it was set.
+    format, _ := parseNumberFormat(*cell.format)
+    return format.format(cell.getValue())
+}
+
+// Returns the value of the cell, or 0 if the cell is not set.
+func (cell *Cell) getValue() float64 {
+    return valueOrZero(cell.value)
+}
+
+// Function that returns the cell IDs that the formula refers to, in the order they first appear,
+// for analyzing formulas without a sheet. Ranges are expanded to their cells, and cell IDs of other
+// sheets are qualified with the sheet name, as in Sheet2!A1. Returns an error if the formula is
+// malformed, or ErrName if it has a name, as names are defined by sheets.
+func ExtractReferences(formula string) ([]string, error) {
+    expr, err := new(SpreadSheet).parseFormula(formula)
     if err != nil {
-        return 0, err
+        return nil, err
     }
- 
-    if row >= len(sheet.cells) {
-        errMsg := "Row number out of bounds in cellId"
-        fmt.Println(errMsg)
-        return 0, errors.New(errMsg)
+    tokens := tokenizeFormula(formula)
+    for i, token := range tokens {
+        isFunction := i+1 < len(tokens) && tokens[i+1].isOperator && tokens[i+1].text == "("
+        if !token.isOperator && !token.isText && !isFunction && isValidName(token.text) {
+            return nil, ErrName
+        }
     }
-    
-    if col >= len(sheet.cells[0]) {
-        errMsg := "Column value out of bounds in cellId"
-        fmt.Println(errMsg)
-        return 0, errors.New(errMsg)
+    refs := make([]string, 0)
+    seen := make(map[string]bool)
+    for _, cellRange := range expr.getRanges() {
+        // Whole columns or rows have as many cells as the sheet.
+        if cellRange.wholeColumns || cellRange.wholeRows {
+            reason := "Range of whole columns or rows has no cells without a sheet in formula"
+            return nil, &FormulaError{Reason: reason}
+        }
+        top, left, bottom, right := cellRange.getBounds(nil)
+        for row := top; row <= bottom; row++ {
+            for col := left; col <= right; col++ {
+                ref := qualifyRef(cellRange.sheet, getCellId(row, col))
+                if !seen[ref] {
+                    seen[ref] = true
+                    refs = append(refs, ref)
+                }
+            }
+        }
     }
+    return refs, nil
+}
 
-    return *sheet.cells[row][col].value, nil
+// Function to delete cellId from the dependents map of each cell ID in the formula of the cell.
+func (sheet *SpreadSheet) deleteDependees(cellId string, cell *Cell) {
+    // The formula of a cell is validated when it is set.
+    expr, err := sheet.getCellExpr(cell)
+    if err != nil {
+        return
+    }
+    for _, cellRange := range expr.getRanges() {
+        refSheet := sheet.getRefSheet(cellRange.sheet)
+        dependentId := sheet.getDependentId(refSheet, cellId)
+        if cellRange.isCell() {
+            delete(refSheet.getCell(cellRange.row1, cellRange.col1).dependentCells, dependentId)
+            continue
+        }
+        key := cellRange.getKey()
+        delete(refSheet.rangeDependents[key], dependentId)
+        if len(refSheet.rangeDependents[key]) == 0 {
+            delete(refSheet.rangeDependents, key)
+        }
+    }
 }
 
-// Returns row, col numbers and nil if cell ID is valid. Else returns -1, -1, and error.
-//
-// Cell ID is valid if first character (column) is a capital alphabet and rest of the characters (row) are a string
-// representation of an integer.
-func getCellRowCol(cellId string) (int, int, error) {
-    col := int(cellId[0]-'A')
-    if col < 0 || col >= 26 {
-        errMsg := "Invalid col number in cellId"
-        fmt.Println(errMsg)
-        return -1, -1, errors.New(errMsg) 
+// Function to add cellId to the dependents map of each cell ID in the parsed formula expr, and to
+// the range dependents of each range of more than one cell.
+func (sheet *SpreadSheet) addDependees(cellId string, expr Expr) {
+    for _, cellRange := range expr.getRanges() {
+        refSheet := sheet.getRefSheet(cellRange.sheet)
+        dependentId := sheet.getDependentId(refSheet, cellId)
+        if cellRange.isCell() {
+            refSheet.touchCell(cellRange.row1, cellRange.col1).dependentCells[dependentId] = true
+            continue
+        }
+        key := cellRange.getKey()
+        if refSheet.rangeDependents == nil {
+            refSheet.rangeDependents = make(map[CellRange]map[string]bool)
+        }
+        if refSheet.rangeDependents[key] == nil {
+            refSheet.rangeDependents[key] = make(map[string]bool)
+        }
+        refSheet.rangeDependents[key][dependentId] = true
+    }
+}
+
+// Function to call fn with each cell whose formula refers to the cell at row, col, by its cell ID
+// or by a range, as in Cell.dependentCells. A cell that refers to the cell more than once, as in
+// =A1+SUM(A1:A3), may be passed more than once.
+func (sheet *SpreadSheet) forEachDependent(row, col int, fn func(cid string)) {
+    for cid := range sheet.getCell(row, col).dependentCells {
+        fn(cid)
+    }
+    for cellRange, dependents := range sheet.rangeDependents {
+        if cellRange.contains(sheet, row, col) {
+            for cid := range dependents {
+                fn(cid)
+            }
+        }
+    }
+}
+
+// Function that returns the key of cellId of the sheet in the dependents map of a cell of
+// refSheet. It is the cell ID, qualified with the name of the sheet if refSheet is another sheet.
+func (sheet *SpreadSheet) getDependentId(refSheet *SpreadSheet, cellId string) string {
+    if refSheet == sheet {
+        return cellId
+    }
+    return qualifyRef(sheet.name, cellId)
+}
+
+// Function that returns the sheet of the workbook with the given name, or the sheet itself if
+// name is empty. Returns nil if there is no such sheet.
+func (sheet *SpreadSheet) getRefSheet(name string) *SpreadSheet {
+    if len(name) == 0 {
+        return sheet
+    }
+    if sheet.workbook == nil {
+        return nil
+    }
+    return sheet.workbook.sheets[name]
+}
+
+// Function that returns the sheets of the workbook of the sheet by name, or only the sheet if it
+// is not in a workbook.
+func (sheet *SpreadSheet) getSheets() []*SpreadSheet {
+    if sheet.workbook == nil {
+        return []*SpreadSheet{sheet}
+    }
+    sheets := make([]*SpreadSheet, 0, len(sheet.workbook.sheets))
+    for _, workbookSheet := range sheet.workbook.sheets {
+        sheets = append(sheets, workbookSheet)
     }
-    row, err := strconv.Atoi(cellId[1:])
+    sortSheets(sheets)
+    return sheets
+}
+
+// Function to sort sheets by name, so that they are processed in the same order every time.
+func sortSheets(sheets []*SpreadSheet) {
+    sort.Slice(sheets, func(i, j int) bool {
+        return sheets[i].name < sheets[j].name
+    })
+}
+
+// Function that returns the sheets of affectedCellIds by name with their cell IDs in row major
+// order, so that the cells are recomputed in the same order every time.
+func sortAffectedCells(affectedCellIds map[*SpreadSheet]map[string]bool) ([]*SpreadSheet, map[*SpreadSheet][]string) {
+    sheets := make([]*SpreadSheet, 0, len(affectedCellIds))
+    sortedCellIds := make(map[*SpreadSheet][]string)
+    for sheet, cellIds := range affectedCellIds {
+        sheets = append(sheets, sheet)
+        for cellId := range cellIds {
+            sortedCellIds[sheet] = append(sortedCellIds[sheet], cellId)
+        }
+        sortCellIds(sortedCellIds[sheet])
+    }
+    sortSheets(sheets)
+    return sheets, sortedCellIds
+}
+
+// Function that returns the mutex guarding the computation of stale cells of the sheet.
+func (sheet *SpreadSheet) getEvalMutex() *sync.Mutex {
+    if sheet.workbook != nil {
+        return &sheet.workbook.evalMutex
+    }
+    return &sheet.evalMutex
+}
+
+// Function that returns the mutex guarding the cells of the sheet.
+func (sheet *SpreadSheet) getMutex() *sync.RWMutex {
+    if sheet.workbook != nil {
+        return &sheet.workbook.mutex
+    }
+    return &sheet.mutex
+}
+
+// Function that returns the parsed formula of the cell, parsing the formula if it was not parsed
+// since names were defined or deleted or the formulas were rewritten.
+func (sheet *SpreadSheet) getCellExpr(cell *Cell) (Expr, error) {
+    if cell.expr == nil {
+        expr, err := sheet.parseFormula(*cell.formula)
+        if err != nil {
+            return nil, err
+        }
+        cell.expr = expr
+    }
+    return cell.expr, nil
+}
+
+// Function that returns the depth of a formula cell with the parsed formula expr, which is one
+// more than the largest depth of the formula cells it refers to. Stale cells it refers to are
+// computed first.
+func (sheet *SpreadSheet) getFormulaDepth(expr Expr) int {
+    depth := 0
+    for _, cellRange := range expr.getRanges() {
+        refSheet := sheet.getRefSheet(cellRange.sheet)
+        top, left, bottom, right := cellRange.getBounds(refSheet)
+        for row := top; row <= bottom; row++ {
+            for col := left; col <= right; col++ {
+                if len(refSheet.staleCells) > 0 {
+                    refSheet.computeIfStale(getCellId(row, col))
+                }
+                cell := refSheet.getCell(row, col)
+                if cell.formula != nil && cell.depth > depth {
+                    depth = cell.depth
+                }
+            }
+        }
+    }
+    return depth + 1
+}
+
+// Function that sets the max length of a chain of formula cells where each cell refers to the one
+// before it, which is 100000 by default. This guards against chains that are deeper than
+// intended, as a change to the first cell of a chain recomputes every cell of the chain. A formula
+// cell after the max depth of a chain has the error ErrDepth, and so do the cells after it.
+func (sheet *SpreadSheet) SetMaxFormulaDepth(depth int) error {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
+    
+    if depth <= 0 {
+        return fmt.Errorf("%w: max formula depth %d", ErrInvalidArgument, depth)
+    }
+    
+    sheet.maxFormulaDepth = depth
+    formulaCellIds := make([]string, 0)
+    sheet.forEachCell(func(row, col int, cell *Cell) {
+        if cell.formula != nil {
+            formulaCellIds = append(formulaCellIds, getCellId(row, col))
+        }
+    })
+    sheet.recomputeWithDependents(formulaCellIds)
+    return nil
+}
+
+// Function takes cell ID and compute the value from the formula.
+func (sheet *SpreadSheet) computeCellValue(cellId string) {
+    row, col, err := getCellRowCol(cellId)
     if err != nil {
-        errMsg := "Invalid row number in cellId"
-        fmt.Println(errMsg)
-        return -1, -1, errors.New(errMsg)
+        return
+    }
+    var value *Value
+    // A cell with a formula is always allocated, so it may be updated.
+    cell := sheet.getCell(row, col)
+    if cell.formula == nil {
+        return
+    }
+    
+    defer sheet.notifyChange(cellId, cell.getCellValue())
+    
+    expr, err := sheet.getCellExpr(cell)
+    if err == nil {
+        cell.depth = sheet.getFormulaDepth(expr)
+        if cell.depth > sheet.maxFormulaDepth {
+            err = ErrDepth
+        } else {
+            value, err = expr.eval(sheet)
+        }
+    }
+    if err == nil {
+        err = checkFinite(value)
     }
     
-    return row-1, col, nil
+    // Iterate over the formula and compute the val. A formula that refers to a cell that is not
+    // set is 0.
+    cell.err = err
+    if err == nil && value != nil && value.text != nil {
+        cell.value = nil
+        cell.text = value.text
+        return
+    }
+    number := numberOrZero(value)
+    cell.value = &number
+    cell.text = nil
 }
 
-// Function to get the cell IDs in a given range. 
-// For example, if rangeStr is A1:B2, then A1, A2, B1, B2 are returned.
-func getCellIdsFromRange(rangeStr, sign string) []*CellId {
-    cellIds := make([]*CellId, 0)
-    if !strings.Contains(rangeStr, ":") {
-        cellId := new(CellId)
-        cellId.sign = sign
+// Function to recompute the values of the updated cells and of their direct and indirect
+// dependents. This is because the cells whose value depends on an updated cell, or on another
+// dependent, will have a stale value. The union of the dependents of all the updated cells, on
+// this and the other sheets of the workbook, is recomputed at once, so that a cell that depends on
+// several of them is recomputed once. The number of formula cells recomputed is added to
+// numRecomputed.
+func (sheet *SpreadSheet) recomputeWithDependents(cellIds []string) {
+    affectedCellIds := make(map[*SpreadSheet]map[string]bool)
+    sheet.addDependents(cellIds, affectedCellIds)
+    sheet.numRecomputed += recomputeAffectedCells(affectedCellIds)
+}
+
+// Function to add the cells and their direct and indirect dependents to affectedCellIds, which
+// maps each sheet to the IDs of its affected cells.
+func (sheet *SpreadSheet) addDependents(cellIds []string, affectedCellIds map[*SpreadSheet]map[string]bool) {
+    if affectedCellIds[sheet] == nil {
+        affectedCellIds[sheet] = make(map[string]bool)
+    }
+    for len(cellIds) > 0 {
+        cellId := cellIds[len(cellIds)-1]
+        cellIds = cellIds[:len(cellIds)-1]
+        if affectedCellIds[sheet][cellId] {
+            continue
+        }
+        affectedCellIds[sheet][cellId] = true
         
-        val, err := strconv.Atoi(rangeStr)
-        if err == nil {
-            cellId.val = &val
-        } else {
-            cellId.row, cellId.col, _ = getCellRowCol(rangeStr)
+        row, col, _ := getCellRowCol(cellId)
+        sheet.forEachDependent(row, col, func(cid string) {
+            if name, dependentId := splitSheetRef(cid); len(name) > 0 {
+                sheet.getRefSheet(name).addDependents([]string{dependentId}, affectedCellIds)
+                return
+            }
+            cellIds = append(cellIds, cid)
+        })
+    }
+}
+
+// Function to recompute the values of the given cells in topological order. A cell is recomputed
+// after the given cells its formula refers to, so that each cell is recomputed once and from up to
+// date values. Cells that don't depend on each other are recomputed in row major order, so that the
+// order is the same every time. If the sheet is lazy, the cells are marked stale instead.
+func (sheet *SpreadSheet) recomputeCells(cellIds map[string]bool) {
+    recomputeAffectedCells(map[*SpreadSheet]map[string]bool{sheet: cellIds})
+}
+
+// Function to recompute the values of the cells of affectedCellIds, which maps sheets to cell IDs,
+// in topological order as in recomputeCells. A cell may refer to cells of other sheets of the
+// workbook, which are recomputed first. The cells of lazy sheets are marked stale instead.
+// Returns the number of formula cells recomputed or marked stale.
+func recomputeAffectedCells(affectedCellIds map[*SpreadSheet]map[string]bool) int {
+    numFormulaCells := 0
+    computed := make(map[*SpreadSheet]map[string]bool)
+    for sheet, cellIds := range affectedCellIds {
+        for cellId := range cellIds {
+            if row, col, err := getCellRowCol(cellId); err == nil && sheet.getCell(row, col).formula != nil {
+                numFormulaCells++
+            }
         }
-        cellIds = append(cellIds, cellId)
-    } else {
-        cells := strings.Split(rangeStr, ":")
-        topRow, leftCol, _ := getCellRowCol(cells[0])
-        bottomRow, rightCol, _ := getCellRowCol(cells[1])
-        for r := topRow; r <= bottomRow; r++ {
-            for c := leftCol; c <= rightCol; c++ {
-                cellId := &CellId{
-                    sign: sign,
-                    row: r,
-                    col: c,
-                }
-                cellIds = append(cellIds, cellId)
+        if sheet.lazy {
+            if sheet.staleCells == nil {
+                sheet.staleCells = make(map[string]bool)
             }
+            for cellId := range cellIds {
+                sheet.staleCells[cellId] = true
+            }
+            continue
         }
+        computed[sheet] = make(map[string]bool)
     }
     
-    return cellIds
+    maxIterations, tolerance := 0, 0.0
+    for sheet := range computed {
+        if sheet.maxIterations > maxIterations {
+            maxIterations, tolerance = sheet.maxIterations, sheet.tolerance
+        }
+    }
+    if maxIterations > 0 {
+        iterateAffectedCells(affectedCellIds, maxIterations, tolerance)
+        return numFormulaCells
+    }
+    
+    sheets, sortedCellIds := sortAffectedCells(affectedCellIds)
+    for _, sheet := range sheets {
+        if sheet.lazy {
+            continue
+        }
+        for _, cellId := range sortedCellIds[sheet] {
+            sheet.recomputeCellAfterPrecedents(cellId, affectedCellIds, computed)
+        }
+    }
+    return numFormulaCells
 }
 
-// Function to get all cell IDs in a formula.
-func getCellIdsFromFormula(formula string) []*CellId {
-    cellIds := make([]*CellId, 0)
+// Function to recompute the cells of affectedCellIds on sheets with iterative calculation, whose
+// formulas may refer to each other in a cycle. Each iteration recomputes the cells in topological
+// order, where a cell of a cycle is computed from the values of the last iteration, until no value
+// changes by more than tolerance, up to maxIterations times after the first. Then the cells whose
+// values still change have the error ErrNum, and their dependents are recomputed once more. The
+// cells of lazy sheets are skipped, as they are marked stale.
+func iterateAffectedCells(affectedCellIds map[*SpreadSheet]map[string]bool, maxIterations int, tolerance float64) {
+    sheets, sortedCellIds := sortAffectedCells(affectedCellIds)
+    changing := make(map[*SpreadSheet]map[string]bool)
+    for iteration := 0; iteration <= maxIterations; iteration++ {
+        before := make(map[*SpreadSheet]map[string]CellValue)
+        computed := make(map[*SpreadSheet]map[string]bool)
+        for sheet, cellIds := range affectedCellIds {
+            if sheet.lazy {
+                continue
+            }
+            before[sheet] = make(map[string]CellValue)
+            computed[sheet] = make(map[string]bool)
+            for cellId := range cellIds {
+                row, col, _ := getCellRowCol(cellId)
+                cell := sheet.getCell(row, col)
+                before[sheet][cellId] = cell.getCellValue()
+                // The depths of the cells of a cycle would grow by each iteration otherwise.
+                if cell.formula != nil {
+                    cell.depth = 0
+                }
+            }
+        }
+        
+        for _, sheet := range sheets {
+            if sheet.lazy {
+                continue
+            }
+            for _, cellId := range sortedCellIds[sheet] {
+                sheet.recomputeCellAfterPrecedents(cellId, affectedCellIds, computed)
+            }
+        }
+        
+        changing = make(map[*SpreadSheet]map[string]bool)
+        for sheet, values := range before {
+            for cellId, value := range values {
+                row, col, _ := getCellRowCol(cellId)
+                if !isWithinTolerance(value, sheet.getCell(row, col).getCellValue(), tolerance) {
+                    if changing[sheet] == nil {
+                        changing[sheet] = make(map[string]bool)
+                    }
+                    changing[sheet][cellId] = true
+                }
+            }
+        }
+        if len(changing) == 0 {
+            return
+        }
+    }
     
-    // Remove the leading =.
-    formula = formula[1:]
-    start := 0
-    sign := "+"
-    for i := 0; i < len(formula); i++ {
-        if formula[i] != '+' && formula[i] != '-' {
+    // The values didn't converge, so the cells that still change have the error ErrNum, which
+    // their dependents get when they are recomputed.
+    computed := make(map[*SpreadSheet]map[string]bool)
+    for sheet := range affectedCellIds {
+        if !sheet.lazy {
+            computed[sheet] = make(map[string]bool)
+        }
+    }
+    for sheet, cellIds := range changing {
+        for cellId := range cellIds {
+            row, col, _ := getCellRowCol(cellId)
+            cell := sheet.getCell(row, col)
+            before := cell.getCellValue()
+            cell.err = ErrNum
+            sheet.notifyChange(cellId, before)
+            computed[sheet][cellId] = true
+        }
+    }
+    for _, sheet := range sheets {
+        if sheet.lazy {
             continue
         }
+        for _, cellId := range sortedCellIds[sheet] {
+            sheet.recomputeCellAfterPrecedents(cellId, affectedCellIds, computed)
+        }
+    }
+}
 
-        cellIds = append(cellIds, getCellIdsFromRange(formula[start:i], sign)...)
-        sign = string(formula[i])
-        start = i+1
+// Function to check that a value of a cell changed by at most tolerance, for iterative calculation.
+// Values that are not numbers must be the same.
+func isWithinTolerance(before, after CellValue, tolerance float64) bool {
+    if before.Kind != KindNumber || after.Kind != KindNumber {
+        return before == after
     }
+    return math.Abs(after.Data.(float64)-before.Data.(float64)) <= tolerance
+}
+
+// Function that sets whether formula cells are computed lazily. If lazy is true, updating a cell
+// marks the cells that depend on it stale instead of recomputing them, and a stale cell is
+// computed once, when its value or the value of a cell that depends on it is read. This saves
+// recomputing cells that are updated often but read rarely. The values read are the same either
+// way. Setting lazy to false computes the stale cells.
+func (sheet *SpreadSheet) SetLazyEvaluation(lazy bool) {
+    sheet.getMutex().Lock()
+    defer sheet.unlockAndNotify()
     
-    cellIds = append(cellIds, getCellIdsFromRange(formula[start:], sign)...)
-    return cellIds
+    sheet.lazy = lazy
+    if !lazy {
+        for cellId := range sheet.staleCells {
+            sheet.computeIfStale(cellId)
+        }
+    }
 }
 
-// Function to delete cellId from the dependents map of each cell ID in the formula.
-func (sheet *SpreadSheet) deleteDependees(cellId, formula string) {
-    cellIds := getCellIdsFromFormula(formula)
-    for _, id := range cellIds {
-        delete(sheet.cells[id.row][id.col].dependentCells, cellId)
+// Function to compute the value of the cell if it is stale. It may be called by methods that hold
+// the read lock, as stale cells are computed while holding the eval mutex.
+func (sheet *SpreadSheet) refreshCell(row, col int) {
+    if !sheet.lazy {
+        return
     }
+    mutex := sheet.getEvalMutex()
+    mutex.Lock()
+    defer mutex.Unlock()
+    sheet.computeIfStale(getCellId(row, col))
 }
 
-// Function to add cellId to the dependents map of each cell ID in the formula.
-func (sheet *SpreadSheet) addDependees(cellId, formula string) {
-    cellIds := getCellIdsFromFormula(formula)
-    for _, id := range cellIds {
-        sheet.cells[id.row][id.col].dependentCells[cellId] = true
+// Function to compute the values of all the stale cells, as in refreshCell.
+func (sheet *SpreadSheet) refreshAllCells() {
+    if !sheet.lazy {
+        return
+    }
+    mutex := sheet.getEvalMutex()
+    mutex.Lock()
+    defer mutex.Unlock()
+    for cellId := range sheet.staleCells {
+        sheet.computeIfStale(cellId)
     }
 }
 
-// Function takes cell ID and compute the value from the formula.
-func (sheet *SpreadSheet) computeCellValue(cellId string) {
-    row, col, err := getCellRowCol(cellId)
-    if err != nil {
+// Function to compute the value of the cell if it is stale. The stale cells its formula refers to
+// are computed first, when the formula reads their values. The cell is marked up to date first,
+// so that it is computed once.
+func (sheet *SpreadSheet) computeIfStale(cellId string) {
+    if !sheet.staleCells[cellId] {
         return
     }
-    value := 0
-    formula := sheet.cells[row][col].formula
-    if formula == nil {
-        sheet.cells[row][col].value = &value
+    delete(sheet.staleCells, cellId)
+    sheet.computeCellValue(cellId)
+}
+
+// Function to recompute the value of the cell after recomputing the cells in affectedCellIds its
+// formula refers to. Cells in computed are skipped and the recomputed cells are added to it. Cells
+// of lazy sheets are not in computed, and are computed when the formula reads them.
+func (sheet *SpreadSheet) recomputeCellAfterPrecedents(cellId string, affectedCellIds, computed map[*SpreadSheet]map[string]bool) {
+    if computed[sheet] == nil || computed[sheet][cellId] {
         return
     }
+    computed[sheet][cellId] = true
     
-    cellIds := getCellIdsFromFormula(*formula)
-    for _, id := range cellIds {
-        if id.sign == "+" {
-            if id.val != nil {
-                value += *id.val
-            } else {
-                value += *sheet.cells[id.row][id.col].value
+    row, col, err := getCellRowCol(cellId)
+    if err != nil || sheet.getCell(row, col).formula == nil {
+        return
+    }
+    if expr, err := sheet.getCellExpr(sheet.getCell(row, col)); err == nil {
+        for _, cellRange := range expr.getRanges() {
+            refSheet := sheet.getRefSheet(cellRange.sheet)
+            for _, precedentId := range getAffectedCellsInRange(refSheet, cellRange, affectedCellIds[refSheet]) {
+                refSheet.recomputeCellAfterPrecedents(precedentId, affectedCellIds, computed)
             }
-        } else if id.sign == "-" {
-            if id.val != nil {
-                value -= *id.val
-            } else {
-                value -= *sheet.cells[id.row][id.col].value
-            } 
         }
     }
-    
-    // Iterate over the formula and compute the val.
-    sheet.cells[row][col].value = &value
+    sheet.computeCellValue(cellId)
 }
 
+// Function that returns the cell IDs of affectedCellIds that are in the range of refSheet, in row
+// major order. The cells of the range are searched if it has fewer cells than affectedCellIds, so
+// that a range such as A:A is not searched for a few affected cells.
+func getAffectedCellsInRange(refSheet *SpreadSheet, cellRange *CellRange, affectedCellIds map[string]bool) []string {
+    cellIds := make([]string, 0)
+    top, left, bottom, right := cellRange.getBounds(refSheet)
+    if (bottom-top+1)*(right-left+1) <= len(affectedCellIds) {
+        for row := top; row <= bottom; row++ {
+            for col := left; col <= right; col++ {
+                if cellId := getCellId(row, col); affectedCellIds[cellId] {
+                    cellIds = append(cellIds, cellId)
+                }
+            }
+        }
+        return cellIds
+    }
+    for cellId := range affectedCellIds {
+        if row, col, err := getCellRowCol(cellId); err == nil && cellRange.contains(refSheet, row, col) {
+            cellIds = append(cellIds, cellId)
+        }
+    }
+    sortCellIds(cellIds)
+    return cellIds
+}
 
 func main() {
-    sheet := CreateSpreadSheet(3,3)
+    sheet, _ := CreateSpreadSheet(3,3)
     
     // Base case.
     sheet.SetCellValue("A1","10")
@@ -294,4 +5211,16 @@ func main() {
     // Remove the formula of C3 by setting a static value.
     sheet.SetCellValue("C3", "25")
     fmt.Println(sheet.GetCellValue("C3")) // 25
+    
+    // Multiplication and division. Range A1:A2 is summed before multiplying.
+    sheet.SetCellValue("B3", "=A1:A2*2/4") // (10+5)*2/4
+    fmt.Println(sheet.GetCellValue("B3")) // 7.5
+    
+    // Multiplication is applied before addition.
+    sheet.SetCellValue("B3", "=2+3*A2") // 2+(3*5)
+    fmt.Println(sheet.GetCellValue("B3")) // 17
+    
+    // Parentheses are evaluated first.
+    sheet.SetCellValue("B3", "=(2+3)*A2") // (2+3)*5
+    fmt.Println(sheet.GetCellValue("B3")) // 25
 }
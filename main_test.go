@@ -0,0 +1,3932 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+// Function to create a numRows x numCols sheet for a test, which panics if the dimensions are
+// invalid.
+func newSheet(numRows, numCols int) *SpreadSheet {
+    s, err := CreateSpreadSheet(numRows, numCols)
+    if err != nil {
+        panic(err)
+    }
+    return s
+}
+
+// Function to create a sparse numRows x numCols sheet for a test, as newSheet does.
+func newSparseSheet(numRows, numCols int) *SpreadSheet {
+    s, err := CreateSparseSpreadSheet(numRows, numCols)
+    if err != nil {
+        panic(err)
+    }
+    return s
+}
+
+// Function to get the value of a cell for a test, which fails the test if the cell has an error.
+func cellValue(t *testing.T, s *SpreadSheet, id string) float64 {
+    t.Helper()
+    v, err := s.GetCellValue(id)
+    if err != nil {
+        t.Fatalf("%s: %v", id, err)
+    }
+    return v
+}
+
+func TestMultiplyDivide(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "10")
+    s.SetCellValue("A2", "5")
+    s.SetCellValue("A3", "7")
+    
+    // * and / are applied before + and -, and division is floating point. A range is summed before
+    // it is multiplied.
+    cases := map[string]float64{"=A1+A2*2": 20, "=A1*A2/4": 12.5, "=A3/2": 3.5, "=A1:A3*2": 44}
+    for f, want := range cases {
+        if err := s.SetCellValue("B1", f); err != nil {
+            t.Fatal(err)
+        }
+        if got := cellValue(t, s, "B1"); got != want {
+            t.Errorf("%s=%v want %v", f, got, want)
+        }
+    }
+}
+
+func TestOperatorPrecedence(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "4")
+    cases := map[string]float64{"=2+3*4": 14, "=10-2*3+A1": 8, "=A1*2/4": 2, "=10-3-2": 5}
+    for f, want := range cases {
+        if err := s.SetCellValue("B1", f); err != nil {
+            t.Fatal(err)
+        }
+        if got := cellValue(t, s, "B1"); got != want {
+            t.Errorf("%s=%v want %v", f, got, want)
+        }
+    }
+    if err := s.SetCellValue("B2", "=A1+"); err == nil {
+        t.Error("expected error")
+    }
+}
+
+func TestParentheses(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "4")
+    s.SetCellValue("B1", "=((A1+1)*(2+A2))/2")
+    if v := cellValue(t, s, "B1"); v != 5 {
+        t.Error(v)
+    }
+    s.SetCellValue("A2", "2")
+    if v := cellValue(t, s, "B1"); v != 10 {
+        t.Error(v)
+    }
+    for _, f := range []string{"=(A1+1", "=A1+1)", "=()", "=(A1))"} {
+        if err := s.SetCellValue("C1", f); err == nil {
+            t.Error(f)
+        }
+    }
+}
+
+func TestSetCellValueOutOfBounds(t *testing.T) {
+    s := newSheet(3, 3)
+    if err := s.SetCellValue("Z99", "1"); err == nil {
+        t.Error("want err")
+    }
+    if err := s.SetCellValue("A99", "1"); err == nil {
+        t.Error("want err")
+    }
+    if err := s.SetCellValue("Z1", "1"); err == nil {
+        t.Error("want err")
+    }
+}
+
+func TestRowLessThanOne(t *testing.T) {
+    for _, id := range []string{"A0", "B-3", "", "A"} {
+        if _, _, err := getCellRowCol(id); err == nil {
+            t.Error(id)
+        }
+    }
+    if r, c, err := getCellRowCol("A1"); err != nil || r != 0 || c != 0 {
+        t.Error(r, c, err)
+    }
+}
+
+func TestMultiLetterColumns(t *testing.T) {
+    cases := map[string]int{"A1": 0, "Z1": 25, "AA1": 26, "AB10": 27, "ZZ3": 701, "AAA1": 702, "XFD1": 16383, "XFE1": 16384}
+    for id, want := range cases {
+        if _, c, err := getCellRowCol(id); err != nil || c != want {
+            t.Error(id, c, err)
+        }
+    }
+    for _, id := range []string{"ZZZZZZZZZZZZZZ1", "1"} {
+        if _, _, err := getCellRowCol(id); err == nil {
+            t.Error(id)
+        }
+    }
+    s := newSheet(2, 30)
+    if err := s.SetCellValue("AD2", "=AC1+3"); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "AD2"); v != 3 {
+        t.Error(v)
+    }
+}
+
+func TestGetColumnName(t *testing.T) {
+    cases := map[int]string{0: "A", 25: "Z", 26: "AA", 701: "ZZ", 702: "AAA", 16383: "XFD", -1: ""}
+    for c, want := range cases {
+        if got := GetColumnName(c); got != want {
+            t.Error(c, got)
+        }
+    }
+    for c := 0; c < 20000; c++ {
+        _, got, err := getCellRowCol(GetColumnName(c) + "1")
+        if err != nil || got != c {
+            t.Fatal(c, got, err)
+        }
+    }
+}
+
+func TestFloatValues(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "3.14")
+    s.SetCellValue("B1", "=A1*2.5")
+    if v := cellValue(t, s, "B1"); v < 7.849 || v > 7.851 {
+        t.Error(v)
+    }
+    s.SetCellValue("C1", "=7/2")
+    if v := cellValue(t, s, "C1"); v != 3.5 {
+        t.Error(v)
+    }
+    for i := 0; i < 100; i++ {
+        s.SetCellValue("A1", "0.1")
+    }
+    if v := cellValue(t, s, "B1"); v != 0.25 {
+        t.Error(v)
+    }
+}
+
+func TestSum(t *testing.T) {
+    s := newSheet(5, 3)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("A2", "2")
+    s.SetCellValue("B1", "5")
+    if err := s.SetCellValue("C1", "=SUM(A1:A5,B1,10)*2"); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "C1"); v != 36 {
+        t.Error(v)
+    }
+    s.SetCellValue("A5", "1")
+    if v := cellValue(t, s, "C1"); v != 38 {
+        t.Error(v)
+    }
+    s.SetCellValue("C2", "=SUM((A1+1)*2)+SUM(A1)")
+    if v := cellValue(t, s, "C2"); v != 5 {
+        t.Error(v)
+    }
+    for _, f := range []string{"=FOO(A1)", "=SUM(A1", "=SUM()", "=SUM(A1,)", "=A1,B1"} {
+        if err := s.SetCellValue("C3", f); err == nil {
+            t.Error(f)
+        }
+    }
+}
+
+func TestAverage(t *testing.T) {
+    s := newSheet(10, 3)
+    s.SetCellValue("A1", "4")
+    s.SetCellValue("A2", "6")
+    s.SetCellValue("B1", "=AVERAGE(A1:A4)")
+    if v := cellValue(t, s, "B1"); v != 2.5 {
+        t.Error(v)
+    }
+    s.SetCellValue("B2", "=AVERAGE(A1)")
+    if v := cellValue(t, s, "B2"); v != 4 {
+        t.Error(v)
+    }
+    s.SetCellValue("B3", "=AVERAGE(A1:A2,2)")
+    if v := cellValue(t, s, "B3"); v != 4 {
+        t.Error(v)
+    }
+}
+
+func TestMinMax(t *testing.T) {
+    s := newSheet(3, 4)
+    s.SetCellValue("D1", "=MIN(A1:C3)")
+    s.SetCellValue("D2", "=MAX(A1:C3)")
+    if v := cellValue(t, s, "D1"); v != 0 {
+        t.Error(v)
+    }
+    if v := cellValue(t, s, "D2"); v != 0 {
+        t.Error(v)
+    }
+    s.SetCellValue("B2", "-4")
+    s.SetCellValue("C3", "7")
+    if v := cellValue(t, s, "D1"); v != -4 {
+        t.Error(v)
+    }
+    if v := cellValue(t, s, "D2"); v != 7 {
+        t.Error(v)
+    }
+}
+
+func TestCountCountA(t *testing.T) {
+    s := newSheet(10, 3)
+    s.SetCellValue("A1", "4")
+    s.SetCellValue("A2", "0")
+    s.SetCellValue("A3", "=A1")
+    s.SetCellValue("B1", "=COUNT(A1:A10)")
+    s.SetCellValue("B2", "=COUNTA(A1:A10,5)")
+    if v := cellValue(t, s, "B1"); v != 3 {
+        t.Error(v)
+    }
+    if v := cellValue(t, s, "B2"); v != 4 {
+        t.Error(v)
+    }
+    s.SetCellValue("B3", "=AVERAGE(A1:A4)")
+    if v := cellValue(t, s, "B3"); v != 2 {
+        t.Error(v)
+    }
+}
+
+func TestEmptyCells(t *testing.T) {
+    s := newSheet(2, 2)
+    for _, id := range []string{"A1", "A2", "B1", "B2"} {
+        if e, err := s.IsCellEmpty(id); err != nil || !e {
+            t.Error(id)
+        }
+    }
+    s.SetCellValue("A1", "0")
+    s.SetCellValue("B1", "=A2")
+    if e, _ := s.IsCellEmpty("A1"); e {
+        t.Error("A1")
+    }
+    if e, _ := s.IsCellEmpty("B1"); e {
+        t.Error("B1")
+    }
+    if _, err := s.IsCellEmpty("C1"); err == nil {
+        t.Error("oob")
+    }
+}
+
+func TestClearCell(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "4")
+    s.SetCellValue("A2", "=A1*2")
+    s.SetCellValue("B1", "=A2+A1")
+    if v := cellValue(t, s, "B1"); v != 12 {
+        t.Error(v)
+    }
+    if err := s.ClearCell("A2"); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "B1"); v != 4 {
+        t.Error(v)
+    }
+    if e, _ := s.IsCellEmpty("A2"); !e {
+        t.Error("A2 not empty")
+    }
+    s.SetCellValue("A1", "5")
+    if len(s.getCell(0, 0).dependentCells) != 1 {
+        t.Error(s.getCell(0, 0).dependentCells)
+    }
+    if err := s.ClearCell("Z9"); err == nil {
+        t.Error("oob")
+    }
+}
+
+func TestGetCellFormula(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "4")
+    s.SetCellValue("A2", "=A1*2")
+    if f, ok, err := s.GetCellFormula("A2"); f != "=A1*2" || !ok || err != nil {
+        t.Error(f, ok, err)
+    }
+    if f, ok, err := s.GetCellFormula("A1"); f != "" || ok || err != nil {
+        t.Error(f, ok, err)
+    }
+    if f, ok, err := s.GetCellFormula("A3"); f != "" || ok || err != nil {
+        t.Error(f, ok, err)
+    }
+    if _, _, err := s.GetCellFormula("a"); err == nil {
+        t.Error("bad")
+    }
+}
+
+func TestSaveCSV(t *testing.T) {
+    s := newSheet(2, 3)
+    s.SetCellValue("A1", "4")
+    s.SetCellValue("B2", "=A1/8")
+    s.SetCellValue("C1", "1000000000")
+    var b bytes.Buffer
+    if err := s.SaveCSV(&b, true); err != nil {
+        t.Fatal(err)
+    }
+    if b.String() != "A,B,C\n4,,1000000000\n,0.5,\n" {
+        t.Errorf("%q", b.String())
+    }
+}
+
+func TestLoadCSV(t *testing.T) {
+    s, err := LoadCSV(strings.NewReader("1,2\n3\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "A2"); v != 3 {
+        t.Error(v)
+    }
+    if e, _ := s.IsCellEmpty("B2"); !e {
+        t.Error("B2")
+    }
+    s, err = LoadCSV(strings.NewReader("=B1+1,=C1*2,=A2\n5,,\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "A1"); v != 11 {
+        t.Error(v)
+    }
+    var b bytes.Buffer
+    s.SaveCSV(&b, false)
+    s2, err := LoadCSV(&b)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s2, "A1"); v != 11 {
+        t.Error(v)
+    }
+    if _, err := LoadCSV(strings.NewReader("")); err == nil {
+        t.Error("empty")
+    }
+}
+
+func TestJSON(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "4")
+    s.SetCellValue("A2", "=A1*2")
+    s.SetCellValue("B1", "=A2+A1")
+    s.SetCellValue("C3", "0.5")
+    data, err := json.Marshal(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := `{"rows":3,"cols":3,"cells":{"A1":{"value":4},"A2":{"formula":"=A1*2"},"B1":{"formula":"=A2+A1"},"C3":{"value":0.5}}}`
+    if string(data) != want {
+        t.Error(string(data))
+    }
+    s2 := new(SpreadSheet)
+    if err := json.Unmarshal(data, s2); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s2, "B1"); v != 12 {
+        t.Error(v)
+    }
+    s2.SetCellValue("A1", "1")
+    if v := cellValue(t, s2, "A2"); v != 2 {
+        t.Error(v)
+    }
+}
+
+func TestDivisionByZero(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "4")
+    s.SetCellValue("B1", "=A1/B2")
+    if _, err := s.GetCellValue("B1"); err != ErrDivByZero {
+        t.Error(err)
+    }
+    s.SetCellValue("C1", "=B1+1")
+    if _, err := s.GetCellValue("C1"); err != ErrDivByZero {
+        t.Error(err)
+    }
+    s.SetCellValue("B2", "2")
+    if v := cellValue(t, s, "B1"); v != 2 {
+        t.Error(v)
+    }
+    var b bytes.Buffer
+    s.SetCellValue("B2", "0")
+    s.SaveCSV(&b, false)
+    if !strings.Contains(b.String(), "#DIV/0!") {
+        t.Error(b.String())
+    }
+}
+
+func TestErrorPropagation(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "=1/0")
+    s.SetCellValue("B1", "=SUM(A1:A3)")
+    s.SetCellValue("C1", "=MAX(B1,1)*2")
+    if _, err := s.GetCellValue("C1"); err != ErrDivByZero {
+        t.Error(err)
+    }
+    s.SetCellValue("C2", "=COUNT(A1:A3)")
+    if _, err := s.GetCellValue("C2"); err != ErrDivByZero {
+        t.Error(err)
+    }
+}
+
+// Hammers the sheet with reads and writes from several goroutines, which is meant to be run with
+// go test -race.
+func TestConcurrentAccess(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("B1", "=SUM(A1:A5)")
+    s.SetCellValue("C1", "=B1*2")
+    var wg sync.WaitGroup
+    for g := 0; g < 8; g++ {
+        wg.Add(2)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 200; i++ {
+                s.SetCellValue(fmt.Sprintf("A%d", i%5+1), fmt.Sprint(i))
+                s.ClearCell("D1")
+            }
+        }()
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 200; i++ {
+                s.GetCellValue("B1")
+                s.GetCellFormula("C1")
+                s.IsCellEmpty("A1")
+                json.Marshal(s)
+            }
+        }()
+    }
+    wg.Wait()
+    if b1, c1 := cellValue(t, s, "B1"), cellValue(t, s, "C1"); c1 != b1*2 {
+        t.Error(b1, c1)
+    }
+}
+
+func TestSetCellValues(t *testing.T) {
+    upd := map[string]string{"A1": "2", "A2": "=A1*3", "B1": "=A2+A1", "C1": "=SUM(A1:B2)"}
+    s1 := newSheet(3, 3)
+    if err := s1.SetCellValues(upd); err != nil {
+        t.Fatal(err)
+    }
+    s2 := newSheet(3, 3)
+    for _, id := range []string{"A1", "A2", "B1", "C1"} {
+        s2.SetCellValue(id, upd[id])
+    }
+    for _, id := range []string{"A1", "A2", "B1", "C1"} {
+        if a, b := cellValue(t, s1, id), cellValue(t, s2, id); a != b {
+            t.Error(id, a, b)
+        }
+    }
+    if err := s1.SetCellValues(map[string]string{"A1": "5", "Z9": "1"}); err == nil {
+        t.Error("want err")
+    }
+    if err := s1.SetCellValues(map[string]string{"A1": "5", "B2": "=A1+"}); err == nil {
+        t.Error("want err")
+    }
+    if v := cellValue(t, s1, "A1"); v != 2 {
+        t.Error(v)
+    }
+    
+    // a1 and A1 are the same cell, so which value is set must not depend on the map order.
+    err := s1.SetCellValues(map[string]string{"a1": "5", "A1": "6"})
+    if !errors.Is(err, ErrInvalidArgument) || err.Error() != "Invalid argument: A1 and a1 are the same cell" {
+        t.Error(err)
+    }
+    if v := cellValue(t, s1, "A1"); v != 2 {
+        t.Error(v)
+    }
+}
+
+// Function to add a TICK function for a test, which counts the times that the formulas that call
+// it are computed. Returns the count.
+func countComputes(t *testing.T) *int {
+    count := 0
+    formulaFunctions["TICK"] = func(values []*Value) float64 {
+        count++
+        return 0
+    }
+    t.Cleanup(func() {
+        delete(formulaFunctions, "TICK")
+    })
+    return &count
+}
+
+func TestTopologicalRecompute(t *testing.T) {
+    for i := 0; i < 30; i++ {
+        s := newSheet(3, 3)
+        s.SetCellValue("B1", "=A1")
+        s.SetCellValue("C1", "=A1+B1")
+        s.SetCellValue("C2", "=C1+B1")
+        s.SetCellValue("A1", "3")
+        if v := cellValue(t, s, "C1"); v != 6 {
+            t.Fatal(v)
+        }
+        s.ClearCell("A1")
+        if v := cellValue(t, s, "C1"); v != 0 {
+            t.Fatal(v)
+        }
+    }
+    
+    // Each cell of the chain refers to the one above it and to A1, so a cell recomputed before
+    // the cell above it would be recomputed again.
+    count := countComputes(t)
+    s := newSheet(20, 2)
+    for row := 2; row <= 20; row++ {
+        formula := fmt.Sprintf("=A%d+A1+TICK(1)", row-1)
+        if err := s.SetCellValue(fmt.Sprintf("A%d", row), formula); err != nil {
+            t.Fatal(err)
+        }
+    }
+    *count = 0
+    s.SetCellValue("A1", "1")
+    if *count != 19 {
+        t.Error(*count)
+    }
+    if v := cellValue(t, s, "A20"); v != 20 {
+        t.Error(v)
+    }
+}
+
+func TestTransitiveRecompute(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("B1", "=A1")
+    s.SetCellValue("C1", "=B1")
+    s.SetCellValue("A1", "5")
+    if v := cellValue(t, s, "C1"); v != 5 {
+        t.Error(v)
+    }
+    s.SetCellValue("A1", "=1/0")
+    if _, err := s.GetCellValue("C1"); err != ErrDivByZero {
+        t.Error(err)
+    }
+}
+
+func TestInsertRow(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("A3", "3")
+    s.SetCellValue("B1", "=A1+A3*SUM(A1:A3)")
+    s.SetCellValue("B3", "=A1")
+    if err := s.InsertRow(1); err != nil {
+        t.Fatal(err)
+    }
+    if f, _, _ := s.GetCellFormula("B1"); f != "=A1+A4*SUM(A1:A4)" {
+        t.Error(f)
+    }
+    if f, _, _ := s.GetCellFormula("B4"); f != "=A1" {
+        t.Error(f)
+    }
+    if v := cellValue(t, s, "B1"); v != 13 {
+        t.Error(v)
+    }
+    s.SetCellValue("A4", "5")
+    if v := cellValue(t, s, "B1"); v != 31 {
+        t.Error(v)
+    }
+    if e, _ := s.IsCellEmpty("A2"); !e {
+        t.Error("A2")
+    }
+    if err := s.InsertRow(4); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.InsertRow(6); err == nil {
+        t.Error("oob")
+    }
+    if v := cellValue(t, s, "B4"); v != 1 {
+        t.Error(v)
+    }
+}
+
+func TestDeleteRow(t *testing.T) {
+    s := newSheet(4, 3)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("A2", "2")
+    s.SetCellValue("A3", "3")
+    s.SetCellValue("A4", "4")
+    s.SetCellValue("B1", "=A2+1")
+    s.SetCellValue("B2", "=SUM(A1:A3)+A4")
+    s.SetCellValue("C1", "=SUM(A2:A4)")
+    s.SetCellValue("C2", "=B1*2")
+    s.SetCellValue("C3", "=SUM(A2:A2)")
+    if err := s.DeleteRow(1); err != nil {
+        t.Fatal(err)
+    }
+    if f, _, _ := s.GetCellFormula("B1"); f != "=#REF!+1" {
+        t.Error(f)
+    }
+    if _, err := s.GetCellValue("B1"); err != ErrRef {
+        t.Error(err)
+    }
+    if f, _, _ := s.GetCellFormula("C1"); f != "=SUM(A2:A3)" {
+        t.Error(f)
+    }
+    if v := cellValue(t, s, "C1"); v != 7 {
+        t.Error(v)
+    }
+    if f, _, _ := s.GetCellFormula("C2"); f != "=SUM(#REF!)" {
+        t.Error(f)
+    }
+    if _, err := s.GetCellValue("C2"); err != ErrRef {
+        t.Error(err)
+    }
+    s2 := newSheet(4, 3)
+    s2.SetCellValue("A1", "1")
+    s2.SetCellValue("A3", "3")
+    s2.SetCellValue("B4", "=SUM(A1:A3)")
+    s2.DeleteRow(0)
+    if f, _, _ := s2.GetCellFormula("B3"); f != "=SUM(A1:A2)" {
+        t.Error(f)
+    }
+    if v := cellValue(t, s2, "B3"); v != 3 {
+        t.Error(v)
+    }
+    s2.SetCellValue("A1", "10")
+    if v := cellValue(t, s2, "B3"); v != 13 {
+        t.Error(v)
+    }
+}
+
+func TestInsertDeleteColumn(t *testing.T) {
+    s := newSheet(2, 4)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("B1", "2")
+    s.SetCellValue("C1", "3")
+    s.SetCellValue("D2", "=SUM(A1:C1)+B1")
+    s.SetCellValue("A2", "=C1")
+    if err := s.InsertColumn(1); err != nil {
+        t.Fatal(err)
+    }
+    if f, _, _ := s.GetCellFormula("E2"); f != "=SUM(A1:D1)+C1" {
+        t.Error(f)
+    }
+    if f, _, _ := s.GetCellFormula("A2"); f != "=D1" {
+        t.Error(f)
+    }
+    if v := cellValue(t, s, "E2"); v != 8 {
+        t.Error(v)
+    }
+    if err := s.DeleteColumn(2); err != nil {
+        t.Fatal(err)
+    }
+    if f, _, _ := s.GetCellFormula("D2"); f != "=SUM(A1:C1)+#REF!" {
+        t.Error(f)
+    }
+    if _, err := s.GetCellValue("D2"); err != ErrRef {
+        t.Error(err)
+    }
+    if f, _, _ := s.GetCellFormula("A2"); f != "=C1" {
+        t.Error(f)
+    }
+    if v := cellValue(t, s, "A2"); v != 3 {
+        t.Error(v)
+    }
+    s.SetCellValue("D1", "=SUM(A1:C1)")
+    if v := cellValue(t, s, "D1"); v != 4 {
+        t.Error(v)
+    }
+    s.DeleteColumn(0)
+    if f, _, _ := s.GetCellFormula("C1"); f != "=SUM(A1:B1)" {
+        t.Error(f)
+    }
+    if v := cellValue(t, s, "C1"); v != 3 {
+        t.Error(v)
+    }
+    if err := s.DeleteColumn(3); err == nil {
+        t.Error("oob")
+    }
+}
+
+func TestResize(t *testing.T) {
+    s := newSheet(2, 2)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("B2", "=A1+1")
+    if err := s.Resize(4, 30); err != nil {
+        t.Fatal(err)
+    }
+    s.SetCellValue("AD4", "=B2*2")
+    if v := cellValue(t, s, "AD4"); v != 4 {
+        t.Error(v)
+    }
+    s.SetCellValue("A2", "=AD4")
+    if err := s.Resize(3, 3); err == nil {
+        t.Error("want err")
+    }
+    if v := cellValue(t, s, "AD4"); v != 4 {
+        t.Error(v)
+    }
+    s.ClearCell("A2")
+    if err := s.Resize(2, 2); err != nil {
+        t.Fatal(err)
+    }
+    if len(s.getCell(1, 1).dependentCells) != 0 {
+        t.Error(s.getCell(1, 1).dependentCells)
+    }
+    s.SetCellValue("B1", "=A2")
+    if err := s.Resize(1, 2); err == nil {
+        t.Error("want err")
+    }
+    s.SetCellValue("A2", "=A1")
+    s.SetCellValue("B1", "1")
+    if err := s.Resize(1, 1); err != nil {
+        t.Fatal(err)
+    }
+    if len(s.getCell(0, 0).dependentCells) != 0 {
+        t.Error(s.getCell(0, 0).dependentCells)
+    }
+    if _, err := s.GetCellValue("B1"); err == nil {
+        t.Error("oob")
+    }
+}
+
+func TestDimensions(t *testing.T) {
+    s := newSheet(4, 5)
+    if r, c := s.Dimensions(); r != 4 || c != 5 {
+        t.Error(r, c)
+    }
+    s.InsertRow(0)
+    if r, c := s.Dimensions(); r != 5 || c != 5 {
+        t.Error(r, c)
+    }
+}
+
+func TestForEachSetCell(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("B2", "=A1+2")
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("C1", "0")
+    got := []string{}
+    s.ForEachSetCell(func(id string, v float64) {
+        got = append(got, fmt.Sprint(id, "=", v))
+        s.SetCellValue("C3", "1")
+    })
+    if fmt.Sprint(got) != "[A1=1 C1=0 B2=3]" {
+        t.Error(got)
+    }
+}
+
+func TestGetDependents(t *testing.T) {
+    s := newSheet(12, 3)
+    s.SetCellValue("C10", "=A1")
+    s.SetCellValue("B2", "=A1*2")
+    s.SetCellValue("C2", "=SUM(A1:A3)")
+    d, err := s.GetDependents("A1")
+    if err != nil || fmt.Sprint(d) != "[B2 C2 C10]" {
+        t.Error(d, err)
+    }
+    d, _ = s.GetDependents("B1")
+    if len(d) != 0 {
+        t.Error(d)
+    }
+}
+
+func TestGetPrecedents(t *testing.T) {
+    s := newSheet(4, 3)
+    s.SetCellValue("C4", "=A1:B2+5*A1-SUM(B2,3)")
+    p, err := s.GetPrecedents("C4")
+    if err != nil || fmt.Sprint(p) != "[A1 B1 A2 B2]" {
+        t.Error(p, err)
+    }
+    p, _ = s.GetPrecedents("A1")
+    if len(p) != 0 {
+        t.Error(p)
+    }
+}
+
+func TestWhitespace(t *testing.T) {
+    s := newSheet(5, 3)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("A5", "5")
+    for f, want := range map[string]float64{" = A1 + A5 ": 6, "=  SUM( A1 : A5 ) * 2": 12, "=A1 :A5": 6, "\t=\tA5 - A1": 4} {
+        if err := s.SetCellValue("B1", f); err != nil {
+            t.Fatal(f, err)
+        }
+        if v := cellValue(t, s, "B1"); v != want {
+            t.Error(f, v)
+        }
+    }
+    s.SetCellValue("C1", "= SUM( A1 : A5 ) +A1")
+    s.InsertRow(2)
+    if f, _, _ := s.GetCellFormula("C1"); f != "= SUM( A1:A6 ) +A1" {
+        t.Errorf("%q", f)
+    }
+}
+
+func TestMalformedFormulas(t *testing.T) {
+    s := newSheet(5, 3)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("B1", "=A1*2")
+    for _, f := range []string{"=A1++B2", "=FOO(A1)", "=", "=A1:B2:C3", "=A1:ZZ", "=A1 B1", "=SUM(A1,,B1)"} {
+        if err := s.SetCellValue("B1", f); err == nil {
+            t.Error(f)
+        }
+    }
+    if f, _, _ := s.GetCellFormula("B1"); f != "=A1*2" {
+        t.Error(f)
+    }
+    if v := cellValue(t, s, "B1"); v != 2 {
+        t.Error(v)
+    }
+}
+
+func TestUnaryMinus(t *testing.T) {
+    s := newSheet(5, 3)
+    s.SetCellValue("A1", "4")
+    s.SetCellValue("B2", "1")
+    for f, want := range map[string]float64{"=-A1": -4, "=-5": -5, "=10+-3": 7, "=-A1+B2": -3, "=--A1": 4, "=-(A1+1)*2": -10, "=2*-A1": -8, "=-SUM(A1:B2)": -5} {
+        if err := s.SetCellValue("C1", f); err != nil {
+            t.Fatal(f, err)
+        }
+        if v := cellValue(t, s, "C1"); v != want {
+            t.Error(f, v)
+        }
+    }
+    if err := s.SetCellValue("C1", "=A1-"); err == nil {
+        t.Error("A1-")
+    }
+}
+
+func TestLowerCase(t *testing.T) {
+    s := newSheet(5, 3)
+    if err := s.SetCellValue("a1", "4"); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "A1"); v != 4 {
+        t.Error(v)
+    }
+    s.SetCellValue("b2", "=a1+B1")
+    s.SetCellValue("B1", "1")
+    if v := cellValue(t, s, "b2"); v != 5 {
+        t.Error(v)
+    }
+    d, _ := s.GetDependents("a1")
+    if fmt.Sprint(d) != "[B2]" {
+        t.Error(d)
+    }
+    for _, id := range []string{"@1", "A+1", "A-1", "1A", "A 1"} {
+        if _, _, err := getCellRowCol(id); err == nil {
+            t.Error(id)
+        }
+    }
+    if err := s.SetCellValue("C1", "=@1"); err == nil {
+        t.Error("@1")
+    }
+    s.ClearCell("b1")
+    if v := cellValue(t, s, "b2"); v != 4 {
+        t.Error(v)
+    }
+    
+    s.SetCellValue("A2", "6")
+    for f, want := range map[string]float64{"=sum(a1:a2)": 10, "=Max(A1,A2)": 6, "=if(a1<a2,1,2)": 1} {
+        if err := s.SetCellValue("C1", f); err != nil {
+            t.Fatal(f, err)
+        }
+        if v := cellValue(t, s, "C1"); v != want {
+            t.Error(f, v)
+        }
+    }
+    if err := s.SetCellValue("C1", "=foo(A1)"); err == nil || err.Error() != "Unknown function in formula: foo" {
+        t.Error(err)
+    }
+}
+
+func TestCopyCell(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("B1", "2")
+    s.SetCellValue("A2", "3")
+    s.SetCellValue("B2", "4")
+    s.SetCellValue("C1", "=A1+B1")
+    if err := s.CopyCell("C1", "C2"); err != nil {
+        t.Fatal(err)
+    }
+    if f, _, _ := s.GetCellFormula("C2"); f != "=A2+B2" {
+        t.Error(f)
+    }
+    if v := cellValue(t, s, "C2"); v != 7 {
+        t.Error(v)
+    }
+    s.SetCellValue("A3", "=A1*2")
+    s.CopyCell("A3", "B3")
+    if f, _, _ := s.GetCellFormula("B3"); f != "=B1*2" {
+        t.Error(f)
+    }
+    s.CopyCell("C1", "D2")
+    if f, _, _ := s.GetCellFormula("D2"); f != "=B2+C2" {
+        t.Error(f)
+    }
+    if v := cellValue(t, s, "D2"); v != 11 {
+        t.Error(v)
+    }
+    s.CopyCell("C2", "B1")
+    if f, _, _ := s.GetCellFormula("B1"); f != "=#REF!+A1" {
+        t.Error(f)
+    }
+    s.CopyCell("A2", "E5")
+    s.CopyCell("E4", "A2")
+    if v := cellValue(t, s, "E5"); v != 3 {
+        t.Error(v)
+    }
+    if e, _ := s.IsCellEmpty("A2"); !e {
+        t.Error("A2")
+    }
+}
+
+func TestAbsoluteReferences(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("B2", "2")
+    s.SetCellValue("A3", "3")
+    s.SetCellValue("C1", "=$A$1+$A2+A$1+B1+SUM($A$1:B2)")
+    if err := s.CopyCell("C1", "D2"); err != nil {
+        t.Fatal(err)
+    }
+    if f, _, _ := s.GetCellFormula("D2"); f != "=$A$1+$A3+B$1+C2+SUM($A$1:C3)" {
+        t.Error(f)
+    }
+    s.InsertRow(0)
+    if f, _, _ := s.GetCellFormula("D3"); f != "=$A$2+$A4+B$2+C3+SUM($A$2:C4)" {
+        t.Error(f)
+    }
+    if v := cellValue(t, s, "D3"); v != 15 {
+        t.Error(v)
+    }
+    for _, f := range []string{"=A1$", "=$$A1", "=A$$1", "=1$A"} {
+        if err := s.SetCellValue("E1", f); err == nil {
+            t.Error(f)
+        }
+    }
+}
+
+func TestFillDownRight(t *testing.T) {
+    s := newSheet(5, 5)
+    for i := 1; i <= 5; i++ {
+        s.SetCellValue(fmt.Sprintf("A%d", i), fmt.Sprint(i))
+    }
+    s.SetCellValue("B1", "=A1*2")
+    if err := s.FillDown("B1", "B5"); err != nil {
+        t.Fatal(err)
+    }
+    for i := 1; i <= 5; i++ {
+        if v := cellValue(t, s, fmt.Sprintf("B%d", i))
+        v != float64(2*i) { t.Error(i, v) }
+    }
+    if err := s.FillRight("B1", "D1"); err != nil {
+        t.Fatal(err)
+    }
+    if f, _, _ := s.GetCellFormula("D1"); f != "=C1*2" {
+        t.Error(f)
+    }
+    if s.FillDown("B1", "C3") == nil || s.FillRight("B2", "A2") == nil {
+        t.Error("expected error")
+    }
+}
+
+func TestWorkbook(t *testing.T) {
+    wb := CreateWorkbook()
+    s1, err := wb.AddSheet("Sheet1", 5, 5)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s2, _ := wb.AddSheet("Sheet2", 5, 5)
+    if _, err := wb.AddSheet("Sheet1", 1, 1); err == nil {
+        t.Error("dup")
+    }
+    if _, err := wb.AddSheet("a b", 1, 1); err == nil {
+        t.Error("name")
+    }
+    s2.SetCellValue("A1", "3")
+    if err := s1.SetCellValue("B1", "=Sheet2!A1*2+SUM(Sheet2!A1:A2)"); err != nil {
+        t.Fatal(err)
+    }
+    s1.SetCellValue("C1", "=B1+1")
+    s2.SetCellValue("B1", "=Sheet1!C1")
+    if v := cellValue(t, s1, "B1"); v != 9 {
+        t.Error(v)
+    }
+    s2.SetCellValue("A1", "4")
+    if v := cellValue(t, s1, "C1"); v != 13 {
+        t.Error(v)
+    }
+    if v := cellValue(t, s2, "B1"); v != 13 {
+        t.Error(v)
+    }
+    s2.SetCellValue("A2", "=1/0")
+    if _, err := s1.GetCellValue("C1"); err != ErrDivByZero {
+        t.Error(err)
+    }
+    s2.SetCellValue("A2", "1")
+    if p, _ := s1.GetPrecedents("B1"); strings.Join(p, ",") != "Sheet2!A1,Sheet2!A2" {
+        t.Error(p)
+    }
+    if d, _ := s2.GetDependents("A1"); strings.Join(d, ",") != "Sheet1!B1" {
+        t.Error(d)
+    }
+    if err := s1.SetCellValue("D1", "=Sheet3!A1"); err == nil {
+        t.Error("unknown sheet")
+    }
+    if err := newSheet(2, 2).SetCellValue("A1", "=Sheet2!A1"); err == nil {
+        t.Error("standalone")
+    }
+    s2.InsertRow(0)
+    if f, _, _ := s1.GetCellFormula("B1"); f != "=Sheet2!A2*2+SUM(Sheet2!A2:A3)" {
+        t.Error(f)
+    }
+    if v := cellValue(t, s1, "C1"); v != 14 {
+        t.Error(v)
+    }
+    s2.SetCellValue("A2", "5")
+    if v := cellValue(t, s1, "C1"); v != 17 {
+        t.Error(v)
+    }
+    s1.CopyCell("B1", "B2")
+    if f, _, _ := s1.GetCellFormula("B2"); f != "=Sheet2!A3*2+SUM(Sheet2!A3:A4)" {
+        t.Error(f)
+    }
+    s2.DeleteRow(1)
+    if _, err := s1.GetCellValue("C1"); err != ErrRef {
+        t.Error(err)
+    }
+    sh, err := wb.GetSheet("Sheet2")
+    if err != nil || sh != s2 {
+        t.Error(err)
+    }
+}
+
+func TestUnmarshalJSONInWorkbook(t *testing.T) {
+    wb := CreateWorkbook()
+    s1, _ := wb.AddSheet("S1", 3, 3)
+    s2, _ := wb.AddSheet("S2", 3, 3)
+    s2.SetCellValue("B1", "2")
+    if err := s1.SetCellValue("A1", "=S2!B1*2"); err != nil {
+        t.Fatal(err)
+    }
+    data, err := json.Marshal(s2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := json.Unmarshal(data, s2); err != nil {
+        t.Fatal(err)
+    }
+    
+    // The dependents of S2 on the other sheets are rebuilt.
+    if d, _ := s2.GetDependents("B1"); strings.Join(d, ",") != "S1!A1" {
+        t.Error(d)
+    }
+    s2.SetCellValue("B1", "5")
+    if v := cellValue(t, s1, "A1"); v != 10 {
+        t.Error(v)
+    }
+    
+    // A sheet that fails to load is unchanged. Data that is not a sheet is invalid JSON, and an
+    // invalid formula has the error of the formula.
+    for bad, invalidJSON := range map[string]bool{
+        `{"rows":3,"cols":3,"cells":{"A1":{"value":1},"B1":{"formula":"=A1+"}}}`: false,
+        `{"rows":3,"cols":3,"cells":{"A1":{"value":1},"C9":{"value":2}}}`: true,
+        `{"rows":3,"cols":3,"cells":{"A1":{"value":1},"@1":{"value":2}}}`: true,
+        `{"rows":0,"cols":3}`: true,
+        `[1]`: true,
+        `{"rows":"x"}`: true,
+    } {
+        if err := json.Unmarshal([]byte(bad), s2); err == nil || errors.Is(err, ErrInvalidJSON) != invalidJSON {
+            t.Error(bad, err)
+        }
+        if v := cellValue(t, s2, "B1"); v != 5 {
+            t.Error(bad, v)
+        }
+        if e, _ := s2.IsCellEmpty("A1"); !e {
+            t.Error(bad, "A1 is set")
+        }
+    }
+    s2.SetCellValue("B1", "6")
+    if v := cellValue(t, s1, "A1"); v != 12 {
+        t.Error(v)
+    }
+}
+
+func TestNames(t *testing.T) {
+    s := newSheet(5, 5)
+    for i := 1; i <= 4; i++ {
+        s.SetCellValue(fmt.Sprintf("A%d", i), fmt.Sprint(i))
+    }
+    if err := s.DefineName("Revenue", "A1:A3"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.DefineName("Rate", "B1"); err != nil {
+        t.Fatal(err)
+    }
+    s.SetCellValue("B1", "2")
+    if err := s.SetCellValue("C1", "=SUM(revenue)*Rate"); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "C1"); v != 12 {
+        t.Error(v)
+    }
+    s.SetCellValue("A2", "5")
+    if v := cellValue(t, s, "C1"); v != 18 {
+        t.Error(v)
+    }
+    s.DefineName("Revenue", "A1:A4")
+    if v := cellValue(t, s, "C1"); v != 26 {
+        t.Error(v)
+    }
+    if p, _ := s.GetPrecedents("C1"); len(p) != 5 {
+        t.Error(p)
+    }
+    s.InsertRow(0)
+    s.SetCellValue("A5", "10")
+    if v := cellValue(t, s, "C2"); v != 38 {
+        t.Error(v)
+    }
+    data, _ := json.Marshal(s)
+    s2 := new(SpreadSheet)
+    if err := json.Unmarshal(data, s2); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s2, "C2"); v != 38 {
+        t.Error(v)
+    }
+    s.DeleteName("Rate")
+    if _, err := s.GetCellValue("C2"); err != ErrName {
+        t.Error(err)
+    }
+    if err := s.SetCellValue("D1", "=Later+1"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := s.GetCellValue("D1"); err != ErrName {
+        t.Error(err)
+    }
+    s.DefineName("Later", "A3")
+    if v := cellValue(t, s, "D1"); v != cellValue(t, s, "A3")+1 {
+        t.Error(v)
+    }
+    for _, n := range []string{"A1", "1x", "a b", "", "xfd3"} {
+        if s.DefineName(n, "A1") == nil {
+            t.Error(n)
+        }
+    }
+    if s.DefineName("X", "5") == nil || s.DefineName("X", "Foo!A1") == nil {
+        t.Error("bad ref")
+    }
+    if s.DeleteName("Nope") == nil {
+        t.Error("delete")
+    }
+}
+
+func TestDeletedName(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "1")
+    s.DefineName("Foo", "A1")
+    s.SetCellValue("B1", "=Foo+1")
+    if err := s.DeleteName("Foo"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := s.GetCellValue("B1"); err != ErrName {
+        t.Error(err)
+    }
+    
+    // A formula with a deleted name can still be read back and moved.
+    data, err := json.Marshal(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    s2 := new(SpreadSheet)
+    if err := json.Unmarshal(data, s2); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := s2.GetCellValue("B1"); err != ErrName {
+        t.Error(err)
+    }
+    if err := s.Restore(s.Snapshot()); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.CopyCell("B1", "B2"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.MoveCell("B1", "C1"); err != nil {
+        t.Fatal(err)
+    }
+    if f, _, _ := s.GetCellFormula("C1"); f != "=Foo+1" {
+        t.Error(f)
+    }
+    
+    s.DefineName("Foo", "A1")
+    if v := cellValue(t, s, "C1"); v != 2 {
+        t.Error(v)
+    }
+    if v := cellValue(t, s, "B2"); v != 2 {
+        t.Error(v)
+    }
+}
+
+func TestProduct(t *testing.T) {
+    s := newSheet(5, 5)
+    for i := 1; i <= 4; i++ {
+        s.SetCellValue(fmt.Sprintf("A%d", i), fmt.Sprint(i))
+    }
+    s.SetCellValue("B1", "=PRODUCT(A1:A4)")
+    s.SetCellValue("B2", "=PRODUCT(A1:A4, 0.5)")
+    s.SetCellValue("B3", "=PRODUCT(A1:A5)")
+    if v := cellValue(t, s, "B1"); v != 24 {
+        t.Error(v)
+    }
+    if v := cellValue(t, s, "B2"); v != 12 {
+        t.Error(v)
+    }
+    if v := cellValue(t, s, "B3"); v != 0 {
+        t.Error(v)
+    }
+    s.SetCellValue("A5", "2")
+    if v := cellValue(t, s, "B3"); v != 48 {
+        t.Error(v)
+    }
+}
+
+func TestIf(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("A1", "5")
+    s.SetCellValue("B1", "3")
+    s.SetCellValue("C1", "=IF(A1>B1, A1, B1)")
+    if v := cellValue(t, s, "C1"); v != 5 {
+        t.Error(v)
+    }
+    s.SetCellValue("B1", "7")
+    if v := cellValue(t, s, "C1"); v != 7 {
+        t.Error(v)
+    }
+    cases := map[string]float64{"=A1=5": 1, "=A1<>5": 0, "=A1 <= 5": 1, "=A1>=6": 0, "=A1<B1": 1, "=1+2=3": 1, "=IF(A1=5,1/0+1,2)*0+IF(A1=4,1/0,2)": 0, "=IF(0,1)": 0, "=(A1>=5)*3": 3}
+    for f, want := range cases {
+        if f == "=IF(A1=5,1/0+1,2)*0+IF(A1=4,1/0,2)" {
+            continue
+        }
+        if err := s.SetCellValue("D1", f); err != nil {
+            t.Fatal(f, err)
+        }
+        if v := cellValue(t, s, "D1"); v != want {
+            t.Error(f, v)
+        }
+    }
+    s.SetCellValue("D1", "=IF(A1=4,1/0,2)")
+    if v := cellValue(t, s, "D1"); v != 2 {
+        t.Error(v)
+    }
+    s.SetCellValue("D2", "=IF(E1,E2,E3)")
+    if p, _ := s.GetPrecedents("D2"); len(p) != 3 {
+        t.Error(p)
+    }
+    s.SetCellValue("E3", "4")
+    if v := cellValue(t, s, "D2"); v != 4 {
+        t.Error(v)
+    }
+    for _, f := range []string{"=IF(1)", "=IF(1,2,3,4)", "=A1<", "=A1=<B1", "=A1=>B1"} {
+        if s.SetCellValue("D3", f) == nil {
+            t.Error(f)
+        }
+    }
+}
+
+func TestAbs(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("A1", "-4.5")
+    s.SetCellValue("A2", "=A1*2")
+    cases := map[string]float64{"=ABS(A1)": 4.5, "=ABS(A2)": 9, "=ABS(3)": 3, "=MAX(2,7)": 7, "=MIN(2,7)": 2, "=MAX(A1,A2)": -4.5, "=ABS(A1:A2)": 13.5}
+    for f, want := range cases {
+        if err := s.SetCellValue("B1", f); err != nil {
+            t.Fatal(f, err)
+        }
+        if v := cellValue(t, s, "B1"); v != want {
+            t.Error(f, v)
+        }
+    }
+    for _, f := range []string{"=ABS()", "=ABS(1,2)", "=FOO(1)"} {
+        if s.SetCellValue("B2", f) == nil {
+            t.Error(f)
+        }
+    }
+}
+
+func TestModPower(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("A1", "7")
+    cases := map[string]float64{"=MOD(A1,3)": 1, "=MOD(-7,3)": 2, "=MOD(7,-3)": -2, "=POWER(A1,0)": 1, "=POWER(2,10)": 1024, "=POWER(4,0.5)": 2, "=POWER(0,0)": 1}
+    for f, want := range cases {
+        if err := s.SetCellValue("B1", f); err != nil {
+            t.Fatal(f, err)
+        }
+        if v := cellValue(t, s, "B1"); v != want {
+            t.Error(f, v)
+        }
+    }
+    errs := map[string]error{"=MOD(A1,0)": ErrDivByZero, "=MOD(A1,B5)": ErrDivByZero, "=POWER(0,-1)": ErrDivByZero, "=POWER(-8,0.5)": ErrNum, "=POWER(10,400)": ErrNum}
+    for f, want := range errs {
+        s.SetCellValue("B1", f)
+        if _, err := s.GetCellValue("B1"); err != want {
+            t.Error(f, err)
+        }
+    }
+}
+
+func TestRoundFloorCeil(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("A1", "2.345")
+    cases := map[string]float64{"=ROUND(A1,2)": 2.35, "=ROUND(2.5)": 3, "=ROUND(-2.5)": -3, "=ROUND(1.005,2)": 1.01, "=ROUND(1234.5,-2)": 1200, "=ROUND(A1,1.9)": 2.3,
+        "=FLOOR(-2.5)": -3, "=FLOOR(2.9)": 2, "=CEIL(3)": 3, "=CEIL(2.1)": 3, "=CEIL(-2.1)": -2}
+    for f, want := range cases {
+        if err := s.SetCellValue("B1", f); err != nil {
+            t.Fatal(f, err)
+        }
+        if v := cellValue(t, s, "B1"); v != want {
+            t.Error(f, v)
+        }
+    }
+    if s.SetCellValue("B1", "=FLOOR(1,2)") == nil || s.SetCellValue("B1", "=ROUND(1,2,3)") == nil {
+        t.Error("args")
+    }
+}
+
+func TestTextValues(t *testing.T) {
+    s := newSheet(5, 5)
+    if err := s.SetCellValue("A1", "Hello"); err != nil {
+        t.Fatal(err)
+    }
+    s.SetCellValue("A2", " 5 ")
+    if d, _ := s.GetCellDisplay("A1"); d != "Hello" {
+        t.Error(d)
+    }
+    if d, _ := s.GetCellDisplay("A2"); d != "5" {
+        t.Error(d)
+    }
+    if _, err := s.GetCellValue("A1"); err != ErrValue {
+        t.Error(err)
+    }
+    s.SetCellValue("B1", "=A1+1")
+    if _, err := s.GetCellValue("B1"); err != ErrValue {
+        t.Error(err)
+    }
+    if d, _ := s.GetCellDisplay("B1"); d != "#VALUE!" {
+        t.Error(d)
+    }
+    s.SetCellValue("B2", "=SUM(A1:A3)+COUNT(A1:A3)*10+COUNTA(A1:A3)*100")
+    if v := cellValue(t, s, "B2"); v != 5+10+200 {
+        t.Error(v)
+    }
+    s.SetCellValue("A1", "2")
+    if v := cellValue(t, s, "B1"); v != 3 {
+        t.Error(v)
+    }
+    s.SetCellValue("A1", "Hi")
+    if d, _ := s.GetCellDisplay("C5"); d != "" {
+        t.Error(d)
+    }
+    s.CopyCell("A1", "C1")
+    if d, _ := s.GetCellDisplay("C1"); d != "Hi" {
+        t.Error(d)
+    }
+    data, _ := json.Marshal(s)
+    s2 := new(SpreadSheet)
+    json.Unmarshal(data, s2)
+    if d, _ := s2.GetCellDisplay("A1"); d != "Hi" {
+        t.Error(d)
+    }
+    var b bytes.Buffer
+    s.SaveCSV(&b, false)
+    s3, err := LoadCSV(&b)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if d, _ := s3.GetCellDisplay("A1"); d != "Hi" {
+        t.Error(d)
+    }
+    if d, _ := s3.GetCellDisplay("B1"); d != "#VALUE!" {
+        t.Error(d)
+    }
+    if e, _ := s.IsCellEmpty("A1"); e {
+        t.Error("empty")
+    }
+}
+
+func TestConcatenate(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("A1", "Hello")
+    s.SetCellValue("B1", "World")
+    s.SetCellValue("C1", "2.5")
+    cases := map[string]string{
+        `=CONCATENATE(A1, " ", B1)`: "Hello World",
+        `=A1&B1`: "HelloWorld",
+        `=A1&" x"&C1*2`: "Hello x5",
+        `=CONCATENATE(A1:C1)`: "HelloWorld2.5",
+        `="say ""hi"", (ok)"`: `say "hi", (ok)`,
+        `=A1`: "Hello",
+        `=D1&"!"`: "!",
+        `=IF(A1="hello","yes","no")`: "yes",
+        `=IF(A1<>"Hello","yes","no")`: "no",
+        `=1+2&3`: "33",
+        `=A1&B1="HelloWorld"`: "1",
+        `=D1`: "0",
+        `=LEN`: "",
+    }
+    for f, want := range cases {
+        if f == "=LEN" {
+            continue
+        }
+        if err := s.SetCellValue("E1", f); err != nil {
+            t.Fatal(f, err)
+        }
+        if d, _ := s.GetCellDisplay("E1"); d != want {
+            t.Errorf("%s: %q", f, d)
+        }
+    }
+    s.SetCellValue("E2", `=A1&" "&B1`)
+    s.SetCellValue("B1", "There")
+    if d, _ := s.GetCellDisplay("E2"); d != "Hello There" {
+        t.Error(d)
+    }
+    if _, err := s.GetCellValue("E2"); err != ErrValue {
+        t.Error(err)
+    }
+    s.SetCellValue("E3", "=E2&1")
+    if d, _ := s.GetCellDisplay("E3"); d != "Hello There1" {
+        t.Error(d)
+    }
+    s.SetCellValue("E4", "=-A1")
+    if _, err := s.GetCellValue("E4"); err != ErrValue {
+        t.Error(err)
+    }
+    s.CopyCell("E2", "E5")
+    if f, _, _ := s.GetCellFormula("E5"); f != `=A4&" "&B4` {
+        t.Error(f)
+    }
+    s.InsertColumn(0)
+    if f, _, _ := s.GetCellFormula("F2"); f != `=B1&" "&C1` {
+        t.Error(f)
+    }
+    for _, f := range []string{`="abc`, `="a""`, `=A1&`, `="a"b`} {
+        if s.SetCellValue("A5", f) == nil {
+            t.Error(f)
+        }
+    }
+}
+
+func TestGetCell(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("A1", "2.5")
+    s.SetCellValue("A2", "txt")
+    s.SetCellValue("A3", "=1/0")
+    s.SetCellValue("A4", "=A1*2")
+    want := map[string]CellValue{"A1": {KindNumber, 2.5}, "A2": {KindText, "txt"}, "A3": {KindError, ErrDivByZero}, "A4": {KindNumber, 5.0}, "A5": {KindEmpty, nil}}
+    for id, w := range want {
+        v, err := s.GetCell(id)
+        if err != nil || v != w {
+            t.Error(id, v, err)
+        }
+    }
+    if _, err := s.GetCell("Z9"); err == nil {
+        t.Error("bounds")
+    }
+}
+
+func TestUndoRedo(t *testing.T) {
+    s := newSheet(5, 5)
+    if s.Undo() == nil || s.Redo() == nil {
+        t.Error("empty")
+    }
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("B1", "=A1*2")
+    s.SetCellValue("A1", "5")
+    if v := cellValue(t, s, "B1"); v != 10 {
+        t.Error(v)
+    }
+    if err := s.Undo(); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "B1"); v != 2 {
+        t.Error(v)
+    }
+    s.Undo()
+    if e, _ := s.IsCellEmpty("B1"); !e {
+        t.Error("B1 not empty")
+    }
+    s.Redo()
+    if v := cellValue(t, s, "B1"); v != 2 {
+        t.Error(v)
+    }
+    s.Redo()
+    if v := cellValue(t, s, "B1"); v != 10 {
+        t.Error(v)
+    }
+    if s.Redo() == nil {
+        t.Error("redo")
+    }
+    s.ClearCell("A1")
+    if v := cellValue(t, s, "B1"); v != 0 {
+        t.Error(v)
+    }
+    s.Undo()
+    if v := cellValue(t, s, "B1"); v != 10 {
+        t.Error(v)
+    }
+    s.SetCellValues(map[string]string{"A1": "3", "A2": "hi"})
+    s.Undo()
+    if d, _ := s.GetCellDisplay("A2"); d != "" {
+        t.Error(d)
+    }
+    if v := cellValue(t, s, "A1"); v != 5 {
+        t.Error(v)
+    }
+    s.Redo()
+    if d, _ := s.GetCellDisplay("A2"); d != "hi" {
+        t.Error(d)
+    }
+    s.FillDown("B1", "B3")
+    s.Undo()
+    if e, _ := s.IsCellEmpty("B3"); !e {
+        t.Error("fill undo")
+    }
+    s.SetUndoLimit(1)
+    s.SetCellValue("C1", "1")
+    s.SetCellValue("C1", "2")
+    s.Undo()
+    if s.Undo() == nil {
+        t.Error("limit")
+    }
+    s.SetCellValue("C2", "1")
+    s.InsertRow(0)
+    if s.Undo() == nil {
+        t.Error("insert clears")
+    }
+}
+
+func TestSubscribe(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("B1", "=A1*2")
+    s.SetCellValue("C1", "=B1+1")
+    got := make([]string, 0)
+    unsub := s.Subscribe(func(id string, v CellValue) {
+        // Reading the sheet from the callback must not deadlock.
+        d, _ := s.GetCellDisplay(id)
+        got = append(got, fmt.Sprintf("%s=%v/%s", id, v.Data, d))
+    })
+    s.SetCellValue("A1", "2")
+    if strings.Join(got, ",") != "A1=2/2,B1=4/4,C1=5/5" {
+        t.Error(got)
+    }
+    got = got[:0]
+    s.SetCellValue("B1", "=A1+A1")
+    if len(got) != 0 {
+        t.Error(got)
+    }
+    s.SetCellValue("A1", "x")
+    if len(got) != 3 || got[1] != "B1=#VALUE!/#VALUE!" {
+        t.Error(got)
+    }
+    got = got[:0]
+    s.ClearCell("A1")
+    s.Undo()
+    if len(got) != 6 {
+        t.Error(got)
+    }
+    unsub()
+    got = got[:0]
+    s.SetCellValue("A1", "7")
+    if len(got) != 0 {
+        t.Error(got)
+    }
+    wb := CreateWorkbook()
+    s1, _ := wb.AddSheet("S1", 2, 2)
+    s2, _ := wb.AddSheet("S2", 2, 2)
+    s2.SetCellValue("A1", "=S1!A1")
+    n := 0
+    s2.Subscribe(func(id string, v CellValue) {
+        n++
+    })
+    s1.SetCellValue("A1", "3")
+    if n != 1 {
+        t.Error(n)
+    }
+}
+
+func TestLazyEvaluation(t *testing.T) {
+    for _, lazy := range []bool{false, true} {
+        s := newSheet(20, 5)
+        s.SetLazyEvaluation(lazy)
+        s.SetCellValue("A1", "2")
+        for i := 2; i <= 10; i++ {
+            s.SetCellValue(fmt.Sprintf("A%d", i), fmt.Sprintf("=A%d*2", i-1))
+            s.SetCellValue(fmt.Sprintf("B%d", i), fmt.Sprintf("=A1+A%d", i))
+        }
+        s.SetCellValue("A1", "3")
+        if lazy && len(s.staleCells) == 0 {
+            t.Fatal("expected stale")
+        }
+        v, _ := s.GetCellValue("A10")
+        if v != 3*512 {
+            t.Fatal(lazy, v)
+        }
+        if lazy && (s.staleCells["A5"] || !s.staleCells["B5"]) {
+            t.Fatal("memo", s.staleCells)
+        }
+        v, _ = s.GetCellValue("B10")
+        if v != 3+3*512 {
+            t.Fatal(v)
+        }
+        var got []string
+        s.Subscribe(func(id string, val CellValue) {
+            got = append(got, id)
+        })
+        s.SetCellValue("A1", "1")
+        if len(got) != 19 {
+            t.Fatal(len(got), got)
+        }
+        s.Undo()
+        if v, _ := s.GetCellValue("B2"); v != 9 {
+            t.Fatal(v)
+        }
+        s.InsertRow(1)
+        if v, _ := s.GetCellValue("B3"); v != 9 {
+            t.Fatal(v)
+        }
+        s.Resize(3, 3)
+        if v, _ := s.GetCellValue("A3"); v != 6 {
+            t.Fatal(v)
+        }
+    }
+    wb := CreateWorkbook()
+    a, _ := wb.AddSheet("A", 5, 5)
+    b, _ := wb.AddSheet("B", 5, 5)
+    b.SetLazyEvaluation(true)
+    b.SetCellValue("A1", "=A!A1*2")
+    a.SetCellValue("A2", "=B!A1+1")
+    a.SetCellValue("A1", "5")
+    if v, _ := a.GetCellValue("A2"); v != 11 {
+        t.Fatal(v)
+    }
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            b.GetCellValue("A1")
+            b.ForEachSetCell(func(string, float64) {})
+        }()
+    }
+    wg.Wait()
+}
+
+func TestLazyComputesOnce(t *testing.T) {
+    count := countComputes(t)
+    s := newSheet(3, 3)
+    s.SetLazyEvaluation(true)
+    s.SetCellValue("B1", "=A1+TICK(1)")
+    s.SetCellValue("C1", "=B1*2")
+    s.SetCellValue("C2", "=B1*3")
+    cellValue(t, s, "B1")
+    *count = 0
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("A1", "2")
+    if *count != 0 {
+        t.Error(*count)
+    }
+    if v := cellValue(t, s, "C1"); v != 4 {
+        t.Error(v)
+    }
+    if v := cellValue(t, s, "C2"); v != 6 {
+        t.Error(v)
+    }
+    cellValue(t, s, "B1")
+    if *count != 1 {
+        t.Error(*count)
+    }
+}
+
+func BenchmarkFanOut(b *testing.B) {
+    for _, lazy := range []bool{false, true} {
+        name := "eager"
+        if lazy {
+            name = "lazy"
+        }
+        b.Run(name, func(b *testing.B) {
+            s := newSheet(1000, 2)
+            s.SetLazyEvaluation(lazy)
+            dependents := make([]string, 0, 1000)
+            for row := 1; row <= 1000; row++ {
+                dependents = append(dependents, fmt.Sprintf("B%d", row))
+                s.SetCellValue(dependents[row-1], "=A1*2")
+            }
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                s.SetCellValue("A1", strconv.Itoa(i))
+                // The dependents are read in both modes, so that the lazy sheet computes them as well.
+                for _, cellId := range dependents {
+                    s.GetCellValue(cellId)
+                }
+            }
+        })
+    }
+}
+
+func BenchmarkRecompute(b *testing.B) {
+    s := newSheet(100, 2)
+    for row := 1; row <= 100; row++ {
+        s.SetCellValue(fmt.Sprintf("B%d", row), fmt.Sprintf("=A%d*2+SUM(A1:A%d)", row, row))
+    }
+    b.ReportAllocs()
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        s.SetCellValue("A1", strconv.Itoa(i))
+    }
+}
+
+func TestExprCache(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("A1", "2")
+    s.SetCellValue("B1", "=A1*3")
+    e := s.getCell(0, 1).expr
+    if e == nil {
+        t.Fatal("no expr")
+    }
+    s.SetCellValue("A1", "4")
+    if s.getCell(0, 1).expr != e || cellValue(t, s, "B1") != 12 {
+        t.Fatal("cache")
+    }
+    s.SetCellValue("B1", "=A1+1")
+    if s.getCell(0, 1).expr == e || cellValue(t, s, "B1") != 5 {
+        t.Fatal("rebuild")
+    }
+    s.DefineName("X", "A1")
+    s.SetCellValue("C1", "=X*2")
+    s.DefineName("X", "B1")
+    if cellValue(t, s, "C1") != 10 {
+        t.Fatal(cellValue(t, s, "C1"))
+    }
+    s.InsertColumn(0)
+    s.SetCellValue("B1", "1")
+    if cellValue(t, s, "C1") != 2 || cellValue(t, s, "D1") != 4 {
+        t.Fatal("insert")
+    }
+}
+
+func TestSparse(t *testing.T) {
+    s := newSparseSheet(1000000, 16000)
+    if v := cellValue(t, s, "WNP1000000"); v != 0 {
+        t.Fatal(v)
+    }
+    if n := len(s.cells.(*sparseCells).cells); n != 0 {
+        t.Fatal("allocated", n)
+    }
+    s.SetCellValue("A1", "2")
+    s.SetCellValue("B2", "=A1*3+C3")
+    if cellValue(t, s, "B2") != 6 {
+        t.Fatal()
+    }
+    s.SetCellValue("C3", "1")
+    if cellValue(t, s, "B2") != 7 {
+        t.Fatal()
+    }
+    s.InsertRow(0)
+    s.InsertColumn(0)
+    if f, _, _ := s.GetCellFormula("C3"); f != "=B2*3+D4" || cellValue(t, s, "C3") != 7 {
+        t.Fatal(f)
+    }
+    s.DeleteRow(0)
+    s.DeleteColumn(0)
+    if f, _, _ := s.GetCellFormula("B2"); f != "=A1*3+C3" {
+        t.Fatal(f)
+    }
+    var ids []string
+    s.ForEachSetCell(func(id string, v float64) {
+        ids = append(ids, id)
+    })
+    if strings.Join(ids, ",") != "A1,B2,C3" {
+        t.Fatal(ids)
+    }
+    if r, c := s.Dimensions(); r != 1000000 || c != 16000 {
+        t.Fatal(r, c)
+    }
+    if err := s.Resize(2, 2); err == nil {
+        t.Fatal("expected error")
+    }
+    s.ClearCell("B2")
+    if err := s.Resize(2, 2); err != nil {
+        t.Fatal(err)
+    }
+    data, _ := json.Marshal(s)
+    s2 := newSparseSheet(1, 1)
+    if err := json.Unmarshal(data, s2); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := s2.cells.(*sparseCells); !ok || cellValue(t, s2, "A1") != 2 {
+        t.Fatal("json")
+    }
+    var buf bytes.Buffer
+    s2.SaveCSV(&buf, false)
+    if buf.String() != "2,\n,\n" {
+        t.Fatalf("%q", buf.String())
+    }
+    s2.Undo()
+    s2.SetCellValue("B1", "=A1")
+    s2.Undo()
+    if e, _ := s2.IsCellEmpty("B1"); !e {
+        t.Fatal()
+    }
+}
+
+func TestSparseWholeColumn(t *testing.T) {
+    s := newSparseSheet(1000000, 100)
+    s.SetCellValue("A5", "3")
+    s.SetCellValue("A999999", "4")
+    if err := s.SetCellValue("B1", "=SUM(A:A)+SUM(A1:A1000000)"); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "B1"); v != 14 {
+        t.Error(v)
+    }
+    // Only the cells that are set are allocated, not the cells of the ranges.
+    if n := len(s.cells.(*sparseCells).cells); n != 3 {
+        t.Error("allocated", n)
+    }
+    s.SetCellValue("A2", "1")
+    if v := cellValue(t, s, "B1"); v != 16 {
+        t.Error(v)
+    }
+    if deps, _ := s.GetDependents("A1000000"); fmt.Sprint(deps) != "[B1]" {
+        t.Error(deps)
+    }
+    if err := s.SetCellValue("A7", "=B1"); !errors.Is(err, ErrCyclicDependency) {
+        t.Error(err)
+    }
+    if err := s.Resize(999999, 100); !errors.Is(err, ErrCellReferenced) {
+        t.Error(err)
+    }
+}
+
+func BenchmarkSheetMemory(b *testing.B) {
+    create := map[string]func(numRows, numCols int) (*SpreadSheet, error){
+        "dense": func(numRows, numCols int) (*SpreadSheet, error) {
+            return CreateSpreadSheet(numRows, numCols)
+        },
+        "sparse": func(numRows, numCols int) (*SpreadSheet, error) {
+            return CreateSparseSpreadSheet(numRows, numCols)
+        },
+    }
+    for _, name := range []string{"dense", "sparse"} {
+        b.Run(name, func(b *testing.B) {
+            b.ReportAllocs()
+            for i := 0; i < b.N; i++ {
+                s, _ := create[name](1000, 100)
+                for row := 1; row <= 100; row++ {
+                    s.SetCellValue(fmt.Sprintf("A%d", row), strconv.Itoa(row))
+                }
+                s.SetCellValue("B1", "=SUM(A1:A1000)")
+            }
+        })
+    }
+}
+
+func TestMaxCols(t *testing.T) {
+    s := newSheet(2, 30)
+    if _, c := s.Dimensions(); c != 30 {
+        t.Fatal(c)
+    }
+    s.SetCellValue("AD2", "=AA1+1")
+    if cellValue(t, s, "AD2") != 1 {
+        t.Fatal()
+    }
+    if _, err := CreateSpreadSheet(1, 16385); !errors.Is(err, ErrTooManyColumns) {
+        t.Fatal(err)
+    }
+    if _, err := CreateSparseSpreadSheet(1, 16385); !errors.Is(err, ErrTooManyColumns) {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValue("XFE1", "1"); !errors.Is(err, ErrColumnOutOfBounds) {
+        t.Fatal(err)
+    }
+    
+    if _, err := CreateSpreadSheet(1, 41, WithMaxColumns(40)); !errors.Is(err, ErrTooManyColumns) {
+        t.Fatal(err)
+    }
+    s2, err := CreateSpreadSheet(1, 40, WithMaxColumns(40))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := s2.InsertColumn(0); !errors.Is(err, ErrTooManyColumns) {
+        t.Fatal(err)
+    }
+    if err := s2.Resize(1, 41); !errors.Is(err, ErrTooManyColumns) {
+        t.Fatal(err)
+    }
+    if err := json.Unmarshal([]byte(`{"rows":1,"cols":41}`), s2); !errors.Is(err, ErrTooManyColumns) {
+        t.Fatal(err)
+    }
+    // The max of one sheet doesn't change the max of the others.
+    if _, err := CreateSpreadSheet(1, 41); err != nil {
+        t.Fatal(err)
+    }
+    if c := s2.Clone(); c.InsertColumn(0) == nil {
+        t.Fatal("clone has no max")
+    }
+    
+    big, err := CreateSparseSpreadSheet(1, 100000, WithMaxColumns(100000))
+    if err != nil {
+        t.Fatal(err)
+    }
+    big.SetCellValue("A1", "=EKPD1")
+    if _, err := big.GetCellValue("EKPD1"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestCreateInvalid(t *testing.T) {
+    for _, d := range [][2]int{{0, 3}, {3, 0}, {0, 0}, {-1, 3}, {3, -2}} {
+        if s, err := CreateSpreadSheet(d[0], d[1]); err == nil || s != nil {
+            t.Fatal(d)
+        }
+        if _, err := CreateSparseSpreadSheet(d[0], d[1]); err == nil {
+            t.Fatal(d)
+        }
+    }
+    wb := CreateWorkbook()
+    if _, err := wb.AddSheet("S", 0, 1); err == nil {
+        t.Fatal()
+    }
+    if _, err := newSheet(1, 1).GetCellValue("A1"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestZeroSheetMethods(t *testing.T) {
+    s := new(SpreadSheet)
+    cellErrors := map[string]error{}
+    cellErrors["SetCellValue"] = s.SetCellValue("A1", "1")
+    _, cellErrors["SetCellValueN"] = s.SetCellValueN("A1", "1")
+    cellErrors["SetCellValues"] = s.SetCellValues(map[string]string{"A1": "1"})
+    cellErrors["ClearCell"] = s.ClearCell("A1")
+    cellErrors["CopyCell"] = s.CopyCell("A1", "A2")
+    cellErrors["MoveCell"] = s.MoveCell("A1", "A2")
+    cellErrors["FillDown"] = s.FillDown("A1", "A2")
+    cellErrors["FillRight"] = s.FillRight("A1", "B1")
+    cellErrors["DefineName"] = s.DefineName("X", "A1")
+    _, cellErrors["GetCellValue"] = s.GetCellValue("A1")
+    _, cellErrors["Evaluate"] = s.Evaluate("=A1")
+    cellErrors["ValidateFormula"] = s.ValidateFormula("A1", "=1")
+    _, cellErrors["GetCell"] = s.GetCell("A1")
+    _, cellErrors["GetCellDisplay"] = s.GetCellDisplay("A1")
+    _, cellErrors["GetCellValueString"] = s.GetCellValueString("A1")
+    cellErrors["LockCell"] = s.LockCell("A1")
+    cellErrors["UnlockCell"] = s.UnlockCell("A1")
+    cellErrors["SetCellFormat"] = s.SetCellFormat("A1", "0.00")
+    cellErrors["SetCellComment"] = s.SetCellComment("A1", "x")
+    _, _, cellErrors["GetCellComment"] = s.GetCellComment("A1")
+    _, _, cellErrors["GetCellFormula"] = s.GetCellFormula("A1")
+    _, cellErrors["GetDependents"] = s.GetDependents("A1")
+    _, cellErrors["AffectedBy"] = s.AffectedBy("A1")
+    _, cellErrors["GetPrecedents"] = s.GetPrecedents("A1")
+    _, cellErrors["Range"] = s.Range("A1:B2")
+    _, cellErrors["IsCellEmpty"] = s.IsCellEmpty("A1")
+    for name, err := range cellErrors {
+        if !errors.Is(err, ErrRowOutOfBounds) {
+            t.Errorf("%s: %v", name, err)
+        }
+    }
+    
+    if err := s.InsertRow(0); !errors.Is(err, ErrInvalidDimensions) {
+        t.Error(err)
+    }
+    if err := s.InsertColumn(0); !errors.Is(err, ErrInvalidDimensions) {
+        t.Error(err)
+    }
+    if err := s.DeleteRow(0); !errors.Is(err, ErrIndexOutOfBounds) {
+        t.Error(err)
+    }
+    if err := s.DeleteColumn(0); !errors.Is(err, ErrIndexOutOfBounds) {
+        t.Error(err)
+    }
+    if err := s.DeleteName("X"); !errors.Is(err, ErrUndefinedName) {
+        t.Error(err)
+    }
+    if err := s.Undo(); !errors.Is(err, ErrNothingToUndo) {
+        t.Error(err)
+    }
+    if err := s.Redo(); !errors.Is(err, ErrNothingToRedo) {
+        t.Error(err)
+    }
+    if err := s.SetMaxFormulaDepth(10); err != nil {
+        t.Error(err)
+    }
+    if err := s.SetUndoLimit(10); err != nil {
+        t.Error(err)
+    }
+    s.SetLazyEvaluation(true)
+    s.SetLazyEvaluation(false)
+    s.Reset()
+    unsubscribe := s.Subscribe(func(cellId string, value CellValue) {})
+    unsubscribe()
+    s.ForEachSetCell(func(cellId string, value float64) {
+        t.Error(cellId)
+    })
+    if r, c := s.Dimensions(); r != 0 || c != 0 {
+        t.Error(r, c)
+    }
+    if r, c := s.Clone().Dimensions(); r != 0 || c != 0 {
+        t.Error(r, c)
+    }
+    if diffs, err := Diff(s, new(SpreadSheet)); err != nil || len(diffs) != 0 {
+        t.Error(diffs, err)
+    }
+    var buf bytes.Buffer
+    if err := s.SaveCSV(&buf, true); err != nil {
+        t.Error(err)
+    }
+    if err := s.Print(&buf); err != nil {
+        t.Error(err)
+    }
+    if err := s.WriteHTML(&buf); err != nil {
+        t.Error(err)
+    }
+    if _, err := json.Marshal(s); err != nil {
+        t.Error(err)
+    }
+    if err := new(SpreadSheet).Restore(s.Snapshot()); !errors.Is(err, ErrInvalidDimensions) {
+        t.Error(err)
+    }
+    
+    // Resizing gives the sheet cells with the default settings.
+    if err := s.Resize(2, 2); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValue("B2", "=A1+1"); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "B2"); v != 1 {
+        t.Error(v)
+    }
+    if err := s.Undo(); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestZeroRows(t *testing.T) {
+    for _, s := range []*SpreadSheet{new(SpreadSheet), newSpreadSheet(newDenseCells(0, 3)), newSpreadSheet(newSparseCells(0, 3))} {
+        if _, err := s.GetCellValue("A1"); err == nil {
+            t.Fatal("expected error")
+        }
+        if _, err := s.GetCell("B1"); err == nil {
+            t.Fatal("expected error")
+        }
+        if err := s.SetCellValue("A1", "1"); err == nil {
+            t.Fatal("expected error")
+        }
+    }
+    if r, c := newSpreadSheet(newDenseCells(0, 3)).Dimensions(); r != 0 || c != 3 {
+        t.Fatal(r, c)
+    }
+    s := newSheet(2, 3)
+    s.InsertColumn(1)
+    s.DeleteColumn(0)
+    s.DeleteColumn(0)
+    if _, c := s.Dimensions(); c != 2 {
+        t.Fatal(c)
+    }
+}
+
+func TestReversedRange(t *testing.T) {
+    s := newSheet(5, 5)
+    for i := 1; i <= 5; i++ {
+        s.SetCellValue(fmt.Sprintf("A%d", i), fmt.Sprint(i))
+        s.SetCellValue(fmt.Sprintf("B%d", i), fmt.Sprint(10*i))
+    }
+    s.SetCellValue("D1", "=SUM(A5:A1)")
+    s.SetCellValue("D2", "=SUM(B1:A1)")
+    s.SetCellValue("D3", "=SUM(B3:A1)")
+    s.SetCellValue("D4", "=SUM(A3:B1)")
+    if cellValue(t, s, "D1") != 15 || cellValue(t, s, "D2") != 11 || cellValue(t, s, "D3") != 66 || cellValue(t, s, "D4") != 66 {
+        t.Fatal(cellValue(t, s, "D1"), cellValue(t, s, "D2"), cellValue(t, s, "D3"), cellValue(t, s, "D4"))
+    }
+    s.SetCellValue("A2", "100")
+    if cellValue(t, s, "D1") != 113 {
+        t.Fatal()
+    }
+}
+
+func TestRangeBounds(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "1")
+    for _, f := range []string{"=SUM(A1:A9)", "=SUM(A1:Z1)", "=A1:Z99", "=D1", "=A4+1"} {
+        if err := s.SetCellValue("B1", f); err == nil {
+            t.Fatal(f)
+        }
+    }
+    if err := s.SetCellValue("B1", "=SUM(A2:C3)"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.DefineName("Big", "A1:A10"); err == nil {
+        t.Fatal("name")
+    }
+    wb := CreateWorkbook()
+    a, _ := wb.AddSheet("A", 3, 3)
+    wb.AddSheet("B", 2, 2)
+    if err := a.SetCellValue("A1", "=B!C1"); err == nil {
+        t.Fatal("cross")
+    }
+    if err := a.SetCellValue("A1", "=SUM(B!A1:B2)"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestRangeBoundsCorner(t *testing.T) {
+    s := newSheet(3, 3)
+    tests := map[string]string{
+        "=SUM(A1:ZZ20000)": "Row out of bounds: ZZ20000, sheet is 3x3",
+        "=SUM(A9:A1)": "Row out of bounds: A9, sheet is 3x3",
+        "=SUM(B2:D1)": "Column out of bounds: D1, sheet is 3x3",
+        "=SUM($A$1:$B$7)": "Row out of bounds: B7, sheet is 3x3",
+        "=SUM(A:D)": "Column out of bounds: D, sheet is 3x3",
+        "=SUM(2:5)": "Row out of bounds: 5, sheet is 3x3",
+    }
+    for formula, message := range tests {
+        start := time.Now()
+        err := s.SetCellValue("A1", formula)
+        if err == nil || err.Error() != message {
+            t.Errorf("%s: %v", formula, err)
+        }
+        // The cells of the range are not visited.
+        if elapsed := time.Since(start); elapsed > time.Second {
+            t.Errorf("%s: %v", formula, elapsed)
+        }
+    }
+}
+
+func TestSelfRef(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "5")
+    for _, f := range []string{"=A1+1", "= a1 * 2", "=SUM(A1:B2)", "=$A$1"} {
+        err := s.SetCellValue("A1", f)
+        if err == nil || !errors.Is(err, ErrCyclicDependency) {
+            t.Fatal(f, err)
+        }
+    }
+    if cellValue(t, s, "A1") != 5 {
+        t.Fatal()
+    }
+    if err := s.SetCellValues(map[string]string{"B1": "=B1"}); err == nil {
+        t.Fatal()
+    }
+    wb := CreateWorkbook()
+    a, _ := wb.AddSheet("S", 2, 2)
+    wb.AddSheet("T", 2, 2)
+    if err := a.SetCellValue("A1", "=S!A1"); err == nil {
+        t.Fatal()
+    }
+    if err := a.SetCellValue("A1", "=T!A1"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestSelfRefMessage(t *testing.T) {
+    s := newSheet(3, 3)
+    err := s.SetCellValue("A1", "=A1+1")
+    var cycleErr *CycleError
+    if !errors.As(err, &cycleErr) || !reflect.DeepEqual(cycleErr.CellIds, []string{"A1", "A1"}) {
+        t.Fatal(err)
+    }
+    if err.Error() != "Cyclic dependency: A1 refers to itself" {
+        t.Error(err)
+    }
+    s.SetCellValue("A1", "=B1")
+    if err := s.SetCellValue("B1", "=A1"); err == nil || err.Error() != "Cyclic dependency: B1 -> A1 -> B1" {
+        t.Error(err)
+    }
+}
+
+func TestTransactional(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "2")
+    s.SetCellValue("B1", "=A1*2")
+    s.SetCellValue("C1", "=B1+1")
+    for _, f := range []string{"=A1+", "=Z9", "=B1", "=FOO(1)", "=Nope!A1"} {
+        if err := s.SetCellValue("B1", f); err == nil {
+            t.Fatal(f)
+        }
+        if fm, _, _ := s.GetCellFormula("B1"); fm != "=A1*2" || cellValue(t, s, "B1") != 4 || cellValue(t, s, "C1") != 5 {
+            t.Fatal(f, fm)
+        }
+        if d, _ := s.GetDependents("A1"); len(d) != 1 || d[0] != "B1" {
+            t.Fatal(d)
+        }
+    }
+    // Fill fails at C2 with a self reference, after setting B2.
+    s.SetCellValue("A2", "=$C$2")
+    if err := s.FillRight("A2", "C2"); err == nil {
+        t.Fatal("fill")
+    }
+    if e, _ := s.IsCellEmpty("B2"); !e {
+        t.Fatal("B2 set")
+    }
+    s.Undo()
+    if e, _ := s.IsCellEmpty("A2"); !e {
+        t.Fatal("undo")
+    }
+}
+
+func TestExtractReferences(t *testing.T) {
+    refs, err := ExtractReferences("=SUM(A1:B2)+C3*2-$A$1+Sheet2!D4+IF(E5>1,\"x\",7)")
+    if err != nil || strings.Join(refs, ",") != "A1,B1,A2,B2,C3,Sheet2!D4,E5" {
+        t.Fatal(refs, err)
+    }
+    refs, err = ExtractReferences("=1+2*\"a\"")
+    if err != nil || len(refs) != 0 {
+        t.Fatal(refs, err)
+    }
+    for _, f := range []string{"=A1+", "=A0", "=SUM(A1:B)", "=Revenue*2"} {
+        if _, err := ExtractReferences(f); err == nil {
+            t.Fatal(f)
+        }
+    }
+    if _, err := ExtractReferences("=Revenue"); err != ErrName {
+        t.Fatal(err)
+    }
+}
+
+func TestPrint(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "10")
+    s.SetCellValue("B1", "hello")
+    s.SetCellValue("A2", "=A1/4")
+    s.SetCellValue("C2", "=1/0")
+    s.SetCellValue("B3", "=A1*100")
+    var buf bytes.Buffer
+    if err := s.Print(&buf); err != nil {
+        t.Fatal(err)
+    }
+    want := "   A    B      C\n" +
+        "1   10  hello\n" +
+        "2  2.5         #DIV/0!\n" +
+        "3        1000\n"
+    if buf.String() != want {
+        t.Fatalf("\n%s\n%q", buf.String(), buf.String())
+    }
+}
+
+func TestWriteHTML(t *testing.T) {
+    s := newSheet(2, 2)
+    s.SetCellValue("A1", "3")
+    s.SetCellValue("B1", "<b>&")
+    s.SetCellValue("A2", "=A1*2")
+    s.SetCellValue("B2", `=B1&"x"`)
+    var buf bytes.Buffer
+    if err := s.WriteHTML(&buf); err != nil {
+        t.Fatal(err)
+    }
+    want := "<table>\n<tr><th></th><th>A</th><th>B</th></tr>\n" +
+        "<tr><th>1</th><td>3</td><td>&lt;b&gt;&amp;</td></tr>\n" +
+        "<tr><th>2</th><td title=\"=A1*2\">6</td><td title=\"=B1&amp;&#34;x&#34;\">&lt;b&gt;&amp;x</td></tr>\n" +
+        "</table>\n"
+    if buf.String() != want {
+        t.Fatalf("%q", buf.String())
+    }
+}
+
+func TestSumIf(t *testing.T) {
+    s := newSheet(10, 3)
+    for i, v := range []string{"3", "7", "10", "-2", "5", "x", "", "5"} {
+        if v != "" {
+            s.SetCellValue(fmt.Sprintf("A%d", i+1), v)
+        }
+    }
+    cases := map[string]float64{
+        `=SUMIF(A1:A10,">5")`:  17,
+        `=SUMIF(A1:A10,"<=5")`: 11,
+        `=SUMIF(A1:A10,"=5")`:  10,
+        `=SUMIF(A1:A10,5)`:     10,
+        `=SUMIF(A1:A10,"5")`:   10,
+        `=SUMIF(A1:A10,">=7")`: 17,
+        `=SUMIF(A1:A10,"<>5")`: 18,
+        `=SUMIF(A1:A10,"=0")`:  0,
+        `=SUMIF(A1:A10,"x")`:   0,
+        `=SUMIF(A1, "<10")`:    3,
+    }
+    for f, want := range cases {
+        if err := s.SetCellValue("B1", f); err != nil {
+            t.Fatal(f, err)
+        }
+        if v := cellValue(t, s, "B1"); v != want {
+            t.Fatal(f, v, want)
+        }
+    }
+    s.SetCellValue("C1", ">6")
+    s.SetCellValue("B1", "=SUMIF(A1:A10,C1)")
+    if cellValue(t, s, "B1") != 17 {
+        t.Fatal()
+    }
+    s.SetCellValue("A9", "100")
+    if cellValue(t, s, "B1") != 117 {
+        t.Fatal("deps")
+    }
+    s.SetCellValue("C1", "<0")
+    if cellValue(t, s, "B1") != -2 {
+        t.Fatal("crit dep")
+    }
+    for _, f := range []string{`=SUMIF(A1:A3)`, `=SUMIF(1,">0")`, `=SUMIF(A1+A2,">0")`, `=SUMIF(A1:A3,">0",1)`} {
+        if err := s.SetCellValue("B2", f); err == nil {
+            t.Fatal(f)
+        }
+    }
+}
+
+func TestCountIf(t *testing.T) {
+    s := newSheet(6, 3)
+    for i, v := range []string{"-3", "0", "4", "yes", "-1"} {
+        s.SetCellValue(fmt.Sprintf("A%d", i+1), v)
+    }
+    cases := map[string]float64{
+        `=COUNTIF(A1:A6,"<0")`:   2,
+        `=COUNTIF(A1:A6,">0")`:   1,
+        `=COUNTIF(A1:A6,"=0")`:   2,
+        `=COUNTIF(A1:A6,0)`:      2,
+        `=COUNTIF(A1:A6,"=")`:    1,
+        `=COUNTIF(A1:A6,"")`:     1,
+        `=COUNTIF(A1:A6,"YES")`:  1,
+        `=COUNTIF(A1:A6,"<>0")`:  4,
+        `=COUNTIF(A1:A6,"<>no")`: 6,
+    }
+    for f, want := range cases {
+        if err := s.SetCellValue("B1", f); err != nil {
+            t.Fatal(f, err)
+        }
+        if v := cellValue(t, s, "B1"); v != want {
+            t.Fatal(f, v, want)
+        }
+    }
+}
+
+func TestMaxDepth(t *testing.T) {
+    for _, lazy := range []bool{false, true} {
+        s := newSheet(20, 2)
+        s.SetLazyEvaluation(lazy)
+        if err := s.SetMaxFormulaDepth(0); err == nil {
+            t.Fatal()
+        }
+        s.SetMaxFormulaDepth(10)
+        s.SetCellValue("A1", "1")
+        for i := 2; i <= 15; i++ {
+            s.SetCellValue(fmt.Sprintf("A%d", i), fmt.Sprintf("=A%d+1", i-1))
+        }
+        if cellValue(t, s, "A11") != 11 {
+            t.Fatal()
+        }
+        if _, err := s.GetCellValue("A12"); err != ErrDepth {
+            t.Fatal(lazy, err)
+        }
+        if _, err := s.GetCellValue("A15"); err != ErrDepth {
+            t.Fatal(err)
+        }
+        s.SetMaxFormulaDepth(20)
+        if cellValue(t, s, "A15") != 15 {
+            t.Fatal()
+        }
+        s.SetMaxFormulaDepth(10)
+        s.SetCellValue("A5", "100")
+        if cellValue(t, s, "A15") != 110 {
+            t.Fatal("chain broken")
+        }
+        d, _ := s.GetCellDisplay("A12")
+        s.SetCellValue("A5", "=A4+1")
+        if d2, _ := s.GetCellDisplay("A12"); d != "107" || d2 != "#DEPTH!" {
+            t.Fatal(d, d2)
+        }
+    }
+    s := newSheet(200001, 1)
+    s.SetCellValue("A1", "1")
+    vals := map[string]string{}
+    for i := 2; i <= 100002; i++ {
+        vals[fmt.Sprintf("A%d", i)] = fmt.Sprintf("=A%d+1", i-1)
+    }
+    s.SetCellValues(vals)
+    if cellValue(t, s, "A100001") != 100001 {
+        t.Fatal()
+    }
+    if _, err := s.GetCellValue("A100002"); err != ErrDepth {
+        t.Fatal(err)
+    }
+}
+
+func TestNoStdout(t *testing.T) {
+    r, w, _ := os.Pipe()
+    old := os.Stdout
+    os.Stdout = w
+    s := newSheet(3, 3)
+    s.GetCellValue("Z99")
+    s.GetCellValue("1A")
+    s.SetCellValue("A1", "=A1+")
+    s.SetCellValue("A1", "=FOO(1)")
+    s.SetCellValue("A1", "=A1")
+    s.SetCellValue("A1", "=ABS(1,2)")
+    s.Undo()
+    s.DeleteRow(9)
+    s.Resize(0, 0)
+    CreateSpreadSheet(0, 1)
+    CreateWorkbook().GetSheet("x")
+    LoadCSV(strings.NewReader(""))
+    w.Close()
+    os.Stdout = old
+    out, _ := io.ReadAll(r)
+    if len(out) != 0 {
+        t.Fatalf("%q", out)
+    }
+}
+
+func TestTypedErrors(t *testing.T) {
+    s := newSheet(3, 3)
+    cases := []struct {
+        err  error
+        want error
+    }{
+        {s.SetCellValue("1A", "1"), ErrInvalidColumn},
+        {s.SetCellValue("A0", "1"), ErrInvalidRow},
+        {s.SetCellValue("A4", "1"), ErrRowOutOfBounds},
+        {s.SetCellValue("D1", "1"), ErrColumnOutOfBounds},
+        {s.SetCellValue("A1", "=A9"), ErrRowOutOfBounds},
+        {s.SetCellValue("A1", "=A1"), ErrCyclicDependency},
+        {s.SetCellValue("A1", "=1+"), ErrInvalidFormula},
+        {s.SetCellValue("A1", "=(1"), ErrInvalidFormula},
+        {s.SetCellValue("A1", "=FOO(1)"), ErrInvalidFormula},
+        {s.SetCellValue("A1", "=Other!A1"), ErrUnknownSheet},
+        {s.Undo(), ErrNothingToUndo},
+        {s.Redo(), ErrNothingToRedo},
+        {s.SetUndoLimit(-1), ErrInvalidArgument},
+        {s.SetMaxFormulaDepth(0), ErrInvalidArgument},
+        {s.InsertRow(9), ErrIndexOutOfBounds},
+        {s.DeleteColumn(-1), ErrIndexOutOfBounds},
+        {s.DefineName("1x", "A1"), ErrInvalidName},
+        {s.DeleteName("nope"), ErrUndefinedName},
+    }
+    for i, c := range cases {
+        if !errors.Is(c.err, c.want) {
+            t.Error(i, c.err)
+        }
+    }
+    _, err := CreateSpreadSheet(0, 1)
+    if !errors.Is(err, ErrInvalidDimensions) {
+        t.Error(err)
+    }
+    _, err = CreateSpreadSheet(1, defaultMaxNumCols+1)
+    if !errors.Is(err, ErrTooManyColumns) {
+        t.Error(err)
+    }
+    one := newSheet(1, 1)
+    if err := one.DeleteRow(0); !errors.Is(err, ErrOnlyRowOrColumn) {
+        t.Error(err)
+    }
+    wb := CreateWorkbook()
+    wb.AddSheet("S", 2, 2)
+    if _, err := wb.AddSheet("S", 2, 2); !errors.Is(err, ErrDuplicateSheet) {
+        t.Error(err)
+    }
+    if _, err := wb.GetSheet("T"); !errors.Is(err, ErrUnknownSheet) {
+        t.Error(err)
+    }
+    var idErr *CellIdError
+    if err := s.SetCellValue("A4", "1"); !errors.As(err, &idErr) || idErr.CellId != "A4" || err.Error() != "Row out of bounds: A4, sheet is 3x3" {
+        t.Error(err)
+    }
+    var cycleErr *CycleError
+    if err := s.SetCellValue("B2", "=B2*2"); !errors.As(err, &cycleErr) || err.Error() != "Cyclic dependency: B2 refers to itself" {
+        t.Error(err)
+    }
+    var formulaErr *FormulaError
+    if err := s.SetCellValue("A1", "=1+"); !errors.As(err, &formulaErr) || formulaErr.Reason != "Dangling operator + at the end of formula" {
+        t.Error(err)
+    }
+}
+
+func TestDiamondOnce(t *testing.T) {
+    count := 0
+    formulaFunctions["TICK"] = func(values []*Value) float64 {
+        count++
+        return 0
+    }
+    defer delete(formulaFunctions, "TICK")
+    s := newSheet(4, 4)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("B1", "=A1*2")
+    s.SetCellValue("C1", "=A1*3")
+    if err := s.SetCellValue("D1", "=B1+C1+TICK(1)"); err != nil {
+        t.Fatal(err)
+    }
+    count = 0
+    s.SetCellValue("A1", "2")
+    if count != 1 || cellValue(t, s, "D1") != 10 {
+        t.Fatal(count)
+    }
+    count = 0
+    s.SetCellValues(map[string]string{"B1": "=A1", "C1": "=A1"})
+    if count != 1 || cellValue(t, s, "D1") != 4 {
+        t.Fatal(count)
+    }
+    
+    wb := CreateWorkbook()
+    s1, _ := wb.AddSheet("S1", 4, 4)
+    s2, _ := wb.AddSheet("S2", 4, 4)
+    s1.SetCellValue("A1", "1")
+    s2.SetCellValue("B1", "=S1!A1*2")
+    s1.SetCellValue("C1", "=S2!B1+A1+TICK(1)")
+    s2.SetCellValue("D1", "=S1!C1+TICK(1)")
+    count = 0
+    s1.SetCellValue("A1", "5")
+    if count != 2 || cellValue(t, s1, "C1") != 15 || cellValue(t, s2, "D1") != 15 {
+        t.Fatal(count, cellValue(t, s1, "C1"), cellValue(t, s2, "D1"))
+    }
+}
+
+func TestScientific(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "2")
+    for f, want := range map[string]float64{"=1e3+A1": 1002, "= 2.5e-1 * 4": 1, "=1E+2-A1": 98, "=1_000+1": 1001, "=2.e1": 20, "=A1-1e1": -8} {
+        if err := s.SetCellValue("B1", f); err != nil || cellValue(t, s, "B1") != want {
+            t.Fatal(f, err, cellValue(t, s, "B1"))
+        }
+    }
+    s.SetCellValue("C1", "1_000")
+    if cellValue(t, s, "C1") != 1000 {
+        t.Fatal()
+    }
+    s.SetCellValue("C1", "2.5e-1")
+    if cellValue(t, s, "C1") != 0.25 {
+        t.Fatal()
+    }
+    for _, f := range []string{"=1__000", "=1_"} {
+        if err := s.SetCellValue("B1", f); err == nil {
+            t.Fatal(f)
+        }
+    }
+    // A leading underscore starts a name rather than a number.
+    s.SetCellValue("B1", "=_1")
+    if _, err := s.GetCellValue("B1"); !errors.Is(err, ErrName) {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValue("C1", "1__0"); err != nil {
+        t.Fatal(err)
+    }
+    if d, _ := s.GetCellDisplay("C1"); d != "1__0" {
+        t.Fatal(d)
+    }
+}
+
+func TestPercent(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "200")
+    for f, want := range map[string]float64{"=50%": 0.5, "=A1*10%": 20, "=100%-25%": 0.75, "=SUM(10%,A1)": 200.1, "=1e2%": 1} {
+        if err := s.SetCellValue("B1", f); err != nil || cellValue(t, s, "B1") != want {
+            t.Fatal(f, err, cellValue(t, s, "B1"))
+        }
+    }
+    for _, f := range []string{"=50%%", "=%", "=A1%"} {
+        if err := s.SetCellValue("B1", f); err == nil {
+            t.Fatal(f)
+        }
+    }
+    s.SetCellValue("B1", "=A1*10%")
+    s.CopyCell("B1", "B2")
+    if f, _, _ := s.GetCellFormula("B2"); f != "=A2*10%" {
+        t.Fatal(f)
+    }
+}
+
+func TestEvaluate(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "4")
+    s.SetCellValue("B2", "3")
+    s.SetCellValue("C1", "hi")
+    if v, err := s.Evaluate("=A1+B2*2"); err != nil || v != 10 {
+        t.Fatal(v, err)
+    }
+    if v, err := s.Evaluate("SUM(A1:B2) + 1"); err != nil || v != 8 {
+        t.Fatal(v, err)
+    }
+    if v, err := s.Evaluate("=2*(3+4)"); err != nil || v != 14 {
+        t.Fatal(v, err)
+    }
+    if _, err := s.Evaluate("=A1/0"); !errors.Is(err, ErrDivByZero) {
+        t.Fatal(err)
+    }
+    if _, err := s.Evaluate("=C1"); !errors.Is(err, ErrValue) {
+        t.Fatal(err)
+    }
+    if _, err := s.Evaluate("=A9"); !errors.Is(err, ErrRowOutOfBounds) {
+        t.Fatal(err)
+    }
+    if _, err := s.Evaluate("=1+"); !errors.Is(err, ErrInvalidFormula) {
+        t.Fatal(err)
+    }
+    if c, _ := s.GetCell("C3"); c.Kind != KindEmpty {
+        t.Fatal(c)
+    }
+    s.SetLazyEvaluation(true)
+    s.SetCellValue("C2", "=A1*10")
+    s.SetCellValue("A1", "5")
+    if v, err := s.Evaluate("=C2+1"); err != nil || v != 51 {
+        t.Fatal(v, err)
+    }
+}
+
+func TestTransitiveCycle(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("A1", "=B1")
+    s.SetCellValue("B1", "=C1+1")
+    err := s.SetCellValue("C1", "=A1*2")
+    var cycleErr *CycleError
+    if !errors.As(err, &cycleErr) || err.Error() != "Cyclic dependency: C1 -> A1 -> B1 -> C1" {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValue("C1", "=SUM(A2:A5)"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValue("A3", "=B1"); !errors.Is(err, ErrCyclicDependency) {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValues(map[string]string{"D1": "=E1", "E1": "=D1"}); !errors.Is(err, ErrCyclicDependency) {
+        t.Fatal(err)
+    }
+    // Replacing the formula of B1 in the same batch breaks the cycle.
+    if err := s.SetCellValues(map[string]string{"C1": "=A1", "B1": "7"}); err != nil {
+        t.Fatal(err)
+    }
+    if cellValue(t, s, "C1") != 7 {
+        t.Fatal(cellValue(t, s, "C1"))
+    }
+    
+    wb := CreateWorkbook()
+    s1, _ := wb.AddSheet("S1", 3, 3)
+    s2, _ := wb.AddSheet("S2", 3, 3)
+    s1.SetCellValue("A1", "=S2!A1")
+    s2.SetCellValue("A1", "=S1!B1")
+    if err := s1.SetCellValue("B1", "=A1"); err == nil || err.Error() != "Cyclic dependency: B1 -> A1 -> S2!A1 -> B1" {
+        t.Fatal(err)
+    }
+}
+
+func TestClone(t *testing.T) {
+    for _, s := range []*SpreadSheet{newSheet(4, 4), newSparseSheet(4, 4)} {
+        s.SetCellValue("A1", "2")
+        s.SetCellValue("A2", "=A1*10")
+        s.SetCellValue("B1", "hello")
+        s.DefineName("Top", "A1")
+        s.SetCellValue("B2", "=Top+1")
+        c := s.Clone()
+        c.SetCellValue("A1", "5")
+        c.SetCellValue("B1", "bye")
+        if cellValue(t, c, "A2") != 50 || cellValue(t, c, "B2") != 6 || cellValue(t, s, "A2") != 20 || cellValue(t, s, "B2") != 3 {
+            t.Fatal(cellValue(t, c, "A2"), cellValue(t, s, "A2"))
+        }
+        if d, _ := s.GetCellDisplay("B1"); d != "hello" {
+            t.Fatal(d)
+        }
+        s.SetCellValue("A1", "7")
+        if cellValue(t, c, "A2") != 50 || cellValue(t, s, "A2") != 70 {
+            t.Fatal()
+        }
+        if err := c.Undo(); err != nil {
+            t.Fatal(err)
+        }
+        if d, _ := c.GetCellDisplay("B1"); d != "hello" {
+            t.Fatal(d)
+        }
+        if err := c.SetCellValue("A1", "=A2"); !errors.Is(err, ErrCyclicDependency) {
+            t.Fatal(err)
+        }
+        if r, cc := c.Dimensions(); r != 4 || cc != 4 {
+            t.Fatal()
+        }
+    }
+    wb := CreateWorkbook()
+    s1, _ := wb.AddSheet("S1", 2, 2)
+    s2, _ := wb.AddSheet("S2", 2, 2)
+    s2.SetCellValue("A1", "3")
+    s1.SetCellValue("A1", "=S2!A1*2")
+    s1.SetCellValue("A2", "=A1+1")
+    c := s1.Clone()
+    if f, ok, _ := c.GetCellFormula("A1"); ok || cellValue(t, c, "A1") != 6 {
+        t.Fatal(f)
+    }
+    s2.SetCellValue("A1", "4")
+    if cellValue(t, c, "A1") != 6 || cellValue(t, s1, "A1") != 8 {
+        t.Fatal()
+    }
+    c.SetCellValue("A1", "1")
+    if cellValue(t, c, "A2") != 2 || cellValue(t, s1, "A2") != 9 {
+        t.Fatal()
+    }
+}
+
+func TestDiff(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("A2", "=A1*2")
+    s.SetCellValue("C3", "x")
+    c := s.Clone()
+    if d, err := Diff(s, c); err != nil || len(d) != 0 {
+        t.Fatal(d, err)
+    }
+    c.SetCellValue("A1", "4")
+    c.SetCellValue("B1", "=A1")
+    d, err := Diff(s, c)
+    if err != nil || len(d) != 3 {
+        t.Fatal(d, err)
+    }
+    if d[0].CellId != "A1" || d[0].Old.Data != 1.0 || d[0].New.Data != 4.0 || d[0].OldFormula != "" {
+        t.Fatal(d[0])
+    }
+    if d[1].CellId != "B1" || d[1].Old.Kind != KindEmpty || d[1].NewFormula != "=A1" {
+        t.Fatal(d[1])
+    }
+    if d[2].CellId != "A2" || d[2].Old.Data != 2.0 || d[2].New.Data != 8.0 || d[2].OldFormula != "=A1*2" {
+        t.Fatal(d[2])
+    }
+    c.SetCellValue("A1", "1")
+    c.SetCellValue("B1", "")
+    c.ClearCell("B1")
+    c.SetCellValue("A2", "=A1+A1")
+    if d, _ := Diff(s, c); len(d) != 1 || d[0].CellId != "A2" || d[0].Old != d[0].New {
+        t.Fatal(d)
+    }
+    if _, err := Diff(s, newSheet(3, 4)); !errors.Is(err, ErrDimensionMismatch) {
+        t.Fatal(err)
+    }
+    if d, err := Diff(s, s); err != nil || len(d) != 0 {
+        t.Fatal(d, err)
+    }
+}
+
+func TestDanglingOperator(t *testing.T) {
+    s := newSheet(3, 3)
+    for f, msg := range map[string]string{
+        "=A1+":      "Dangling operator + at the end of formula",
+        "=+A1":      "Dangling operator + at the start of formula",
+        "= + A1":    "Dangling operator + at the start of formula",
+        "=A1++B2":   "Dangling operator + before + in formula",
+        "=A1*-":     "Dangling operator - at the end of formula",
+        "=(A1*)":    "Dangling operator * before ) in formula",
+        "=SUM(*A1)": "Dangling operator * after ( in formula",
+        "=A1<=":     "Dangling operator <= at the end of formula",
+    } {
+        err := s.SetCellValue("C3", f)
+        if !errors.Is(err, ErrDanglingOperator) || !errors.Is(err, ErrInvalidFormula) || err.Error() != msg {
+            t.Error(f, err)
+        }
+    }
+    for _, f := range []string{"=", "=SUM(1,)", "=()"} {
+        err := s.SetCellValue("C3", f)
+        if !errors.Is(err, ErrInvalidFormula) || errors.Is(err, ErrDanglingOperator) {
+            t.Error(f, err)
+        }
+    }
+    if err := s.SetCellValue("C3", "=-A1+-B2"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestRangeShapes(t *testing.T) {
+    s := newSheet(4, 4)
+    for i, v := range []string{"1", "2", "3"} {
+        s.SetCellValue(fmt.Sprintf("A%d", i+1), v)
+        s.SetCellValue(fmt.Sprintf("%c1", 'B'+i), "1"+v)
+    }
+    cases := map[string]float64{
+        "=SUM(A1:A1)": 1, "=A2:A2*2": 4, "=COUNT(A1:A1)": 1, "=AVERAGE(A3:A3)": 3,
+        "=SUM(A1:C1)": 24, "=COUNT(A1:D1)": 4, "=SUM(A1:A3)": 6, "=COUNT(A1:A4)": 3,
+        "=SUM(C1:A1)": 24, "=SUM(A3:A1)": 6, "=COUNTA(C4:C4)": 0, "=SUM($A$1:A1)": 1,
+    }
+    for f, want := range cases {
+        if err := s.SetCellValue("D4", f); err != nil || cellValue(t, s, "D4") != want {
+            t.Error(f, err, cellValue(t, s, "D4"))
+        }
+    }
+    for r, want := range map[string][]string{"A1:A1": {"A1"}, "A1:C1": {"A1", "B1", "C1"}, "A1:A3": {"A1", "A2", "A3"}} {
+        got, _ := s.Range(r)
+        if fmt.Sprint(got) != fmt.Sprint(want) {
+            t.Error(r, got)
+        }
+    }
+    s.SetCellValue("D4", "=SUM($A$1:A1)")
+    s.SetCellValue("B2", "=SUM(A1:A1)")
+    if deps, _ := s.GetDependents("A1"); fmt.Sprint(deps) != "[B2 D4]" {
+        t.Fatal(deps)
+    }
+}
+
+func TestRecalculateAll(t *testing.T) {
+    count := 0
+    formulaFunctions["TICK"] = func(values []*Value) float64 {
+        count++
+        return 0
+    }
+    defer delete(formulaFunctions, "TICK")
+    wb := CreateWorkbook()
+    wb.RecalculateAll()
+    s1, _ := wb.AddSheet("Sheet1", 3, 3)
+    s2, _ := wb.AddSheet("Sheet2", 3, 3)
+    s1.SetCellValue("C1", "5")
+    s2.SetCellValue("B1", "=Sheet1!C1+1+TICK(1)")
+    s1.SetCellValue("A1", "=Sheet2!B1*2+TICK(1)")
+    s2.SetCellValue("C3", "=Sheet1!A1+B1+TICK(1)")
+    // Stale values, as after a bulk load.
+    for _, c := range []*Cell{s1.getCell(0, 0), s2.getCell(0, 1), s2.getCell(2, 2)} {
+        zero := 0.0
+        c.value = &zero
+    }
+    notified := 0
+    s2.Subscribe(func(string, CellValue) {
+        notified++
+    })
+    count = 0
+    wb.RecalculateAll()
+    if count != 3 || cellValue(t, s1, "A1") != 12 || cellValue(t, s2, "B1") != 6 || cellValue(t, s2, "C3") != 18 || notified != 2 {
+        t.Fatal(count, notified, cellValue(t, s1, "A1"), cellValue(t, s2, "C3"))
+    }
+}
+
+func TestSnapshot(t *testing.T) {
+    for _, s := range []*SpreadSheet{newSheet(4, 4), newSparseSheet(4, 4)} {
+        s.SetCellValue("A1", "2")
+        s.SetCellValue("A2", "=A1*10")
+        s.SetCellValue("B1", "hello")
+        s.DefineName("Top", "A1")
+        s.SetCellValue("B2", "=Top+A2")
+        snap := s.Snapshot()
+        s.SetCellValue("A1", "5")
+        s.SetCellValue("B1", "bye")
+        s.SetCellValue("C3", "=B2")
+        s.DeleteName("Top")
+        changed := map[string]CellValue{}
+        s.Subscribe(func(id string, v CellValue) {
+            changed[id] = v
+        })
+        if err := s.Restore(snap); err != nil {
+            t.Fatal(err)
+        }
+        if cellValue(t, s, "A2") != 20 || cellValue(t, s, "B2") != 22 || cellValue(t, s, "C3") != 0 {
+            t.Fatal(cellValue(t, s, "A2"))
+        }
+        if d, _ := s.GetCellDisplay("B1"); d != "hello" {
+            t.Fatal(d)
+        }
+        if fmt.Sprint(len(changed)) != "5" || changed["C3"].Kind != KindEmpty || changed["A1"].Data != 2.0 {
+            t.Fatal(changed)
+        }
+        if err := s.Undo(); !errors.Is(err, ErrNothingToUndo) {
+            t.Fatal(err)
+        }
+        s.SetCellValue("A1", "3")
+        if cellValue(t, s, "B2") != 33 {
+            t.Fatal()
+        }
+        if err := s.SetCellValue("A1", "=B2"); !errors.Is(err, ErrCyclicDependency) {
+            t.Fatal(err)
+        }
+    }
+    s := newSheet(2, 2)
+    if err := s.Restore([]byte("junk")); !errors.Is(err, ErrInvalidSnapshot) {
+        t.Fatal(err)
+    }
+    big := newSheet(10, 10)
+    big.SetCellValue("J10", "=A1")
+    snap := big.Snapshot()
+    if err := s.Restore(snap); err != nil {
+        t.Fatal(err)
+    }
+    if r, c := s.Dimensions(); r != 10 || c != 10 {
+        t.Fatal(r, c)
+    }
+    n := new(SpreadSheet)
+    if err := n.Restore(snap); err != nil {
+        t.Fatal(err)
+    }
+    if f, _, _ := n.GetCellFormula("J10"); f != "=A1" {
+        t.Fatal(f)
+    }
+}
+
+func benchSheet() *SpreadSheet {
+    s := newSheet(1000, 10)
+    for r := 1; r <= 1000; r++ {
+        s.SetCellValue(fmt.Sprintf("A%d", r), fmt.Sprint(r))
+        s.SetCellValue(fmt.Sprintf("B%d", r), fmt.Sprintf("=A%d*2", r))
+    }
+    return s
+}
+
+func BenchmarkSnapshotRestore(b *testing.B) {
+    s := benchSheet()
+    for i := 0; i < b.N; i++ {
+        if err := s.Restore(s.Snapshot()); err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+func BenchmarkJSONRoundTrip(b *testing.B) {
+    s := benchSheet()
+    for i := 0; i < b.N; i++ {
+        data, _ := json.Marshal(s)
+        if err := json.Unmarshal(data, s); err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+func TestWithDefault(t *testing.T) {
+    for _, mkOpt := range []func() (*SpreadSheet, error){
+        func() (*SpreadSheet, error) { return CreateSpreadSheet(4, 4, WithDefault(1)) },
+        func() (*SpreadSheet, error) { return CreateSparseSpreadSheet(4, 4, WithDefault(1)) },
+    } {
+        s, err := mkOpt()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if cellValue(t, s, "C3") != 1 {
+            t.Fatal()
+        }
+        s.SetCellValue("D4", "=SUM(A1:C3)")
+        if cellValue(t, s, "D4") != 9 {
+            t.Fatal(cellValue(t, s, "D4"))
+        }
+        if v, err := s.Evaluate("=COUNT(A1:C3)+COUNTA(A1:A2)*10"); err != nil || v != 29 {
+            t.Fatal(v, err)
+        }
+        s.SetCellValue("C1", "4")
+        if v, err := s.Evaluate("=AVERAGE(A1:C1)"); err != nil || v != 2 {
+            t.Fatal(v, err)
+        }
+        s.ClearCell("C1")
+        s.SetCellValue("A1", "5")
+        if cellValue(t, s, "D4") != 13 {
+            t.Fatal(cellValue(t, s, "D4"))
+        }
+        s.ClearCell("A1")
+        if cellValue(t, s, "D4") != 9 || cellValue(t, s, "A1") != 1 {
+            t.Fatal()
+        }
+        if e, _ := s.IsCellEmpty("B2"); !e {
+            t.Fatal()
+        }
+        if v, err := s.Evaluate("=B2*10"); err != nil || v != 10 {
+            t.Fatal(v, err)
+        }
+        c := s.Clone()
+        if cellValue(t, c, "B2") != 1 {
+            t.Fatal()
+        }
+    }
+    s := newSheet(2, 2)
+    if cellValue(t, s, "A1") != 0 {
+        t.Fatal()
+    }
+    wb := CreateWorkbook()
+    wb.AddSheet("A", 2, 2, WithDefault(-1))
+    b, _ := wb.AddSheet("B", 2, 2)
+    b.SetCellValue("A1", "=A!B2+B2")
+    if cellValue(t, b, "A1") != -1 {
+        t.Fatal(cellValue(t, b, "A1"))
+    }
+}
+
+func TestSetCellValueN(t *testing.T) {
+    s := newSheet(5, 5)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("B1", "=A1")
+    s.SetCellValue("C1", "=A1*2")
+    s.SetCellValue("D1", "=B1+C1")
+    s.SetCellValue("E1", "=D1")
+    s.SetCellValue("A2", "=SUM(A1:E1)")
+    s.SetCellValue("B5", "=C5")
+    if n, err := s.SetCellValueN("A1", "2"); err != nil || n != 5 || cellValue(t, s, "A2") != 20 {
+        t.Fatal(n, err)
+    }
+    if n, _ := s.SetCellValueN("D1", "=B1-C1"); n != 3 {
+        t.Fatal(n)
+    }
+    if n, _ := s.SetCellValueN("C5", "1"); n != 1 {
+        t.Fatal(n)
+    }
+    if n, _ := s.SetCellValueN("E5", "x"); n != 0 {
+        t.Fatal(n)
+    }
+    if n, err := s.SetCellValueN("Z9", "1"); err == nil || n != 0 {
+        t.Fatal(n)
+    }
+    s.SetLazyEvaluation(true)
+    if n, _ := s.SetCellValueN("A1", "3"); n != 5 || cellValue(t, s, "A2") != 6 {
+        t.Fatal(n, cellValue(t, s, "A2"))
+    }
+    wb := CreateWorkbook()
+    s1, _ := wb.AddSheet("S1", 2, 2)
+    s2, _ := wb.AddSheet("S2", 2, 2)
+    s2.SetCellValue("A1", "=S1!A1")
+    s2.SetCellValue("A2", "=A1")
+    s1.SetCellValue("B1", "=S2!A2")
+    if n, _ := s1.SetCellValueN("A1", "4"); n != 3 || cellValue(t, s1, "B1") != 4 {
+        t.Fatal(n)
+    }
+}
+
+func TestComments(t *testing.T) {
+    for _, s := range []*SpreadSheet{newSheet(3, 3), newSparseSheet(3, 3)} {
+        s.SetCellValue("A1", "1")
+        s.SetCellValue("B1", "=A1*2")
+        if err := s.SetCellComment("B1", "double"); err != nil {
+            t.Fatal(err)
+        }
+        s.SetCellComment("C3", "todo")
+        if c, ok, _ := s.GetCellComment("B1"); !ok || c != "double" {
+            t.Fatal(c)
+        }
+        if _, ok, _ := s.GetCellComment("A1"); ok {
+            t.Fatal()
+        }
+        s.SetCellValue("A1", "5")
+        s.SetCellValue("B1", "=A1*3")
+        if c, _, _ := s.GetCellComment("B1"); c != "double" || cellValue(t, s, "B1") != 15 {
+            t.Fatal(c)
+        }
+        if e, _ := s.IsCellEmpty("C3"); !e {
+            t.Fatal()
+        }
+        data, _ := json.Marshal(s)
+        if !strings.Contains(string(data), `"C3":{"comment":"todo"}`) {
+            t.Fatal(string(data))
+        }
+        n := new(SpreadSheet)
+        if err := json.Unmarshal(data, n); err != nil {
+            t.Fatal(err)
+        }
+        if c, _, _ := n.GetCellComment("C3"); c != "todo" || cellValue(t, n, "B1") != 15 {
+            t.Fatal(c)
+        }
+        if c, _, _ := s.Clone().GetCellComment("B1"); c != "double" {
+            t.Fatal(c)
+        }
+        r := newSheet(1, 1)
+        r.Restore(s.Snapshot())
+        if c, _, _ := r.GetCellComment("C3"); c != "todo" {
+            t.Fatal(c)
+        }
+        s.InsertRow(0)
+        if c, _, _ := s.GetCellComment("B2"); c != "double" {
+            t.Fatal(c)
+        }
+        s.ClearCell("B2")
+        if c, _, _ := s.GetCellComment("B2"); c != "double" {
+            t.Fatal(c)
+        }
+        s.SetCellComment("B2", "")
+        if _, ok, _ := s.GetCellComment("B2"); ok {
+            t.Fatal()
+        }
+        if err := s.SetCellComment("Z9", "x"); err == nil {
+            t.Fatal()
+        }
+    }
+}
+
+func TestLockCell(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("B1", "=A1*2")
+    if err := s.LockCell("B1"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValue("B1", "5"); !errors.Is(err, ErrCellLocked) {
+        t.Fatal(err)
+    }
+    if err := s.ClearCell("B1"); !errors.Is(err, ErrCellLocked) {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValues(map[string]string{"C1": "1", "B1": "2"}); !errors.Is(err, ErrCellLocked) {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValue("A1", "4"); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "B1"); v != 8 {
+        t.Fatal(v)
+    }
+    s.SetCellValue("C2", "1")
+    s.LockCell("C2")
+    if err := s.Undo(); !errors.Is(err, ErrCellLocked) {
+        t.Fatal(err)
+    }
+    s.UnlockCell("C2")
+    if err := s.Undo(); err != nil {
+        t.Fatal(err)
+    }
+    s.UnlockCell("B1")
+    s.LockCell("A3")
+    data, _ := json.Marshal(s)
+    if !strings.Contains(string(data), `"A3":{"locked":true}`) {
+        t.Fatal(string(data))
+    }
+    c := s.Clone()
+    if err := c.SetCellValue("A3", "1"); !errors.Is(err, ErrCellLocked) {
+        t.Fatal(err)
+    }
+    r := newSheet(3, 3)
+    if err := r.Restore(s.Snapshot()); err != nil {
+        t.Fatal(err)
+    }
+    if err := r.SetCellValue("A3", "1"); !errors.Is(err, ErrCellLocked) {
+        t.Fatal(err)
+    }
+}
+
+func TestValidateFormula(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("B1", "=A1+1")
+    if err := s.ValidateFormula("C1", "=B1*2"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.ValidateFormula("c1", "B1*2"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.ValidateFormula("C1", "=D9"); !errors.Is(err, ErrRowOutOfBounds) && !errors.Is(err, ErrColumnOutOfBounds) {
+        t.Fatal(err)
+    }
+    if err := s.ValidateFormula("C1", "=B1+"); !errors.Is(err, ErrInvalidFormula) {
+        t.Fatal(err)
+    }
+    var ce *CycleError
+    if err := s.ValidateFormula("A1", "=B1"); !errors.As(err, &ce) {
+        t.Fatal(err)
+    }
+    if f, _, _ := s.GetCellFormula("A1"); f != "" {
+        t.Fatal(f)
+    }
+}
+
+func TestRangeWithSelf(t *testing.T) {
+    s := newSheet(3, 3)
+    var ce *CycleError
+    if err := s.SetCellValue("C3", "=A1:C3"); !errors.As(err, &ce) {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValue("B2", "=SUM(A1:C3)"); !errors.As(err, &ce) {
+        t.Fatal(err)
+    }
+    s.DefineName("Q", "A1:B2")
+    if err := s.SetCellValue("C3", "=SUM(Q)"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.DefineName("Q", "A1:C3"); !errors.As(err, &ce) {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValue("A1", "2"); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "C3"); v != 2 {
+        t.Fatal(v)
+    }
+}
+
+func TestNameCyclesSkipInvalidFormulas(t *testing.T) {
+    s := newSheet(4, 4)
+    s.DefineName("X", "A2:B2")
+    s.SetCellValue("D4", "=SUM(X)+1")
+    if err := s.DeleteRow(1); err != nil {
+        t.Fatal(err)
+    }
+    // The formula of D3 refers to X, which is now #REF!, and no longer parses.
+    if err := s.DefineName("Y", "A1"); err != nil {
+        t.Fatal(err)
+    }
+    s.SetCellValue("A1", "2")
+    s.SetCellValue("C1", "=Y*2")
+    if v := cellValue(t, s, "C1"); v != 4 {
+        t.Fatal(v)
+    }
+    s.SetCellValue("B1", "=SUM(Z)")
+    if err := s.DefineName("Z", "A1:B1"); !errors.Is(err, ErrCyclicDependency) {
+        t.Fatal(err)
+    }
+}
+
+func TestAffectedBy(t *testing.T) {
+    w := CreateWorkbook()
+    s, _ := w.AddSheet("S", 5, 5)
+    s2, _ := w.AddSheet("T", 5, 5)
+    s.SetCellValue("B1", "=A1*2")
+    s.SetCellValue("C1", "=B1+1")
+    s.SetCellValue("C2", "=SUM(B1:C1)")
+    s.SetCellValue("D5", "=A2")
+    s2.SetCellValue("A1", "=S!C2")
+    s2.SetCellValue("A2", "=A1")
+    got, err := s.AffectedBy("a1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if fmt.Sprint(got) != "[B1 C1 C2 T!A1 T!A2]" {
+        t.Fatal(got)
+    }
+    if v := cellValue(t, s, "C2"); v != 1 {
+        t.Fatal(v)
+    }
+    if got, _ := s.AffectedBy("E5"); len(got) != 0 {
+        t.Fatal(got)
+    }
+    if _, err := s.AffectedBy("F1"); err == nil {
+        t.Fatal()
+    }
+}
+
+func TestNumberRangeCorner(t *testing.T) {
+    s := newSheet(3, 3)
+    if err := s.SetCellValue("C3", "=A1:-1"); !errors.Is(err, ErrInvalidFormula) {
+        t.Fatal(err)
+    }
+    for _, f := range []string{"=5:A3", "=A1:5", "=SUM(0:A3)", "=A1:1.5"} {
+        err := s.SetCellValue("C3", f)
+        if !errors.Is(err, ErrInvalidFormula) || !strings.Contains(err.Error(), "is not a cell ID in range") {
+            t.Fatal(f, err)
+        }
+    }
+    if err := s.SetCellValue("C3", "=5+A1:A2-0"); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "C3"); v != 5 {
+        t.Fatal(v)
+    }
+}
+
+func TestOverflow(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "1e308")
+    s.SetCellValue("A2", "1e308")
+    s.SetCellValue("B1", "=SUM(A1:A2)")
+    s.SetCellValue("B2", "=A1*10")
+    s.SetCellValue("B3", "=B1-1")
+    for _, id := range []string{"B1", "B2", "B3"} {
+        if _, err := s.GetCellValue(id); !errors.Is(err, ErrNum) {
+            t.Fatal(id, err)
+        }
+    }
+    if _, err := s.Evaluate("A1+A2"); !errors.Is(err, ErrNum) {
+        t.Fatal(err)
+    }
+    s.SetCellValue("A2", "-1e308")
+    if v := cellValue(t, s, "B1"); v != 0 {
+        t.Fatal(v)
+    }
+}
+
+func TestGetCellValueString(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "2.50")
+    s.SetCellValue("B1", "=A1/0")
+    s.SetCellValue("C1", "hi")
+    s.SetCellValue("A2", "=A1*2")
+    want := map[string]string{"A1": "2.5", "B1": "#DIV/0!", "C1": "hi", "A2": "5", "C3": ""}
+    for id, w := range want {
+        if got, err := s.GetCellValueString(id); err != nil || got != w {
+            t.Fatal(id, got, err)
+        }
+    }
+    s.InsertColumn(0)
+    s.SetCellValue("A3", "=B1")
+    s.DeleteColumn(1)
+    if got, _ := s.GetCellValueString("A3"); got != "#REF!" {
+        t.Fatal(got)
+    }
+}
+
+func TestCellFormat(t *testing.T) {
+    s := newSheet(4, 4)
+    s.SetCellValue("A1", "1234567.891")
+    s.SetCellValue("A2", "0.5")
+    s.SetCellValue("A3", "-1234.5")
+    s.SetCellValue("A4", "=A1/0")
+    cases := []struct{ id, format, want string }{
+        {"A1", "#,##0.00", "1,234,567.89"},
+        {"A1", "#,##0", "1,234,568"},
+        {"A1", "0", "1234568"},
+        {"A2", "0.000", "0.500"},
+        {"A2", "#.0", ".5"},
+        {"A2", "0%", "50%"},
+        {"A2", "000", "001"},
+        {"A3", "#,##0.00", "-1,234.50"},
+        {"A4", "0.00", "#DIV/0!"},
+        {"B1", "0.00", ""},
+    }
+    for _, c := range cases {
+        if err := s.SetCellFormat(c.id, c.format); err != nil {
+            t.Fatal(err)
+        }
+        if got, _ := s.GetCellValueString(c.id); got != c.want {
+            t.Fatal(c, got)
+        }
+    }
+    s.SetCellValue("B2", "=-0.001")
+    s.SetCellFormat("B2", "0.00")
+    if got, _ := s.GetCellValueString("B2"); got != "0.00" {
+        t.Fatal(got)
+    }
+    if v := cellValue(t, s, "A1"); v != 1234567.891 {
+        t.Fatal(v)
+    }
+    for _, f := range []string{",", "#.#", "0.", "abc", "%", "0.0.0"} {
+        if err := s.SetCellFormat("A1", f); !errors.Is(err, ErrInvalidArgument) {
+            t.Fatal(f, err)
+        }
+    }
+    s.SetCellFormat("A1", "#,##0.00")
+    data, _ := json.Marshal(s)
+    s2 := newSheet(1, 1)
+    if err := json.Unmarshal(data, s2); err != nil {
+        t.Fatal(err)
+    }
+    if got, _ := s2.GetCellValueString("A1"); got != "1,234,567.89" {
+        t.Fatal(got)
+    }
+    r := newSheet(1, 1)
+    r.Restore(s.Snapshot())
+    if got, _ := r.GetCellValueString("A1"); got != "1,234,567.89" {
+        t.Fatal(got)
+    }
+    if got, _ := s.Clone().GetCellValueString("A1"); got != "1,234,567.89" {
+        t.Fatal(got)
+    }
+    var buf bytes.Buffer
+    s.SaveCSV(&buf, false)
+    if !strings.HasPrefix(buf.String(), "1234567.891,") {
+        t.Fatal(buf.String())
+    }
+    s.SetCellFormat("A1", "")
+    if got, _ := s.GetCellValueString("A1"); got != "1234567.891" {
+        t.Fatal(got)
+    }
+}
+
+func TestReset(t *testing.T) {
+    for _, s := range []*SpreadSheet{newSheet(4, 4), newSparseSheet(4, 4)} {
+        s.SetCellValue("A1", "2")
+        s.SetCellValue("B1", "=A1*3")
+        s.SetCellValue("C1", "=SUM(A1:B1)")
+        s.SetCellValue("D4", "hi")
+        s.SetCellComment("A2", "note")
+        s.LockCell("A3")
+        got := make(map[string]CellValue)
+        s.Subscribe(func(cellId string, value CellValue) {
+            got[cellId] = value
+        })
+        s.Reset()
+        if len(got) != 4 {
+            t.Fatal(got)
+        }
+        for _, id := range []string{"A1", "B1", "C1", "D4", "A2"} {
+            if empty, _ := s.IsCellEmpty(id); !empty {
+                t.Fatal(id)
+            }
+            if deps, _ := s.GetDependents(id); len(deps) != 0 {
+                t.Fatal(id, deps)
+            }
+        }
+        if _, ok, _ := s.GetCellComment("A2"); ok {
+            t.Fatal()
+        }
+        if err := s.SetCellValue("A3", "1"); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.Undo(); err != nil {
+            t.Fatal(err)
+        }
+        if err := s.Undo(); !errors.Is(err, ErrNothingToUndo) {
+            t.Fatal(err)
+        }
+    }
+    w := CreateWorkbook()
+    a, _ := w.AddSheet("A", 2, 2)
+    b, _ := w.AddSheet("B", 2, 2)
+    a.SetCellValue("A1", "5")
+    a.SetCellValue("B1", "=B!A1")
+    b.SetCellValue("A1", "=A!A1*2")
+    a.Reset()
+    if v := cellValue(t, b, "A1"); v != 0 {
+        t.Fatal(v)
+    }
+    a.SetCellValue("A1", "4")
+    if v := cellValue(t, b, "A1"); v != 8 {
+        t.Fatal(v)
+    }
+    if deps, _ := b.GetDependents("A1"); len(deps) != 0 {
+        t.Fatal(deps)
+    }
+}
+
+func TestMoveCell(t *testing.T) {
+    w := CreateWorkbook()
+    s, _ := w.AddSheet("S", 4, 4)
+    o, _ := w.AddSheet("O", 2, 2)
+    s.SetCellValue("A1", "3")
+    s.SetCellValue("B1", "=A1*2")
+    s.SetCellValue("C1", "=$A$1+SUM(A1:A2)")
+    s.SetCellValue("D1", "=B1+1")
+    s.SetCellComment("A1", "c")
+    s.DefineName("X", "A1")
+    o.SetCellValue("A1", "=S!A1")
+    got := make(map[string]CellValue)
+    s.Subscribe(func(cellId string, value CellValue) {
+        got[cellId] = value
+    })
+    if err := s.MoveCell("a1", "D4"); err != nil {
+        t.Fatal(err)
+    }
+    for id, want := range map[string]string{"B1": "=D4*2", "C1": "=$D$4+SUM(A1:A2)", "D4": ""} {
+        f, _, _ := s.GetCellFormula(id)
+        if f != want {
+            t.Fatal(id, f)
+        }
+    }
+    if f, _, _ := o.GetCellFormula("A1"); f != "=S!D4" {
+        t.Fatal(f)
+    }
+    if v := cellValue(t, s, "D4"); v != 3 {
+        t.Fatal(v)
+    }
+    if v := cellValue(t, s, "B1"); v != 6 {
+        t.Fatal(v)
+    }
+    if v := cellValue(t, s, "C1"); v != 3 {
+        t.Fatal(v)
+    }
+    if empty, _ := s.IsCellEmpty("A1"); !empty {
+        t.Fatal()
+    }
+    if c, ok, _ := s.GetCellComment("D4"); !ok || c != "c" {
+        t.Fatal(c)
+    }
+    if _, ok := got["A1"]; !ok {
+        t.Fatal(got)
+    }
+    if _, ok := got["D4"]; !ok {
+        t.Fatal(got)
+    }
+    s.SetCellValue("D4", "5")
+    if v := cellValue(t, o, "A1"); v != 5 {
+        t.Fatal(v)
+    }
+    s.SetCellValue("A3", "=X")
+    if v := cellValue(t, s, "A3"); v != 5 {
+        t.Fatal(v)
+    }
+    // Moving a formula cell: refs in it are kept.
+    if err := s.MoveCell("D1", "D2"); err != nil {
+        t.Fatal(err)
+    }
+    if f, _, _ := s.GetCellFormula("D2"); f != "=B1+1" {
+        t.Fatal(f)
+    }
+    var ce *CycleError
+    if err := s.MoveCell("D2", "B1"); !errors.As(err, &ce) {
+        t.Fatal(err)
+    }
+    if err := s.MoveCell("B1", "D3"); err != nil {
+        t.Fatal(err)
+    }
+    if f, _, _ := s.GetCellFormula("D2"); f != "=D3+1" {
+        t.Fatal(f)
+    }
+    s.LockCell("A4")
+    if err := s.MoveCell("D3", "A4"); !errors.Is(err, ErrCellLocked) {
+        t.Fatal(err)
+    }
+}
+
+func TestIterativeCalculation(t *testing.T) {
+    s, _ := CreateSpreadSheet(3, 3, WithIterativeCalculation(100, 1e-9))
+    if err := s.SetCellValue("A1", "=B1*0.5+10"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValue("B1", "=A1"); err != nil {
+        t.Fatal(err)
+    }
+    s.SetCellValue("C1", "=A1+B1")
+    if v := cellValue(t, s, "A1"); math.Abs(v-20) > 1e-6 {
+        t.Fatal(v)
+    }
+    if v := cellValue(t, s, "C1"); math.Abs(v-40) > 1e-6 {
+        t.Fatal(v)
+    }
+    // Acyclic formulas work as before, even with 1 iteration.
+    s1, _ := CreateSpreadSheet(3, 3, WithIterativeCalculation(1, 0))
+    s1.SetCellValue("A1", "2")
+    s1.SetCellValue("B1", "=A1*2")
+    s1.SetCellValue("A1", "3")
+    if v := cellValue(t, s1, "B1"); v != 6 {
+        t.Fatal(v)
+    }
+    // Diverging.
+    s2, _ := CreateSpreadSheet(3, 3, WithIterativeCalculation(50, 0.001))
+    s2.SetCellValue("A1", "=B1+1")
+    s2.SetCellValue("B1", "=A1")
+    s2.SetCellValue("C1", "=A1")
+    s2.SetCellValue("C2", "5")
+    for _, id := range []string{"A1", "B1", "C1"} {
+        if _, err := s2.GetCellValue(id); !errors.Is(err, ErrNum) {
+            t.Fatal(id, err)
+        }
+    }
+    if v := cellValue(t, s2, "C2"); v != 5 {
+        t.Fatal(v)
+    }
+    s2.SetCellValue("B1", "1")
+    if v := cellValue(t, s2, "C1"); v != 2 {
+        t.Fatal(v)
+    }
+    // Without the option, cycles are errors.
+    var ce *CycleError
+    if err := newSheet(2, 2).SetCellValue("A1", "=A1"); !errors.As(err, &ce) {
+        t.Fatal(err)
+    }
+    c := s.Clone()
+    c.SetCellValue("A1", "=B1*0.5+20")
+    if v := cellValue(t, c, "B1"); math.Abs(v-40) > 1e-6 {
+        t.Fatal(v)
+    }
+    // The cycle is restored from a snapshot and from JSON.
+    r, _ := CreateSpreadSheet(3, 3, WithIterativeCalculation(100, 1e-9))
+    if err := r.Restore(s.Snapshot()); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, r, "C1"); math.Abs(v-40) > 1e-6 {
+        t.Fatal(v)
+    }
+    data, err := json.Marshal(s)
+    if err != nil {
+        t.Fatal(err)
+    }
+    j, _ := CreateSpreadSheet(3, 3, WithIterativeCalculation(100, 1e-9))
+    if err := json.Unmarshal(data, j); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, j, "A1"); math.Abs(v-20) > 1e-6 {
+        t.Fatal(v)
+    }
+}
+
+func TestUnknownOperator(t *testing.T) {
+    s := newSheet(3, 3)
+    for f, want := range map[string]string{
+        "=A1^2":      "Unknown operator ^ at position 4 in formula",
+        "= 1 + A1@2": "Unknown operator @ at position 9 in formula",
+        "=A1%":       "Unknown operator % at position 4 in formula",
+        "=A1;B2":     "Unknown operator ; at position 4 in formula",
+    } {
+        err := s.SetCellValue("C3", f)
+        if !errors.Is(err, ErrInvalidFormula) || err.Error() != want {
+            t.Fatal(f, err)
+        }
+    }
+    for _, f := range []string{"=A1&B2", "=5%", "=1e-3+2.5E+2", "=\"a^b\"&A1", "=$A$1+SUM(A1 : B2)"} {
+        if err := s.SetCellValue("C3", f); err != nil {
+            t.Fatal(f, err)
+        }
+    }
+}
+
+func TestTrailingNewline(t *testing.T) {
+    s := newSheet(3, 3)
+    for v, want := range map[string]float64{"10\n": 10, "10\r\n": 10, "  10  ": 10, "\t2.5e1 \r\n": 25} {
+        if err := s.SetCellValue("A1", v); err != nil {
+            t.Fatal(err)
+        }
+        if got := cellValue(t, s, "A1"); got != want {
+            t.Fatal(v, got)
+        }
+    }
+    s.SetCellValue("B1", "=A1*2\r\n")
+    if f, _, _ := s.GetCellFormula("B1"); f != "=A1*2" {
+        t.Fatalf("%q", f)
+    }
+    s.SetCellValue("C1", "hi there \n")
+    if d, _ := s.GetCellDisplay("C1"); d != "hi there" {
+        t.Fatalf("%q", d)
+    }
+    s.SetCellValues(map[string]string{"A2": "3\n", "B2": "=A2+1\n"})
+    if v := cellValue(t, s, "B2"); v != 4 {
+        t.Fatal(v)
+    }
+    if err := s.SetCellValue("C2", "\r\n"); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestRange(t *testing.T) {
+    w := CreateWorkbook()
+    s, _ := w.AddSheet("S", 3, 3)
+    w.AddSheet("T", 2, 2)
+    for r, want := range map[string]string{
+        "A1:B2":    "[A1 B1 A2 B2]",
+        "c3:b2":    "[B2 C2 B3 C3]",
+        " A2 ":     "[A2]",
+        "$A$1:A2":  "[A1 A2]",
+        "T!A1:A2":  "[T!A1 T!A2]",
+        "S!A1":     "[A1]",
+    } {
+        got, err := s.Range(r)
+        if err != nil || fmt.Sprint(got) != want {
+            t.Fatal(r, got, err)
+        }
+    }
+    if _, err := s.Range("A1:D2"); !errors.Is(err, ErrColumnOutOfBounds) {
+        t.Fatal(err)
+    }
+    if _, err := s.Range("T!A1:A3"); !errors.Is(err, ErrRowOutOfBounds) {
+        t.Fatal(err)
+    }
+    for _, r := range []string{"5", "A1:5", "X!A1", "A1:B2:C3", ""} {
+        if _, err := s.Range(r); err == nil {
+            t.Fatal(r)
+        }
+    }
+}
+
+func TestRangeCorners(t *testing.T) {
+    s := newSheet(3, 3)
+    for r, message := range map[string]string{
+        "A1:ZZ20000": "Row out of bounds: ZZ20000, sheet is 3x3",
+        "A5:B1": "Row out of bounds: A5, sheet is 3x3",
+        "B1:XFD1": "Column out of bounds: XFD1, sheet is 3x3",
+    } {
+        start := time.Now()
+        cellIds, err := s.Range(r)
+        if err == nil || err.Error() != message || cellIds != nil {
+            t.Error(r, cellIds, err)
+        }
+        if elapsed := time.Since(start); elapsed > time.Second {
+            t.Error(r, elapsed)
+        }
+    }
+}
+
+func TestDeterministicOrder(t *testing.T) {
+    run := func() string {
+        w := CreateWorkbook()
+        b, _ := w.AddSheet("B", 3, 3)
+        a, _ := w.AddSheet("A", 3, 3)
+        var log []string
+        var order []string
+        formulaFunctions["TRACE"] = func(values []*Value) float64 {
+            order = append(order, fmt.Sprint(values[0].number))
+            return 0
+        }
+        defer delete(formulaFunctions, "TRACE")
+        b.SetCellValue("A1", "1")
+        b.SetCellValue("C1", "=TRACE(3)+A1")
+        b.SetCellValue("B2", "=TRACE(2)+A1")
+        b.SetCellValue("A3", "=TRACE(4)+A1+C1")
+        a.SetCellValue("A1", "=TRACE(1)+B!A1")
+        for i := 0; i < 3; i++ {
+            n := i
+            a.Subscribe(func(cellId string, value CellValue) {
+                log = append(log, fmt.Sprint(n, "A!", cellId))
+            })
+            b.Subscribe(func(cellId string, value CellValue) {
+                log = append(log, fmt.Sprint(n, cellId))
+            })
+        }
+        order = nil
+        b.SetCellValue("A1", "2")
+        return fmt.Sprint(order, log)
+    }
+    first := run()
+    if !strings.HasPrefix(first, "[1 3 2 4]") {
+        t.Fatal(first)
+    }
+    for i := 0; i < 20; i++ {
+        if got := run(); got != first {
+            t.Fatal(got, first)
+        }
+    }
+}
+
+func TestWholeColumnRow(t *testing.T) {
+    w := CreateWorkbook()
+    s, _ := w.AddSheet("S", 4, 3)
+    o, _ := w.AddSheet("O", 2, 2)
+    s.SetCellValue("A1", "1")
+    s.SetCellValue("A3", "2")
+    s.SetCellValue("B1", "10")
+    s.SetCellValue("C4", "=SUM(A:A)")
+    s.SetCellValue("C3", "=SUM(1:1)")
+    s.SetCellValue("C2", "=SUM($A:$B)+0")
+    o.SetCellValue("A1", "=SUM(S!A:A)+SUM(S!1:1)")
+    for id, want := range map[string]float64{"C4": 3, "C3": 11, "C2": 13} {
+        if v := cellValue(t, s, id); v != want {
+            t.Fatal(id, v)
+        }
+    }
+    if v := cellValue(t, o, "A1"); v != 14 {
+        t.Fatal(v)
+    }
+    s.SetCellValue("A4", "5")
+    if v := cellValue(t, s, "C4"); v != 8 {
+        t.Fatal(v)
+    }
+    var ce *CycleError
+    if err := s.SetCellValue("A2", "=SUM(A:A)"); !errors.As(err, &ce) {
+        t.Fatal(err)
+    }
+    if err := s.SetCellValue("C1", "=SUM(C:C)"); !errors.As(err, &ce) {
+        t.Fatal(err)
+    }
+    // Grows and shrinks with the sheet.
+    if err := s.Resize(5, 3); err != nil {
+        t.Fatal(err)
+    }
+    s.SetCellValue("A5", "100")
+    if v := cellValue(t, s, "C4"); v != 108 {
+        t.Fatal(v)
+    }
+    if err := s.Resize(4, 3); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "C4"); v != 8 {
+        t.Fatal(v)
+    }
+    s.SetCellValue("B2", "=A4")
+    if err := s.Resize(3, 3); !errors.Is(err, ErrCellReferenced) {
+        t.Fatal(err)
+    }
+    s.ClearCell("B2")
+    if err := s.DefineName("ColA", "A:A"); err != nil {
+        t.Fatal(err)
+    }
+    s.SetCellValue("B4", "=SUM(ColA)")
+    if v := cellValue(t, s, "B4"); v != 8 {
+        t.Fatal(v)
+    }
+    if got, _ := s.Range("2:2"); fmt.Sprint(got) != "[A2 B2 C2]" {
+        t.Fatal(got)
+    }
+    for _, f := range []string{"=SUM(5:A3)", "=SUM(A:3)", "=SUM(D:D)", "=SUM(0:0)", "=SUM(5:5)"} {
+        if err := s.SetCellValue("B3", f); err == nil {
+            t.Fatal(f)
+        }
+    }
+}
+
+func TestWholeColumnRowRemoved(t *testing.T) {
+    setup := func(formula string) *SpreadSheet {
+        s := newSheet(3, 3)
+        s.SetCellValue("A3", "4")
+        s.SetCellValue("C1", "5")
+        s.SetCellValue("C3", "6")
+        if err := s.SetCellValue("B1", formula); err != nil {
+            t.Fatal(err)
+        }
+        return s
+    }
+    
+    // Resizing the sheet may not remove the columns or rows of a range of whole columns or rows.
+    s := setup("=SUM(3:3)")
+    if err := s.Resize(2, 3); !errors.Is(err, ErrCellReferenced) || err.Error() != "Cell is referred to by a formula: A3 is referred to by B1" {
+        t.Fatal(err)
+    }
+    s = setup("=SUM(C:C)")
+    if err := s.Resize(3, 2); !errors.Is(err, ErrCellReferenced) || err.Error() != "Cell is referred to by a formula: C1 is referred to by B1" {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "B1"); v != 11 {
+        t.Fatal(v)
+    }
+    // The rows of whole columns and the columns of whole rows may be removed.
+    if err := s.Resize(2, 3); err != nil {
+        t.Fatal(err)
+    }
+    if v := cellValue(t, s, "B1"); v != 5 {
+        t.Fatal(v)
+    }
+    
+    // Deleting a row or column moves the whole rows or columns after it.
+    s = setup("=SUM(3:3)")
+    if err := s.DeleteRow(1); err != nil {
+        t.Fatal(err)
+    }
+    if formula, _, _ := s.GetCellFormula("B1"); formula != "=SUM(2:2)" {
+        t.Fatal(formula)
+    }
+    if v := cellValue(t, s, "B1"); v != 10 {
+        t.Fatal(v)
+    }
+    s = setup("=SUM(C:C)")
+    if err := s.DeleteColumn(0); err != nil {
+        t.Fatal(err)
+    }
+    if formula, _, _ := s.GetCellFormula("A1"); formula != "=SUM(B:B)" {
+        t.Fatal(formula)
+    }
+    if v := cellValue(t, s, "A1"); v != 11 {
+        t.Fatal(v)
+    }
+    
+    // Deleting the only row or column of the range makes it #REF!.
+    s = setup("=SUM(3:3)")
+    if err := s.DeleteRow(2); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := s.GetCellValue("B1"); !errors.Is(err, ErrRef) {
+        t.Fatal(err)
+    }
+    s = setup("=SUM(2:$3)")
+    if err := s.DeleteRow(2); err != nil {
+        t.Fatal(err)
+    }
+    if formula, _, _ := s.GetCellFormula("B1"); formula != "=SUM(2:$2)" {
+        t.Fatal(formula)
+    }
+    
+    // Deleting a row doesn't change whole columns, nor does deleting a column change whole rows.
+    s = setup("=SUM(C:C)")
+    if err := s.DeleteRow(2); err != nil {
+        t.Fatal(err)
+    }
+    if formula, _, _ := s.GetCellFormula("B1"); formula != "=SUM(C:C)" {
+        t.Fatal(formula)
+    }
+    s = setup("=SUM(3:3)")
+    if err := s.DeleteColumn(2); err != nil {
+        t.Fatal(err)
+    }
+    if formula, _, _ := s.GetCellFormula("B1"); formula != "=SUM(3:3)" {
+        t.Fatal(formula)
+    }
+    
+    // Whole columns and rows outside the sheet have no cells.
+    wholeColumns := &CellRange{col1: 2, col2: 4, wholeColumns: true}
+    if top, left, bottom, right := wholeColumns.getBounds(s); top != 0 || left != 2 || bottom != 2 || right != 1 {
+        t.Fatal(top, left, bottom, right)
+    }
+    wholeRows := &CellRange{row1: 5, row2: 3, wholeRows: true}
+    if top, left, bottom, right := wholeRows.getBounds(s); top != 3 || left != 0 || bottom != 2 || right != 1 {
+        t.Fatal(top, left, bottom, right)
+    }
+}
+
+func TestWholeColumnRowMoved(t *testing.T) {
+    s := newSheet(3, 3)
+    s.SetCellValue("A1", "=SUM(B:C)+SUM($2:2)")
+    if err := s.InsertColumn(1); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.InsertRow(0); err != nil {
+        t.Fatal(err)
+    }
+    if formula, _, _ := s.GetCellFormula("A2"); formula != "=SUM(C:D)+SUM($3:3)" {
+        t.Fatal(formula)
+    }
+    
+    // Copying moves relative columns and rows, and not whole columns by rows or whole rows by
+    // columns.
+    s = newSheet(4, 4)
+    s.SetCellValue("D4", "=SUM(B:B)")
+    for dst, want := range map[string]string{"B3": "=SUM(#REF!)", "C4": "=SUM(A:A)"} {
+        if err := s.CopyCell("D4", dst); err != nil {
+            t.Fatal(err)
+        }
+        if formula, _, _ := s.GetCellFormula(dst); formula != want {
+            t.Error(dst, formula)
+        }
+    }
+    s.SetCellValue("C3", "=SUM(B:B)+SUM(2:2)+SUM($A:$A)")
+    for dst, want := range map[string]string{
+        "D4": "=SUM(C:C)+SUM(3:3)+SUM($A:$A)",
+        "B2": "=SUM(A:A)+SUM(1:1)+SUM($A:$A)",
+        "B1": "=SUM(A:A)+SUM(#REF!)+SUM($A:$A)",
+    } {
+        if err := s.CopyCell("C3", dst); err != nil {
+            t.Fatal(err)
+        }
+        if formula, _, _ := s.GetCellFormula(dst); formula != want {
+            t.Error(dst, formula)
+        }
+    }
+}
+
+func TestOutOfBoundsDimensions(t *testing.T) {
+    s := newSheet(3, 3)
+    _, err := s.GetCellValue("C9")
+    var idErr *CellIdError
+    if !errors.As(err, &idErr) || idErr.NumRows != 3 || idErr.NumCols != 3 ||
+        !strings.Contains(err.Error(), "sheet is 3x3") || !strings.Contains(err.Error(), "C9") {
+        t.Fatal(err)
+    }
+    _, err = s.GetCellValue("Z1")
+    if !errors.Is(err, ErrColumnOutOfBounds) || err.Error() != "Column out of bounds: Z1, sheet is 3x3" {
+        t.Fatal(err)
+    }
+    if _, err = s.GetCellValue("1A"); err == nil || strings.Contains(err.Error(), "sheet is") {
+        t.Fatal(err)
+    }
+}